@@ -0,0 +1,177 @@
+package communityinsights
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.app/packages/llmservice"
+	"encore.dev/rlog"
+	"github.com/samber/lo"
+)
+
+// messageAnalysisVersion identifies the prompt & model of cached analyses,
+// bump it when changing either so recomputed hours are analyzed again
+const messageAnalysisVersion = "gpt-3.5-turbo-0613/v1"
+
+const analysisBatchSize = 25
+
+// hourlyAnalysisTokenBudget caps the estimated tokens spent analyzing the messages of one hour per run.
+// Messages over the budget are left out of the topic, sentiment & language insights of the hour & counted
+// as skipped messages of its bucket. They're not retried automatically: recomputing the hour reuses the
+// cached analyses & spends the budget on the skipped messages, see RecomputeInsights.
+const hourlyAnalysisTokenBudget = 50000
+
+// charsPerToken estimates the tokens of a message, so the budget is enforced before calling the API
+const charsPerToken = 4
+
+// analysisTokenOverhead estimates the tokens each message adds besides its content, ie its analysis
+const analysisTokenOverhead = 30
+
+// analyzeMessages returns the analyses of the messages of an hour, by message ID.
+// Cached analyses are reused, a failing batch only leaves its own messages unanalyzed.
+func (s *Service) analyzeMessages(
+	ctx context.Context, messages []*models.DiscordRawMessage, bucketStart time.Time,
+) (map[string]*llmservice.MessageAnalysis, error) {
+	analyses, err := getCachedMessageAnalyses(ctx, lo.Map(messages, func(msg *models.DiscordRawMessage, _ int) string {
+		return msg.ID
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var uncached []*models.DiscordRawMessage
+	estimatedTokens := 0
+	for _, msg := range messages {
+		if _, ok := analyses[msg.ID]; ok {
+			continue
+		}
+
+		tokens := len(msg.CleanContent)/charsPerToken + analysisTokenOverhead
+		if estimatedTokens+tokens > hourlyAnalysisTokenBudget {
+			rlog.Warn("Hourly analysis budget exhausted", "bucketStart", bucketStart)
+			break
+		}
+
+		estimatedTokens += tokens
+		uncached = append(uncached, msg)
+	}
+
+	optedOut, err := listSentimentOptOuts(ctx, lo.Map(uncached, func(msg *models.DiscordRawMessage, _ int) string {
+		return msg.AuthorID
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// messages of authors who opted out are batched apart & analyzed without asking for their sentiment
+	var withSentiment, withoutSentiment []*models.DiscordRawMessage
+	for _, msg := range uncached {
+		if optedOut[msg.AuthorID] {
+			withoutSentiment = append(withoutSentiment, msg)
+		} else {
+			withSentiment = append(withSentiment, msg)
+		}
+	}
+
+	type analysisBatch struct {
+		messages      []*models.DiscordRawMessage
+		withSentiment bool
+	}
+	var batches []analysisBatch
+	for _, chunk := range lo.Chunk(withSentiment, analysisBatchSize) {
+		batches = append(batches, analysisBatch{messages: chunk, withSentiment: true})
+	}
+	for _, chunk := range lo.Chunk(withoutSentiment, analysisBatchSize) {
+		batches = append(batches, analysisBatch{messages: chunk})
+	}
+
+	var lastErr error
+	failedBatches := 0
+	for _, batch := range batches {
+		batchAnalyses, err := s.llmService.AnalyzeMessages(ctx, batch.messages, insightTopics, batch.withSentiment)
+		if err != nil {
+			rlog.Error("Couldn't analyze messages", "bucketStart", bucketStart, "count", len(batch.messages), "error", err)
+			lastErr = err
+			failedBatches++
+			continue
+		}
+
+		if err := cacheMessageAnalyses(ctx, batch.messages, batchAnalyses); err != nil {
+			return nil, err
+		}
+
+		for id, analysis := range batchAnalyses {
+			analyses[id] = analysis
+		}
+	}
+
+	// when nothing could be analyzed the API is likely down, fail the hour so it's retried
+	if len(batches) > 0 && failedBatches == len(batches) {
+		return nil, fmt.Errorf("couldn't analyze any batch: %w", lastErr)
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE insight_buckets
+		SET analyzed_messages = $2, skipped_messages = $3, estimated_tokens = $4, updated_at = now()
+		WHERE bucket_start = $1
+	`, bucketStart, len(analyses), len(messages)-len(analyses), estimatedTokens)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update insight bucket analysis stats: %w", err)
+	}
+
+	return analyses, nil
+}
+
+func getCachedMessageAnalyses(ctx context.Context, messageIDs []string) (map[string]*llmservice.MessageAnalysis, error) {
+	rows, err := db.Query(ctx, `
+		SELECT message_id, topic, sentiment, language
+		FROM message_analyses
+		WHERE message_id = ANY($1) AND version = $2
+	`, messageIDs, messageAnalysisVersion)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get cached message analyses: %w", err)
+	}
+	defer rows.Close()
+
+	analyses := make(map[string]*llmservice.MessageAnalysis)
+	for rows.Next() {
+		var id string
+		var analysis llmservice.MessageAnalysis
+		if err := rows.Scan(&id, &analysis.Topic, &analysis.Sentiment, &analysis.Language); err != nil {
+			return nil, fmt.Errorf("couldn't scan cached message analysis: %w", err)
+		}
+		analyses[id] = &analysis
+	}
+
+	return analyses, rows.Err()
+}
+
+// cacheMessageAnalyses stores the analyses with their author,
+// analyses of authors who opted out of sentiment tracking have no sentiment to store
+func cacheMessageAnalyses(
+	ctx context.Context,
+	messages []*models.DiscordRawMessage,
+	analyses map[string]*llmservice.MessageAnalysis,
+) error {
+	for _, msg := range messages {
+		analysis, ok := analyses[msg.ID]
+		if !ok {
+			continue
+		}
+
+		_, err := db.Exec(ctx, `
+			INSERT INTO message_analyses (message_id, version, author_id, topic, sentiment, language)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (message_id, version) DO UPDATE SET
+				author_id = EXCLUDED.author_id, topic = EXCLUDED.topic,
+				sentiment = EXCLUDED.sentiment, language = EXCLUDED.language
+		`, msg.ID, messageAnalysisVersion, msg.AuthorID, analysis.Topic, analysis.Sentiment, analysis.Language)
+		if err != nil {
+			return fmt.Errorf("couldn't cache message analysis: %w", err)
+		}
+	}
+
+	return nil
+}
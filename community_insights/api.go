@@ -6,16 +6,119 @@ import (
 	"errors"
 	"fmt"
 	"math"
-	"sort"
 	"time"
 
 	"encore.app/models"
 	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
 	"github.com/samber/lo"
 )
 
+// maxInsightBuckets keeps responses reasonably sized, longer ranges need a coarser granularity
+const maxInsightBuckets = 1000
+
+var insightTopics = []string{"Feature Request", "Feedback", "Other", "Question", "Bug Report"}
+
 type MetricDurationRequest struct {
-	Hours uint `json:"hours"`
+	// Hours is the length of the range ending now, used when From isn't set & defaults to 24
+	Hours uint      `json:"hours"`
+	From  time.Time `json:"from"`
+	// To defaults to now
+	To time.Time `json:"to"`
+	// Granularity of the buckets: hour (default), day, week or month
+	Granularity models.InsightGranularity `json:"granularity"`
+	// GuildID selects the timezone of the day, week & month buckets, UTC is used without it
+	GuildID string `json:"guildId"`
+}
+
+// insightRange is the list of buckets covered by a MetricDurationRequest
+type insightRange struct {
+	granularity models.InsightGranularity
+	timezone    string
+	buckets     []time.Time
+}
+
+func resolveInsightRange(ctx context.Context, req *MetricDurationRequest) (*insightRange, error) {
+	granularity := req.Granularity
+	if granularity == "" {
+		granularity = models.InsightGranularityHour
+	} else if granularity != models.InsightGranularityHour && !lo.Contains(rolledUpGranularities, granularity) {
+		return nil, fmt.Errorf("unsupported granularity %q, use hour, day, week or month", granularity)
+	}
+
+	timezone := defaultInsightTimezone
+	if req.GuildID != "" {
+		settings, err := GetGuildInsightSettings(ctx, req.GuildID)
+		if err != nil {
+			return nil, err
+		}
+		timezone = settings.Timezone
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load timezone: %w", err)
+	}
+
+	to := lo.Ternary(req.To.IsZero(), time.Now(), req.To)
+	from := req.From
+	if from.IsZero() {
+		hours := lo.Ternary(req.Hours == 0, 24, int(req.Hours))
+		from = to.Add(time.Duration(-hours) * time.Hour)
+	}
+
+	if to.Before(from) {
+		return nil, errors.New("please provide a range ending after it starts")
+	}
+
+	r := &insightRange{granularity: granularity, timezone: timezone}
+	last := bucketStart(to, granularity, loc)
+	for bucket := bucketStart(from, granularity, loc); !bucket.After(last); bucket = nextBucketStart(bucket, granularity) {
+		if len(r.buckets) == maxInsightBuckets {
+			return nil, fmt.Errorf("the range has more than %d buckets, please choose a coarser granularity", maxInsightBuckets)
+		}
+		r.buckets = append(r.buckets, bucket)
+	}
+
+	return r, nil
+}
+
+// loadInsightValues returns the values of an insight in the range by the unix time of their bucket
+func loadInsightValues(ctx context.Context, insightType string, r *insightRange) (map[int64]string, error) {
+	start := r.buckets[0]
+	end := nextBucketStart(r.buckets[len(r.buckets)-1], r.granularity)
+
+	var rows *sqldb.Rows
+	var err error
+	if r.granularity == models.InsightGranularityHour {
+		rows, err = db.Query(ctx, `
+			SELECT timestamp, value::TEXT
+			FROM community_insights
+			WHERE type = $1 AND timestamp >= $2 AND timestamp < $3
+		`, insightType, start.UTC(), end.UTC())
+	} else {
+		rows, err = db.Query(ctx, `
+			SELECT bucket_start, value::TEXT
+			FROM community_insight_rollups
+			WHERE type = $1 AND granularity = $2 AND timezone = $3 AND bucket_start >= $4 AND bucket_start < $5
+		`, insightType, r.granularity, r.timezone, start, end)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+
+	values := make(map[int64]string)
+	for rows.Next() {
+		var bucket time.Time
+		var value string
+		if err := rows.Scan(&bucket, &value); err != nil {
+			return nil, err
+		}
+		values[bucket.Unix()] = value
+	}
+
+	return values, rows.Err()
 }
 
 type TimeCountPair struct {
@@ -43,176 +146,145 @@ type UserSentimentResponse struct {
 
 // encore:api public path=/get-message-counts
 func (s *Service) GetMessageCounts(ctx context.Context, req *MetricDurationRequest) (*MessageCountResponse, error) {
-	if req.Hours > 24 {
-		return nil, errors.New("please provide a duration less than or equal to 24 hours")
-	}
-
-	endTime := time.Now().UTC().Truncate(time.Hour)
-	startTime := endTime.Add(time.Duration(-int(req.Hours)) * time.Hour)
-
-	hourlyCounts := make(map[time.Time]int)
-	for t := startTime; !t.After(endTime); t = t.Add(time.Hour) {
-		hourlyCounts[t] = 0
+	r, err := resolveInsightRange(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	query := `
-		SELECT date_trunc('hour', timestamp) AS hour, COALESCE(SUM((value->>'count')::INTEGER), 0) AS count
-		FROM community_insights
-		WHERE type = 'message_count' AND timestamp BETWEEN $1 AND $2
-		GROUP BY hour
-		ORDER BY hour
-	`
-
-	rows, err := db.Query(ctx, query, startTime, endTime)
+	values, err := loadInsightValues(ctx, "message_count", r)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var hour time.Time
-		var count int
-		if err := rows.Scan(&hour, &count); err != nil {
-			return nil, err
+	timeCounts := make([]TimeCountPair, 0, len(r.buckets))
+	for _, bucket := range r.buckets {
+		var count struct {
+			Count int `json:"count"`
 		}
-		_, ok := hourlyCounts[hour]
-		if ok {
-			hourlyCounts[hour] = count
+		if value, ok := values[bucket.Unix()]; ok {
+			if err := json.Unmarshal([]byte(value), &count); err != nil {
+				return nil, fmt.Errorf("unmarshal error: %v", err)
+			}
 		}
-	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+		timeCounts = append(timeCounts, TimeCountPair{Timestamp: bucket, Count: count.Count})
 	}
 
-	var timeCounts []TimeCountPair
-	for timestamp, count := range hourlyCounts {
-		timeCounts = append(timeCounts, TimeCountPair{Timestamp: timestamp, Count: count})
-	}
-
-	sort.Slice(timeCounts, func(i, j int) bool {
-		return timeCounts[i].Timestamp.Before(timeCounts[j].Timestamp)
-	})
-
 	return &MessageCountResponse{TimeCounts: timeCounts}, nil
 }
 
 // encore:api public path=/get-message-counts-per-topic
 func (s *Service) GetMessageCountsPerTopic(ctx context.Context, req *MetricDurationRequest) (*MessageCountPerTopicResponse, error) {
-	if req.Hours > 24 {
-		return nil, errors.New("please provide a duration less than or equal to 24 hours")
+	r, err := resolveInsightRange(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	endTime := time.Now().UTC().Truncate(time.Hour)
-	startTime := endTime.Add(time.Duration(-int(req.Hours)) * time.Hour)
-
-	results := initializeTimeCountPerTopic(startTime, endTime)
-	query := `
-		SELECT date_trunc('hour', timestamp) AS hour, value
-		FROM community_insights
-		WHERE type = 'messages_count_per_topic' AND timestamp BETWEEN $1 AND $2
-		ORDER BY hour
-	`
-
-	rows, err := db.Query(ctx, query, startTime, endTime)
+	values, err := loadInsightValues(ctx, "messages_count_per_topic", r)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var hour time.Time
-		var valueStr string
-		if err := rows.Scan(&hour, &valueStr); err != nil {
-			return nil, err
-		}
 
-		var topicCounts map[string]int
-		if err := json.Unmarshal([]byte(valueStr), &topicCounts); err != nil {
-			return nil, fmt.Errorf("unmarshal error: %v", err)
+	results := make([]TimeCountPerTopic, 0, len(r.buckets))
+	for _, bucket := range r.buckets {
+		topicCounts := make(map[string]int)
+		for _, topic := range insightTopics {
+			topicCounts[topic] = 0
 		}
 
-		results[hour] = TimeCountPerTopic{
-			TopicCounts: topicCounts,
-			Timestamp:   hour,
+		if value, ok := values[bucket.Unix()]; ok {
+			if err := json.Unmarshal([]byte(value), &topicCounts); err != nil {
+				return nil, fmt.Errorf("unmarshal error: %v", err)
+			}
 		}
-	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+		results = append(results, TimeCountPerTopic{Timestamp: bucket, TopicCounts: topicCounts})
 	}
 
-	sortedResults := sortResults(results)
-	return &MessageCountPerTopicResponse{TimeMessageCountPerTopic: sortedResults}, nil
+	return &MessageCountPerTopicResponse{TimeMessageCountPerTopic: results}, nil
 }
 
+// GetUserSentiment ranks the members by sentiment. The per-user insights span every guild,
+// so the ranking is disabled as soon as any guild is in the aggregate sentiment mode.
+//
 // encore:api public path=/get-user-sentiment
 func (s *Service) GetUserSentiment(ctx context.Context, req *MetricDurationRequest) (*UserSentimentResponse, error) {
-	if req.Hours > 24 {
-		return nil, errors.New("please provide a duration less than or equal to 24 hours")
+	var aggregateOnly bool
+	err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM guild_insight_settings WHERE sentiment_mode = $1)",
+		models.SentimentModeAggregate).Scan(&aggregateOnly)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get sentiment modes: %w", err)
+	} else if aggregateOnly {
+		return nil, errors.New("per-user sentiment is disabled, use the channel or topic sentiment instead")
 	}
 
-	endTime := time.Now().UTC().Truncate(time.Hour)
-	startTime := endTime.Add(time.Duration(-int(req.Hours)) * time.Hour)
-	query := `
-	 		SELECT date_trunc('hour', timestamp) AS hour, value
-	 		FROM community_insights
-	 		WHERE type = 'sentiment_per_user' AND timestamp BETWEEN $1 AND $2
-	 		ORDER BY hour
-	 	`
+	settings, err := GetGuildInsightSettings(ctx, req.GuildID)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := db.Query(ctx, query, startTime, endTime)
+	r, err := resolveInsightRange(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	sentimentsPerUser := map[string][]float32{}
-	for rows.Next() {
-		var hour time.Time
-		var valueStr string
-		if err := rows.Scan(&hour, &valueStr); err != nil {
-			return nil, err
-		}
+	values, err := loadInsightValues(ctx, "sentiment_per_user", r)
+	if err != nil {
+		return nil, err
+	}
 
+	sentimentStatsPerUser := map[string]*models.MessageSentimentStats{}
+	for _, valueStr := range values {
 		authorsToSentimentStats := make(map[string]*models.MessageSentimentStats)
 		if err := json.Unmarshal([]byte(valueStr), &authorsToSentimentStats); err != nil {
 			return nil, fmt.Errorf("unmarshal error: %v", err)
 		}
 
 		for author, stats := range authorsToSentimentStats {
-			if _, ok := sentimentsPerUser[author]; !ok {
-				sentimentsPerUser[author] = []float32{}
+			if _, ok := sentimentStatsPerUser[author]; !ok {
+				sentimentStatsPerUser[author] = &models.MessageSentimentStats{}
 			}
-
-			sentiment := (float32(stats.Positive)*1.0 + float32(stats.Negative)*(-1.0)) /
-				float32(stats.Positive+stats.Negative+stats.Neutral)
-			sentimentsPerUser[author] = append(sentimentsPerUser[author], sentiment)
+			addSentimentStats(sentimentStatsPerUser[author], stats)
 		}
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows error: %v", err)
+	// insights computed before a member opted out may not have been cleaned up yet
+	optedOut, err := listSentimentOptOuts(ctx, lo.Keys(sentimentStatsPerUser))
+	if err != nil {
+		return nil, err
 	}
 
-	positiveSentiments := map[string]float32{}
-	negativeSentiments := map[string]float32{}
-	for userID, sentiments := range sentimentsPerUser {
-		avgSentiment := lo.Sum(sentiments) / float32(len(sentiments))
-		if math.Abs(float64(avgSentiment)) < 0.2 {
+	rankedSentiments := map[string]float32{}
+	for userID, stats := range sentimentStatsPerUser {
+		if optedOut[userID] || stats.Positive+stats.Neutral+stats.Negative < settings.MinSentimentMessages {
+			continue
+		}
+
+		sentiment := sentimentScore(stats)
+		if math.Abs(float64(sentiment)) < 0.2 {
 			rlog.Info("Skipping user with neutral sentiment", "user_id", userID)
 			continue
 		}
+		rankedSentiments[userID] = sentiment
+	}
 
-		discordUser, err := s.discordClient.User(userID)
-		if err != nil {
-			return nil, fmt.Errorf("error while trying to get user: %w", err)
+	usernames, err := s.resolveUsernames(ctx, lo.Keys(rankedSentiments))
+	if err != nil {
+		return nil, err
+	}
+
+	positiveSentiments := map[string]float32{}
+	negativeSentiments := map[string]float32{}
+	for userID, sentiment := range rankedSentiments {
+		username, ok := usernames[userID]
+		if !ok {
+			continue
 		}
 
-		if avgSentiment > 0 {
-			positiveSentiments[discordUser.Username] = avgSentiment
+		if sentiment > 0 {
+			positiveSentiments[username] = sentiment
 		} else {
-			negativeSentiments[discordUser.Username] = -avgSentiment
+			negativeSentiments[username] = -sentiment
 		}
 	}
 
@@ -221,30 +293,3 @@ func (s *Service) GetUserSentiment(ctx context.Context, req *MetricDurationReque
 		NegativeSentiments: negativeSentiments,
 	}, nil
 }
-
-func initializeTimeCountPerTopic(start, end time.Time) map[time.Time]TimeCountPerTopic {
-	results := make(map[time.Time]TimeCountPerTopic)
-	topics := []string{"Feature Request", "Feedback", "Other", "Question", "Bug Report"}
-	for t := start; !t.After(end); t = t.Add(time.Hour) {
-		topicCounts := make(map[string]int)
-		for _, topic := range topics {
-			topicCounts[topic] = 0
-		}
-		results[t] = TimeCountPerTopic{
-			Timestamp:   t,
-			TopicCounts: topicCounts,
-		}
-	}
-	return results
-}
-
-func sortResults(results map[time.Time]TimeCountPerTopic) []TimeCountPerTopic {
-	var sortedResults []TimeCountPerTopic
-	for _, result := range results {
-		sortedResults = append(sortedResults, result)
-	}
-	sort.Slice(sortedResults, func(i, j int) bool {
-		return sortedResults[i].Timestamp.Before(sortedResults[j].Timestamp)
-	})
-	return sortedResults
-}
@@ -0,0 +1,226 @@
+package communityinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.dev/rlog"
+)
+
+// messages reach the indexer through a few pubsub hops, an hour is only processed once they've arrived
+const insightSettleDelay = 5 * time.Minute
+
+// missing hours are backfilled automatically this far back, older hours can be recomputed through the API
+const insightBackfillWindow = 72 * time.Hour
+
+// maxBucketsPerRun bounds the LLM usage of a single run, the backlog is worked through over the next runs
+const maxBucketsPerRun = 6
+
+// failed hours are retried this many times before needing a recompute
+const maxBucketAttempts = 3
+
+// maxRecomputeRange bounds the hours a single recompute request may queue
+const maxRecomputeRange = 31 * 24 * time.Hour
+
+const insightBucketColumns = `
+	bucket_start, status, attempts, error, analyzed_messages, skipped_messages,
+	estimated_tokens, processed_at, updated_at`
+
+// lastCompletedHour returns the start of the most recent hour whose messages have all been indexed
+func lastCompletedHour() time.Time {
+	return time.Now().UTC().Add(-insightSettleDelay).Truncate(time.Hour).Add(-time.Hour)
+}
+
+// processInsightBuckets queues the missing hours of the backfill window,
+// then computes the insights of the pending hours, newest first
+func (s *Service) processInsightBuckets(ctx context.Context) error {
+	last := lastCompletedHour()
+	if err := queueInsightBuckets(ctx, last); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT `+insightBucketColumns+`
+		FROM insight_buckets
+		WHERE bucket_start <= $1
+		  AND (status = $2 OR (status = $3 AND attempts < $4))
+		ORDER BY bucket_start DESC
+		LIMIT $5
+	`, last, models.InsightBucketStatusPending, models.InsightBucketStatusFailed, maxBucketAttempts, maxBucketsPerRun)
+	if err != nil {
+		return fmt.Errorf("couldn't get pending insight buckets: %w", err)
+	}
+	defer rows.Close()
+
+	buckets, err := models.MapInsightBucketsFromSQLRows(rows)
+	if err != nil {
+		return fmt.Errorf("couldn't map insight buckets: %w", err)
+	}
+
+	var processed []time.Time
+	for _, bucket := range buckets {
+		// a failing hour shouldn't hold back the others, it's retried on the next run
+		processErr := s.fetchHourlyMessages(ctx, bucket.BucketStart)
+		if processErr != nil {
+			rlog.Error("Couldn't compute hourly insights", "bucketStart", bucket.BucketStart, "error", processErr)
+		} else {
+			processed = append(processed, bucket.BucketStart)
+		}
+
+		if err := completeInsightBucket(ctx, bucket.BucketStart, processErr); err != nil {
+			return err
+		}
+	}
+
+	if len(processed) == 0 {
+		return nil
+	}
+
+	// recomputed hours may be older than the rollup cron's lookback
+	oldest, newest := processed[len(processed)-1], processed[0]
+	return rollupInsights(ctx, oldest, newest.Add(time.Hour-time.Nanosecond))
+}
+
+// queueInsightBuckets adds the missing hours of the backfill window up to last
+func queueInsightBuckets(ctx context.Context, last time.Time) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO insight_buckets (bucket_start)
+		SELECT generate_series($1::TIMESTAMP, $2::TIMESTAMP, INTERVAL '1 hour')
+		ON CONFLICT (bucket_start) DO NOTHING
+	`, last.Add(-insightBackfillWindow), last)
+	if err != nil {
+		return fmt.Errorf("couldn't queue insight buckets: %w", err)
+	}
+
+	return nil
+}
+
+func completeInsightBucket(ctx context.Context, bucketStart time.Time, processErr error) error {
+	status, errMsg := models.InsightBucketStatusProcessed, ""
+	if processErr != nil {
+		status, errMsg = models.InsightBucketStatusFailed, processErr.Error()
+	}
+
+	_, err := db.Exec(ctx, `
+		UPDATE insight_buckets
+		SET status = $2, error = $3, attempts = attempts + 1, updated_at = now(),
+			processed_at = CASE WHEN $2 = 'PROCESSED' THEN now() ELSE processed_at END
+		WHERE bucket_start = $1
+	`, bucketStart, status, errMsg)
+	if err != nil {
+		return fmt.Errorf("couldn't update insight bucket: %w", err)
+	}
+
+	return nil
+}
+
+type RecomputeInsightsRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type RecomputeInsightsResponse struct {
+	QueuedBuckets int `json:"queuedBuckets"`
+}
+
+// RecomputeInsights queues the completed hours between from & to to be computed again,
+// ie after changing a prompt or model. The hours are processed by the hourly insights cron.
+//
+// Messages over the hourly analysis budget are permanently left out of an hour's topic, sentiment &
+// language insights, unless the hour is recomputed: already analyzed messages are reused from the cache,
+// so each recompute analyzes up to another budget's worth of the skipped messages.
+//
+//encore:api private method=POST path=/insights/recompute
+func RecomputeInsights(ctx context.Context, req *RecomputeInsightsRequest) (*RecomputeInsightsResponse, error) {
+	from := req.From.UTC().Truncate(time.Hour)
+	to := req.To.UTC().Truncate(time.Hour)
+	if last := lastCompletedHour(); to.After(last) {
+		to = last
+	}
+
+	if req.From.IsZero() || req.To.IsZero() {
+		return nil, errors.New("please provide a range to recompute")
+	} else if to.Before(from) {
+		return nil, errors.New("please provide a range of completed hours, ending after it starts")
+	} else if to.Sub(from) > maxRecomputeRange {
+		return nil, fmt.Errorf("please recompute at most %s at a time", maxRecomputeRange)
+	}
+
+	result, err := db.Exec(ctx, `
+		INSERT INTO insight_buckets (bucket_start)
+		SELECT generate_series($1::TIMESTAMP, $2::TIMESTAMP, INTERVAL '1 hour')
+		ON CONFLICT (bucket_start) DO UPDATE SET
+			status = $3, attempts = 0, error = '', updated_at = now()
+	`, from, to, models.InsightBucketStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't queue insight buckets: %w", err)
+	}
+
+	rlog.Info("Queued insight recompute", "from", from, "to", to, "buckets", result.RowsAffected())
+	return &RecomputeInsightsResponse{QueuedBuckets: int(result.RowsAffected())}, nil
+}
+
+// requeueInsightBuckets queues the hours to be computed again, like RecomputeInsights
+func requeueInsightBuckets(ctx context.Context, hours []time.Time) (int64, error) {
+	result, err := db.Exec(ctx, `
+		INSERT INTO insight_buckets (bucket_start)
+		SELECT unnest($1::TIMESTAMP[])
+		ON CONFLICT (bucket_start) DO UPDATE SET
+			status = $2, attempts = 0, error = '', updated_at = now()
+	`, hours, models.InsightBucketStatusPending)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't queue insight buckets: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+type ListInsightBucketsRequest struct {
+	// Status filters the buckets, ie FAILED to find hours needing a recompute
+	Status string `query:"status"`
+	// Skipped only lists the hours with messages left unanalyzed by the hourly analysis budget,
+	// which can be recomputed to analyze them
+	Skipped bool      `query:"skipped"`
+	From    time.Time `query:"from"`
+	To      time.Time `query:"to"`
+}
+
+type ListInsightBucketsResponse struct {
+	Buckets []*models.InsightBucket `json:"buckets"`
+}
+
+// ListInsightBuckets lists the processing state of hourly insights, newest first.
+//
+//encore:api private method=GET path=/insight-buckets
+func ListInsightBuckets(ctx context.Context, req *ListInsightBucketsRequest) (*ListInsightBucketsResponse, error) {
+	to := req.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	from := req.From
+	if from.IsZero() {
+		from = to.Add(-insightBackfillWindow)
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT `+insightBucketColumns+`
+		FROM insight_buckets
+		WHERE ($1 = '' OR status = $1) AND bucket_start BETWEEN $2 AND $3 AND (NOT $4 OR skipped_messages > 0)
+		ORDER BY bucket_start DESC
+	`, req.Status, from.UTC(), to.UTC(), req.Skipped)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get insight buckets: %w", err)
+	}
+	defer rows.Close()
+
+	buckets, err := models.MapInsightBucketsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map insight buckets: %w", err)
+	}
+
+	return &ListInsightBucketsResponse{Buckets: buckets}, nil
+}
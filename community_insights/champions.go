@@ -0,0 +1,503 @@
+package communityinsights
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/google/uuid"
+	"github.com/samber/lo"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.app/models"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+)
+
+const forumChannelID = "1233297799366311977"
+
+const solvedTagName = "Solved"
+
+// champion scores of recent days are recomputed, as threads get solved & reactions come in after the answer
+const championsLookbackDays = 2
+
+const defaultChampionsLimit = 10
+const maxChampionsLimit = 50
+const weeklyChampionsCount = 5
+
+// scores of the ways of helping, a solved thread weighs the most
+const (
+	replyToQuestionScore   = 3
+	replyScore             = 1
+	forumThreadHelpedScore = 2
+	solvedThreadScore      = 5
+	positiveReactionScore  = 1
+)
+
+var positiveReactionEmojis = []string{"👍", "❤️", "🙏", "✅", "🎉", "💯", "🔥", "⭐", "🙌"}
+
+// Score the helpers of the last days.
+var _ = cron.NewJob("compute-champion-scores", cron.JobConfig{
+	Title:    "Compute community champion scores",
+	Every:    6 * cron.Hour,
+	Endpoint: ComputeChampionScores,
+})
+
+// Celebrate the top helpers of the week.
+var _ = cron.NewJob("post-weekly-champions", cron.JobConfig{
+	Title:    "Post the weekly community champions",
+	Schedule: "0 16 * * 5",
+	Endpoint: PostWeeklyChampions,
+})
+
+// ComputeChampionScores scores how members helped others on each of the last days,
+// stored as daily champion_scores insights.
+//
+//encore:api private method=POST path=/champion-scores/compute
+func ComputeChampionScores(ctx context.Context) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for days := championsLookbackDays - 1; days >= 0; days-- {
+		if err := service.computeChampionScores(ctx, today.AddDate(0, 0, -days)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) computeChampionScores(ctx context.Context, day time.Time) error {
+	end := day.AddDate(0, 0, 1)
+	championStats := make(map[string]*models.ChampionStats)
+	statsOf := func(userID string) *models.ChampionStats {
+		if _, ok := championStats[userID]; !ok {
+			championStats[userID] = &models.ChampionStats{}
+		}
+		return championStats[userID]
+	}
+
+	if err := s.addChatReplyStats(ctx, day, end, statsOf); err != nil {
+		return err
+	}
+
+	if err := s.addForumStats(day, end, statsOf); err != nil {
+		return err
+	}
+
+	for _, stats := range championStats {
+		stats.Score = championScore(stats)
+	}
+
+	jsonVal, err := json.Marshal(championStats)
+	if err != nil {
+		return err
+	}
+
+	rlog.Info("Computed champion scores", "day", day, "members", len(championStats))
+	return addInsight(ctx, uuid.New().String(), "champion_scores", day, string(jsonVal))
+}
+
+// addChatReplyStats counts the distinct messages of others each member replied to in #general & its threads,
+// replies to messages analyzed as questions count separately.
+// Forum threads are left out, posting in them is credited by addForumStats.
+func (s *Service) addChatReplyStats(
+	ctx context.Context, start, end time.Time, statsOf func(string) *models.ChampionStats,
+) error {
+	resp, err := communitymessageindexer.ListMessageReplies(ctx, &communitymessageindexer.ListMessageRepliesRequest{
+		ChannelID: generalChannelID,
+		Start:     start,
+		End:       end.Add(-time.Nanosecond),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't list message replies: %w", err)
+	}
+
+	replies := lo.UniqBy(resp.Replies, func(reply *models.MessageReply) string {
+		return reply.AuthorID + ":" + reply.ReferencedMessageID
+	})
+
+	analyses, err := getCachedMessageAnalyses(ctx, lo.Map(replies, func(reply *models.MessageReply, _ int) string {
+		return reply.ReferencedMessageID
+	}))
+	if err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if analysis, ok := analyses[reply.ReferencedMessageID]; ok && analysis.Topic == "Question" {
+			statsOf(reply.AuthorID).RepliesToQuestions++
+		} else {
+			statsOf(reply.AuthorID).Replies++
+		}
+	}
+
+	return nil
+}
+
+// addForumStats credits the members who posted in others' forum threads during the day,
+// the positive reactions their answers got & the solved threads they gave the last answer in.
+// Discord doesn't record which answer solved a thread, so a solved thread is credited to the newest
+// non-bot member besides its author who posted in it. That's usually the accepted answer,
+// but it can also be a "thanks" or a follow-up posted after the thread was solved.
+func (s *Service) addForumStats(start, end time.Time, statsOf func(string) *models.ChampionStats) error {
+	forumChannel, err := s.discordClient.Channel(forumChannelID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum channel: %w", err)
+	}
+
+	solvedTag, hasSolvedTag := lo.Find(forumChannel.AvailableTags, func(tag discordgo.ForumTag) bool {
+		return strings.EqualFold(tag.Name, solvedTagName)
+	})
+
+	threads, err := s.listForumThreadsActiveSince(forumChannel, start)
+	if err != nil {
+		return err
+	}
+
+	for _, thread := range threads {
+		messages, err := s.listThreadMessagesSince(thread.ID, start)
+		if err != nil {
+			return err
+		}
+
+		// messages are ordered newest first
+		helpers := lo.Filter(messages, func(msg *discordgo.Message, _ int) bool {
+			return msg.Author != nil && !msg.Author.Bot && msg.Author.ID != thread.OwnerID
+		})
+
+		helped := make(map[string]bool)
+		for _, msg := range helpers {
+			if msg.Timestamp.Before(start) || !msg.Timestamp.Before(end) {
+				continue
+			}
+
+			if !helped[msg.Author.ID] {
+				helped[msg.Author.ID] = true
+				statsOf(msg.Author.ID).ForumThreadsHelped++
+			}
+
+			for _, reaction := range msg.Reactions {
+				if reaction.Emoji != nil && lo.Contains(positiveReactionEmojis, reaction.Emoji.Name) {
+					statsOf(msg.Author.ID).PositiveReactions += reaction.Count
+				}
+			}
+		}
+
+		if hasSolvedTag && lo.Contains(thread.AppliedTags, solvedTag.ID) && len(helpers) > 0 {
+			lastAnswer := helpers[0]
+			if !lastAnswer.Timestamp.Before(start) && lastAnswer.Timestamp.Before(end) {
+				statsOf(lastAnswer.Author.ID).SolvedThreads++
+			}
+		}
+	}
+
+	return nil
+}
+
+// listForumThreadsActiveSince lists the active & archived forum threads with messages since the given time
+func (s *Service) listForumThreadsActiveSince(forumChannel *discordgo.Channel, since time.Time) ([]*discordgo.Channel, error) {
+	active, err := s.discordClient.GuildThreadsActive(forumChannel.GuildID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get active threads: %w", err)
+	}
+
+	threads := lo.Filter(active.Threads, func(thread *discordgo.Channel, _ int) bool {
+		return thread.ParentID == forumChannel.ID
+	})
+
+	// archived threads are ordered by when they were archived, newest first
+	var before *time.Time
+	for {
+		archived, err := s.discordClient.ThreadsArchived(forumChannel.ID, before, 100)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get archived threads: %w", err)
+		}
+
+		threads = append(threads, archived.Threads...)
+		if !archived.HasMore || len(archived.Threads) == 0 {
+			break
+		}
+
+		last := archived.Threads[len(archived.Threads)-1]
+		if last.ThreadMetadata == nil || last.ThreadMetadata.ArchiveTimestamp.Before(since) {
+			break
+		}
+		before = &last.ThreadMetadata.ArchiveTimestamp
+	}
+
+	return lo.Filter(threads, func(thread *discordgo.Channel, _ int) bool {
+		lastMessageAt, err := discordgo.SnowflakeTimestamp(thread.LastMessageID)
+		return err == nil && !lastMessageAt.Before(since)
+	}), nil
+}
+
+// listThreadMessagesSince lists the messages of a thread, newest first, until the first message before the given time
+func (s *Service) listThreadMessagesSince(threadID string, since time.Time) ([]*discordgo.Message, error) {
+	var messages []*discordgo.Message
+	beforeID := ""
+	for {
+		page, err := s.discordClient.ChannelMessages(threadID, 100, beforeID, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get thread messages: %w", err)
+		}
+
+		messages = append(messages, page...)
+		if len(page) < 100 || page[len(page)-1].Timestamp.Before(since) {
+			return messages, nil
+		}
+		beforeID = page[len(page)-1].ID
+	}
+}
+
+func championScore(stats *models.ChampionStats) int {
+	return stats.RepliesToQuestions*replyToQuestionScore +
+		stats.Replies*replyScore +
+		stats.ForumThreadsHelped*forumThreadHelpedScore +
+		stats.SolvedThreads*solvedThreadScore +
+		stats.PositiveReactions*positiveReactionScore
+}
+
+// nextChampionDay returns the start of the first daily champion scores starting at or after t
+func nextChampionDay(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	if day.Before(t) {
+		day = day.AddDate(0, 0, 1)
+	}
+
+	return day
+}
+
+// weeklyChampionsRange is the 7 full days before now, so consecutive weekly posts never count a day twice
+func weeklyChampionsRange(now time.Time) (time.Time, time.Time) {
+	to := now.UTC().Truncate(24 * time.Hour)
+	return to.AddDate(0, 0, -7), to
+}
+
+func addChampionStats(total, stats *models.ChampionStats) {
+	total.RepliesToQuestions += stats.RepliesToQuestions
+	total.Replies += stats.Replies
+	total.ForumThreadsHelped += stats.ForumThreadsHelped
+	total.SolvedThreads += stats.SolvedThreads
+	total.PositiveReactions += stats.PositiveReactions
+	total.Score += stats.Score
+}
+
+type ChampionsRequest struct {
+	// From defaults to a week before To, the scores of the days starting within the range are summed
+	From time.Time `json:"from"`
+	// To defaults to now
+	To time.Time `json:"to"`
+	// Limit defaults to 10 members, at most 50
+	Limit int `json:"limit"`
+}
+
+type Champion struct {
+	Rank     int    `json:"rank"`
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	*models.ChampionStats
+}
+
+type ChampionsResponse struct {
+	Champions []*Champion `json:"champions"`
+}
+
+// encore:api public path=/get-champions
+func (s *Service) GetChampions(ctx context.Context, req *ChampionsRequest) (*ChampionsResponse, error) {
+	to := lo.Ternary(req.To.IsZero(), time.Now(), req.To)
+	from := lo.Ternary(req.From.IsZero(), to.AddDate(0, 0, -7), req.From)
+	limit := lo.Ternary(req.Limit <= 0, defaultChampionsLimit, min(req.Limit, maxChampionsLimit))
+	if to.Before(from) {
+		return nil, errors.New("please provide a range ending after it starts")
+	}
+
+	ranking, err := rankChampions(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := sortChampions(ranking)
+	entries = entries[:min(limit, len(entries))]
+	usernames, err := s.resolveUsernames(ctx, lo.Map(entries, func(entry championEntry, _ int) string {
+		return entry.userID
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	champions := make([]*Champion, 0, limit)
+	for _, entry := range entries {
+		champions = append(champions, &Champion{
+			Rank:          len(champions) + 1,
+			UserID:        entry.userID,
+			Username:      usernames[entry.userID],
+			ChampionStats: entry.stats,
+		})
+	}
+
+	return &ChampionsResponse{Champions: champions}, nil
+}
+
+// rankChampions sums the daily champion scores of the days starting in the range [from, to)
+func rankChampions(ctx context.Context, from, to time.Time) (map[string]*models.ChampionStats, error) {
+	rows, err := db.Query(ctx, `
+		SELECT value::TEXT
+		FROM community_insights
+		WHERE type = 'champion_scores' AND timestamp >= $1 AND timestamp < $2
+	`, nextChampionDay(from), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get champion scores: %w", err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	merged, _, err := mergeInsightValues("champion_scores", values)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't merge champion scores: %w", err)
+	}
+
+	ranking := make(map[string]*models.ChampionStats)
+	if err := json.Unmarshal([]byte(merged), &ranking); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+
+	return ranking, nil
+}
+
+type championEntry struct {
+	userID string
+	stats  *models.ChampionStats
+}
+
+// sortChampions orders members by score, then by solved threads
+func sortChampions(ranking map[string]*models.ChampionStats) []championEntry {
+	entries := lo.MapToSlice(ranking, func(userID string, stats *models.ChampionStats) championEntry {
+		return championEntry{userID: userID, stats: stats}
+	})
+	entries = lo.Filter(entries, func(entry championEntry, _ int) bool {
+		return entry.stats.Score > 0
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].stats.Score != entries[j].stats.Score {
+			return entries[i].stats.Score > entries[j].stats.Score
+		} else if entries[i].stats.SolvedThreads != entries[j].stats.SolvedThreads {
+			return entries[i].stats.SolvedThreads > entries[j].stats.SolvedThreads
+		}
+		return entries[i].userID < entries[j].userID
+	})
+
+	return entries
+}
+
+// PostWeeklyChampions posts the top helpers of the last week in the champions channel of the community's guild.
+// The scores only cover the #general & forum channels of that guild, other guilds would be shown
+// a ranking of someone else's members, so their champions channel is skipped.
+// A channel which can't be posted in doesn't keep the others from being posted in.
+//
+//encore:api private method=POST path=/champions/post-weekly
+func PostWeeklyChampions(ctx context.Context) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	forumChannel, err := service.discordClient.Channel(forumChannelID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum channel: %w", err)
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT guild_id, champions_channel_id
+		FROM guild_insight_settings
+		WHERE champions_channel_id <> ''
+	`)
+	if err != nil {
+		return fmt.Errorf("couldn't get champions channels: %w", err)
+	}
+
+	var channelIDs []string
+	for rows.Next() {
+		var guildID, channelID string
+		if err := rows.Scan(&guildID, &channelID); err != nil {
+			rows.Close()
+			return fmt.Errorf("couldn't scan champions channel: %w", err)
+		}
+
+		if guildID != forumChannel.GuildID {
+			rlog.Warn("Skipping weekly champions of a guild whose channels aren't scored", "guildId", guildID)
+			continue
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("couldn't get champions channels: %w", err)
+	}
+
+	if len(channelIDs) == 0 {
+		return nil
+	}
+
+	from, to := weeklyChampionsRange(time.Now())
+	ranking, err := rankChampions(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	entries := sortChampions(ranking)
+	if len(entries) == 0 {
+		rlog.Info("No champions this week, skipping the weekly post")
+		return nil
+	}
+
+	embed := formatWeeklyChampionsEmbed(entries[:min(weeklyChampionsCount, len(entries))])
+	for _, channelID := range channelIDs {
+		if _, err := service.discordClient.ChannelMessageSendEmbed(channelID, embed); err != nil {
+			rlog.Error("Couldn't post weekly champions", "channelId", channelID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func formatWeeklyChampionsEmbed(entries []championEntry) *discordgo.MessageEmbed {
+	medals := []string{"🥇", "🥈", "🥉"}
+	lines := lo.Map(entries, func(entry championEntry, i int) string {
+		rank := fmt.Sprintf("**%d.**", i+1)
+		if i < len(medals) {
+			rank = medals[i]
+		}
+
+		return fmt.Sprintf("%s <@%s> - answered %d questions, helped in %d forum threads, solved %d",
+			rank, entry.userID, entry.stats.RepliesToQuestions, entry.stats.ForumThreadsHelped, entry.stats.SolvedThreads)
+	})
+
+	return &discordgo.MessageEmbed{
+		Title:       "🏆 Community champions of the week",
+		Description: "Thank you for helping others this week!\n\n" + strings.Join(lines, "\n"),
+		Color:       0xf1c40f,
+	}
+}
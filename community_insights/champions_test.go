@@ -0,0 +1,77 @@
+package communityinsights
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextChampionDay(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want time.Time
+	}{
+		{name: "midnight is kept", t: utc("2024-05-03T00:00:00Z"), want: utc("2024-05-03T00:00:00Z")},
+		{name: "during the day rounds up", t: utc("2024-05-03T09:30:00Z"), want: utc("2024-05-04T00:00:00Z")},
+		{name: "right after midnight rounds up", t: utc("2024-05-03T00:00:01Z"), want: utc("2024-05-04T00:00:00Z")},
+		{
+			name: "other timezones use the UTC day",
+			t:    utc("2024-05-03T09:30:00Z").In(time.FixedZone("UTC-10", -10*60*60)),
+			want: utc("2024-05-04T00:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextChampionDay(tt.t); !got.Equal(tt.want) {
+				t.Errorf("nextChampionDay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeeklyChampionsRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		wantFrom time.Time
+		wantTo   time.Time
+	}{
+		{
+			name:     "the 7 full days before today",
+			now:      utc("2024-05-10T17:00:00Z"),
+			wantFrom: utc("2024-05-03T00:00:00Z"),
+			wantTo:   utc("2024-05-10T00:00:00Z"),
+		},
+		{
+			name:     "at midnight",
+			now:      utc("2024-05-10T00:00:00Z"),
+			wantFrom: utc("2024-05-03T00:00:00Z"),
+			wantTo:   utc("2024-05-10T00:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := weeklyChampionsRange(tt.now)
+			if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+				t.Errorf("weeklyChampionsRange() = [%v, %v), want [%v, %v)", from, to, tt.wantFrom, tt.wantTo)
+			}
+
+			// the days counted are those starting in the range
+			days := 0
+			for day := nextChampionDay(from); day.Before(to); day = day.AddDate(0, 0, 1) {
+				days++
+			}
+			if days != 7 {
+				t.Errorf("weeklyChampionsRange() counts %d days, want 7", days)
+			}
+
+			// the next week's post starts where this one ended
+			nextFrom, _ := weeklyChampionsRange(tt.now.AddDate(0, 0, 7))
+			if !nextFrom.Equal(to) {
+				t.Errorf("next weekly range starts at %v, want %v", nextFrom, to)
+			}
+		})
+	}
+}
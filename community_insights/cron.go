@@ -11,13 +11,16 @@ import (
 
 	communitymessageindexer "encore.app/community_message_indexer"
 	"encore.app/models"
+	"encore.app/packages/llmservice"
 	"encore.dev/cron"
 )
 
 const generalChannelID = "1086301297201909864"
 
+// Process the last completed hour & backfill the hours which were missed or failed.
 var _ = cron.NewJob("fetch-hourly-messages", cron.JobConfig{
-	Every:    1 * cron.Hour,
+	Title:    "Compute hourly community insights",
+	Every:    15 * cron.Minute,
 	Endpoint: FetchHourlyMessages,
 })
 
@@ -38,17 +41,17 @@ func FetchHourlyMessages(ctx context.Context) error {
 		return fmt.Errorf("couldn't create service: %w", err)
 	}
 
-	return service.fetchHourlyMessages(ctx)
+	return service.processInsightBuckets(ctx)
 }
 
-func (s *Service) fetchHourlyMessages(ctx context.Context) error {
-	now := time.Now().Truncate(time.Hour)
-	start := now
-	end := now.Add(time.Hour)
+// fetchHourlyMessages computes the insights of the hour starting at start
+func (s *Service) fetchHourlyMessages(ctx context.Context, start time.Time) error {
+	end := start.Add(time.Hour)
 	req := &communitymessageindexer.ListMessagesRequest{
 		ChannelID: generalChannelID,
 		Start:     start,
-		End:       end,
+		// the range is inclusive, messages posted exactly at the end belong to the next hour
+		End: end.Add(-time.Nanosecond),
 	}
 
 	resp, err := communitymessageindexer.ListMessages(ctx, req)
@@ -60,14 +63,23 @@ func (s *Service) fetchHourlyMessages(ctx context.Context) error {
 		return fmt.Errorf("error while trying to add message count: %w", err)
 	}
 
-	if err := s.addMessageCountPerTopic(ctx, resp, start); err != nil {
+	analyses, err := s.analyzeMessages(ctx, resp.Messages, start)
+	if err != nil {
+		return fmt.Errorf("error while trying to analyze messages: %w", err)
+	}
+
+	if err := s.addMessageCountPerTopic(ctx, resp, analyses, start); err != nil {
 		return fmt.Errorf("error while trying to add message count per topic: %w", err)
 	}
 
-	if err := s.addMessageSentiment(ctx, resp, start); err != nil {
+	if err := s.addMessageSentiment(ctx, resp, analyses, start); err != nil {
 		return fmt.Errorf("error while trying to add message sentiment: %w", err)
 	}
 
+	if err := s.addMessageCountPerLanguage(ctx, resp, analyses, start); err != nil {
+		return fmt.Errorf("error while trying to add message count per language: %w", err)
+	}
+
 	return nil
 }
 
@@ -76,22 +88,26 @@ func (s *Service) addMessageCount(ctx context.Context, resp *communitymessageind
 	return addInsight(ctx, uuid.New().String(), "message_count", start, countAsJson)
 }
 
-func (s *Service) addMessageCountPerTopic(ctx context.Context, resp *communitymessageindexer.SearchMessagesResponse, start time.Time) error {
-	topics := []string{"Question", "Feedback", "Bug Report", "Feature Request", "Other"}
+func (s *Service) addMessageCountPerTopic(
+	ctx context.Context,
+	resp *communitymessageindexer.SearchMessagesResponse,
+	analyses map[string]*llmservice.MessageAnalysis,
+	start time.Time,
+) error {
 	topicMessageCount := make(map[string]int)
-
-	for _, topic := range topics {
+	for _, topic := range insightTopics {
 		topicMessageCount[topic] = 0
 	}
 
 	for _, msg := range resp.Messages {
-		topic, err := s.llmService.MatchMessageToTopic(ctx, msg, topics)
-		if err != nil {
-			return fmt.Errorf("error while trying to match message to topic: %w", err)
+		analysis, ok := analyses[msg.ID]
+		if !ok {
+			continue
 		}
-		topicCount, ok := topicMessageCount[topic]
+
+		topicCount, ok := topicMessageCount[analysis.Topic]
 		if ok {
-			topicMessageCount[topic] = topicCount + 1
+			topicMessageCount[analysis.Topic] = topicCount + 1
 		}
 	}
 
@@ -103,40 +119,77 @@ func (s *Service) addMessageCountPerTopic(ctx context.Context, resp *communityme
 	return addInsight(ctx, uuid.New().String(), "messages_count_per_topic", start, string(messageCountPerTopicJson))
 }
 
-func (s *Service) addMessageSentiment(ctx context.Context, resp *communitymessageindexer.SearchMessagesResponse, start time.Time) error {
-	messageAuthors := lo.Map(resp.Messages, func(msg *models.DiscordRawMessage, _ int) string {
+// addMessageSentiment adds the sentiment per author, channel & topic, leaving out the authors who opted out
+func (s *Service) addMessageSentiment(
+	ctx context.Context,
+	resp *communitymessageindexer.SearchMessagesResponse,
+	analyses map[string]*llmservice.MessageAnalysis,
+	start time.Time,
+) error {
+	optedOut, err := listSentimentOptOuts(ctx, lo.Map(resp.Messages, func(msg *models.DiscordRawMessage, _ int) string {
 		return msg.AuthorID
-	})
+	}))
+	if err != nil {
+		return err
+	}
 
+	// keys are only added once one of their messages was analyzed, so their stats never sum up to zero
 	authorsToSentimentStats := make(map[string]*models.MessageSentimentStats)
-	for _, messageAuthor := range messageAuthors {
-		authorsToSentimentStats[messageAuthor] = &models.MessageSentimentStats{
-			Positive: 0,
-			Neutral:  0,
-			Negative: 0,
+	channelsToSentimentStats := make(map[string]*models.MessageSentimentStats)
+	topicsToSentimentStats := make(map[string]*models.MessageSentimentStats)
+	for _, msg := range resp.Messages {
+		analysis, ok := analyses[msg.ID]
+		if !ok || optedOut[msg.AuthorID] {
+			continue
+		}
+
+		for key, sentimentStats := range map[string]map[string]*models.MessageSentimentStats{
+			msg.AuthorID:   authorsToSentimentStats,
+			msg.ChannelID:  channelsToSentimentStats,
+			analysis.Topic: topicsToSentimentStats,
+		} {
+			if _, ok := sentimentStats[key]; !ok {
+				sentimentStats[key] = &models.MessageSentimentStats{}
+			}
+			countSentiment(sentimentStats[key], analysis.Sentiment)
 		}
 	}
 
-	for _, msg := range resp.Messages {
-		sentiment, err := s.llmService.EvaluateMessageSentiment(ctx, msg)
+	for insightType, sentimentStats := range map[string]map[string]*models.MessageSentimentStats{
+		"sentiment_per_user":    authorsToSentimentStats,
+		"sentiment_per_channel": channelsToSentimentStats,
+		"sentiment_per_topic":   topicsToSentimentStats,
+	} {
+		jsonVal, err := json.Marshal(sentimentStats)
 		if err != nil {
-			return fmt.Errorf("error while trying to evaluate sentiment: %w", err)
+			return err
 		}
 
-		switch sentiment {
-		case models.MessageSentimentPositive:
-			authorsToSentimentStats[msg.AuthorID].Positive++
-		case models.MessageSentimentNeutral:
-			authorsToSentimentStats[msg.AuthorID].Neutral++
-		case models.MessageSentimentNegative:
-			authorsToSentimentStats[msg.AuthorID].Negative++
+		if err := addInsight(ctx, uuid.New().String(), insightType, start, string(jsonVal)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) addMessageCountPerLanguage(
+	ctx context.Context,
+	resp *communitymessageindexer.SearchMessagesResponse,
+	analyses map[string]*llmservice.MessageAnalysis,
+	start time.Time,
+) error {
+	languageMessageCount := make(map[string]int)
+	for _, msg := range resp.Messages {
+		if analysis, ok := analyses[msg.ID]; ok {
+			languageMessageCount[analysis.Language]++
 		}
 	}
 
-	jsonVal, err := json.Marshal(authorsToSentimentStats)
+	jsonVal, err := json.Marshal(languageMessageCount)
 	if err != nil {
 		return err
 	}
 
-	return addInsight(ctx, uuid.New().String(), "sentiment_per_user", start, string(jsonVal))
+	return addInsight(ctx, uuid.New().String(), "messages_count_per_language", start, string(jsonVal))
 }
@@ -0,0 +1,586 @@
+package communityinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+const moderatorChannelID = "1234396668837892107"
+
+// messages shorter than this (ie "thanks!") don't carry a topic
+const minClusteredTextLength = 20
+
+// the chat messages & forum posts clustered per hour are capped separately, bounding the embedding cost
+// of an hour without busy chat hours crowding out the forum posts
+const maxClusteredMessagesPerHour = 160
+const maxClusteredForumPostsPerHour = 40
+const embeddingBatchSize = 100
+
+// items at least this similar to a topic's centroid belong to it
+const clusterSimilarityThreshold = 0.6
+
+// new topics need a few similar items, single messages are noise
+const minNewTopicSize = 3
+const maxLabelSamples = 10
+
+// topics unseen for this long are forgotten
+const emergingTopicRetention = 30 * 24 * time.Hour
+
+// the hourly volume of a topic is compared to its average over the previous week
+const emergingTopicBaselineWindow = 7 * 24 * time.Hour
+
+// a topic spikes when it has at least minSpikeVolume items in an hour, spikeFactor times its baseline
+const minSpikeVolume = 5
+const spikeFactor = 3.0
+
+// baselineFloor keeps topics which were silent before from spiking on a couple of messages
+const baselineFloor = 0.5
+
+const emergingTopicAlertCooldown = 6 * time.Hour
+const maxAlertExamples = 5
+
+// maxClusteredBucketsPerRun bounds the embedding & labelling cost of a single run,
+// missed hours are worked through over the next runs
+const maxClusteredBucketsPerRun = 6
+
+// spikes of hours older than this are over by the time they're clustered, they aren't alerted about
+const maxEmergingTopicAlertDelay = 2 * time.Hour
+
+// Cluster the messages & forum posts of the completed hours & alert about spiking topics.
+var _ = cron.NewJob("detect-emerging-topics", cron.JobConfig{
+	Title:    "Detect emerging topics",
+	Every:    15 * cron.Minute,
+	Endpoint: DetectEmergingTopics,
+})
+
+// clusterItem is a message or forum post being clustered
+type clusterItem struct {
+	text      string
+	link      string
+	embedding []float32
+}
+
+type emergingTopic struct {
+	id            int64
+	label         string
+	summary       string
+	centroid      []float32
+	itemCount     int
+	lastAlertedAt *time.Time
+	items         []*clusterItem
+}
+
+// DetectEmergingTopics clusters the completed hours of the backfill window which weren't clustered yet, oldest first.
+// The hours are tracked on insight_buckets, so hours missed while the service was down are caught up on.
+//
+//encore:api private method=POST path=/emerging-topics/detect
+func DetectEmergingTopics(ctx context.Context) error {
+	last := lastCompletedHour()
+	if err := queueInsightBuckets(ctx, last); err != nil {
+		return err
+	}
+
+	buckets, err := listUnclusteredBuckets(ctx, last)
+	if err != nil {
+		return err
+	} else if len(buckets) == 0 {
+		return nil
+	}
+
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	// a failing hour shouldn't hold back the others, it's clustered again on the next run
+	for _, bucket := range buckets {
+		if err := service.detectEmergingTopics(ctx, bucket); err != nil {
+			rlog.Error("Couldn't cluster emerging topics", "bucketStart", bucket, "error", err)
+		}
+	}
+
+	_, err = db.Exec(ctx, "DELETE FROM emerging_topics WHERE last_seen_at < $1", time.Now().Add(-emergingTopicRetention))
+	if err != nil {
+		return fmt.Errorf("couldn't prune emerging topics: %w", err)
+	}
+
+	return nil
+}
+
+func listUnclusteredBuckets(ctx context.Context, last time.Time) ([]time.Time, error) {
+	rows, err := db.Query(ctx, `
+		SELECT bucket_start
+		FROM insight_buckets
+		WHERE topics_clustered_at IS NULL AND bucket_start >= $1 AND bucket_start <= $2
+		ORDER BY bucket_start
+		LIMIT $3
+	`, last.Add(-insightBackfillWindow), last, maxClusteredBucketsPerRun)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get unclustered insight buckets: %w", err)
+	}
+	defer rows.Close()
+
+	var buckets []time.Time
+	for rows.Next() {
+		var bucket time.Time
+		if err := rows.Scan(&bucket); err != nil {
+			return nil, fmt.Errorf("couldn't scan insight bucket: %w", err)
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// detectEmergingTopics clusters the hour starting at bucket. The new topics, centroids & volumes are stored in
+// the same transaction which marks the hour as clustered, so a failed hour is clustered again from scratch.
+func (s *Service) detectEmergingTopics(ctx context.Context, bucket time.Time) error {
+	items, err := collectClusterItems(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range lo.Chunk(items, embeddingBatchSize) {
+		embeddings, err := s.llmService.CreateEmbeddings(ctx, lo.Map(batch, func(item *clusterItem, _ int) string {
+			return item.text
+		}))
+		if err != nil {
+			return fmt.Errorf("couldn't create embeddings: %w", err)
+		}
+
+		for i, item := range batch {
+			item.embedding = embeddings[i]
+		}
+	}
+
+	topics, err := listEmergingTopics(ctx)
+	if err != nil {
+		return err
+	}
+
+	var unassigned []*clusterItem
+	for _, item := range items {
+		if topic := closestTopic(topics, item.embedding); topic != nil {
+			topic.items = append(topic.items, item)
+		} else {
+			unassigned = append(unassigned, item)
+		}
+	}
+
+	for _, cluster := range clusterItems(unassigned) {
+		if len(cluster) < minNewTopicSize {
+			continue
+		}
+
+		topic, err := s.labelEmergingTopic(ctx, cluster)
+		if err != nil {
+			return err
+		}
+		topics = append(topics, topic)
+	}
+
+	seen := lo.Filter(topics, func(topic *emergingTopic, _ int) bool {
+		return len(topic.items) > 0
+	})
+	clustered, err := saveEmergingTopics(ctx, bucket, seen, len(items))
+	if err != nil {
+		return err
+	} else if !clustered {
+		// another run clustered the hour in the meantime
+		return nil
+	}
+
+	if time.Since(bucket.Add(time.Hour)) <= maxEmergingTopicAlertDelay {
+		for _, topic := range seen {
+			// the hour is clustered, a failed alert can't be retried without counting the hour twice
+			if err := s.alertIfSpiking(ctx, topic, bucket); err != nil {
+				rlog.Error("Couldn't alert about emerging topic", "topicId", topic.id, "error", err)
+			}
+		}
+	}
+
+	rlog.Info("Clustered emerging topics", "bucketStart", bucket, "items", len(items), "topics", len(seen))
+	return nil
+}
+
+// saveEmergingTopics stores the topics seen in the hour & marks it as clustered in a single transaction.
+// It returns false without storing anything when the hour was already clustered.
+func saveEmergingTopics(ctx context.Context, bucket time.Time, topics []*emergingTopic, itemCount int) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(ctx, `
+		UPDATE insight_buckets
+		SET topics_clustered_at = now(), clustered_items = $2
+		WHERE bucket_start = $1 AND topics_clustered_at IS NULL
+	`, bucket, itemCount)
+	if err != nil {
+		return false, fmt.Errorf("couldn't mark insight bucket as clustered: %w", err)
+	} else if res.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	for _, topic := range topics {
+		if topic.id == 0 {
+			err := tx.QueryRow(ctx, `
+				INSERT INTO emerging_topics (label, summary, centroid)
+				VALUES ($1, $2, '{}')
+				RETURNING id
+			`, topic.label, topic.summary).Scan(&topic.id)
+			if err != nil {
+				return false, fmt.Errorf("couldn't insert emerging topic: %w", err)
+			}
+		}
+
+		if err := recordEmergingTopicVolume(ctx, tx, topic, bucket); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("couldn't commit emerging topics: %w", err)
+	}
+
+	return true, nil
+}
+
+// collectClusterItems lists the #general messages & forum posts of the hour starting at bucket
+func collectClusterItems(ctx context.Context, bucket time.Time) ([]*clusterItem, error) {
+	end := bucket.Add(time.Hour)
+	resp, err := communitymessageindexer.ListMessages(ctx, &communitymessageindexer.ListMessagesRequest{
+		ChannelID: generalChannelID,
+		Start:     bucket,
+		End:       end.Add(-time.Nanosecond),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to list messages: %w", err)
+	}
+
+	var items []*clusterItem
+	for _, msg := range resp.Messages {
+		if len(msg.CleanContent) < minClusteredTextLength {
+			continue
+		} else if len(items) == maxClusteredMessagesPerHour {
+			break
+		}
+
+		items = append(items, &clusterItem{
+			text: msg.CleanContent,
+			link: fmt.Sprintf("https://discord.com/channels/%s/%s/%s", msg.GuildID, msg.ChannelID, msg.ID),
+		})
+	}
+
+	// posts recorded before their title was stored have none & are left out
+	forumPosts, err := scanForumPostActivities(ctx, `
+		SELECT `+forumPostActivityColumns+`
+		FROM forum_post_activity
+		WHERE created_at >= $1 AND created_at < $2 AND title <> ''
+		ORDER BY created_at
+		LIMIT $3
+	`, bucket, end, maxClusteredForumPostsPerHour)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, forumPost := range forumPosts {
+		items = append(items, &clusterItem{
+			text: "Forum post: " + forumPost.Title,
+			link: fmt.Sprintf("<#%s>", forumPost.ForumPostID),
+		})
+	}
+
+	return items, nil
+}
+
+func listEmergingTopics(ctx context.Context) ([]*emergingTopic, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, label, summary, centroid, item_count, last_alerted_at
+		FROM emerging_topics
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get emerging topics: %w", err)
+	}
+	defer rows.Close()
+
+	var topics []*emergingTopic
+	for rows.Next() {
+		var topic emergingTopic
+		err := rows.Scan(&topic.id, &topic.label, &topic.summary, &topic.centroid, &topic.itemCount, &topic.lastAlertedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan emerging topic: %w", err)
+		}
+		topics = append(topics, &topic)
+	}
+
+	return topics, rows.Err()
+}
+
+// closestTopic returns the topic most similar to the embedding, if it's similar enough
+func closestTopic(topics []*emergingTopic, embedding []float32) *emergingTopic {
+	var closest *emergingTopic
+	bestSimilarity := float32(clusterSimilarityThreshold)
+	for _, topic := range topics {
+		if similarity := cosineSimilarity(topic.centroid, embedding); similarity >= bestSimilarity {
+			closest, bestSimilarity = topic, similarity
+		}
+	}
+
+	return closest
+}
+
+// clusterItems groups items greedily, each item joins the first cluster whose centroid is similar enough
+func clusterItems(items []*clusterItem) [][]*clusterItem {
+	var clusters [][]*clusterItem
+	var centroids [][]float32
+	for _, item := range items {
+		joined := false
+		for i, centroid := range centroids {
+			if cosineSimilarity(centroid, item.embedding) >= clusterSimilarityThreshold {
+				clusters[i] = append(clusters[i], item)
+				centroids[i] = mergeCentroid(centroid, len(clusters[i])-1, []*clusterItem{item})
+				joined = true
+				break
+			}
+		}
+
+		if !joined {
+			clusters = append(clusters, []*clusterItem{item})
+			centroids = append(centroids, item.embedding)
+		}
+	}
+
+	return clusters
+}
+
+// labelEmergingTopic names a new topic, it's only stored with the hour it was found in
+func (s *Service) labelEmergingTopic(ctx context.Context, items []*clusterItem) (*emergingTopic, error) {
+	label, err := s.llmService.LabelTopicCluster(ctx, lo.Map(lo.Slice(items, 0, maxLabelSamples), func(item *clusterItem, _ int) string {
+		return item.text
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't label topic: %w", err)
+	}
+
+	// the items are added to the topic like those of existing topics, so its centroid starts empty
+	return &emergingTopic{
+		label:   label.Label,
+		summary: label.Summary,
+		items:   items,
+	}, nil
+}
+
+func recordEmergingTopicVolume(ctx context.Context, tx *sqldb.Tx, topic *emergingTopic, bucket time.Time) error {
+	topic.centroid = mergeCentroid(topic.centroid, topic.itemCount, topic.items)
+	topic.itemCount += len(topic.items)
+
+	_, err := tx.Exec(ctx, `
+		UPDATE emerging_topics
+		SET centroid = $2, item_count = $3, last_seen_at = now()
+		WHERE id = $1
+	`, topic.id, topic.centroid, topic.itemCount)
+	if err != nil {
+		return fmt.Errorf("couldn't update emerging topic: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO emerging_topic_volumes (topic_id, bucket_start, count)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (topic_id, bucket_start) DO UPDATE SET count = EXCLUDED.count
+	`, topic.id, bucket, len(topic.items))
+	if err != nil {
+		return fmt.Errorf("couldn't record emerging topic volume: %w", err)
+	}
+
+	return nil
+}
+
+// alertIfSpiking notifies the moderators when the topic's volume of the hour is well above its baseline
+func (s *Service) alertIfSpiking(ctx context.Context, topic *emergingTopic, bucket time.Time) error {
+	volume := len(topic.items)
+	if volume < minSpikeVolume {
+		return nil
+	} else if topic.lastAlertedAt != nil && time.Since(*topic.lastAlertedAt) < emergingTopicAlertCooldown {
+		return nil
+	}
+
+	var baselineVolume int
+	err := db.QueryRow(ctx, `
+		SELECT COALESCE(SUM(count), 0)
+		FROM emerging_topic_volumes
+		WHERE topic_id = $1 AND bucket_start >= $2 AND bucket_start < $3
+	`, topic.id, bucket.Add(-emergingTopicBaselineWindow), bucket).Scan(&baselineVolume)
+	if err != nil {
+		return fmt.Errorf("couldn't get emerging topic baseline: %w", err)
+	}
+
+	baseline := float64(baselineVolume) / emergingTopicBaselineWindow.Hours()
+	if float64(volume) < spikeFactor*math.Max(baseline, baselineFloor) {
+		return nil
+	}
+
+	examples := lo.Map(lo.Slice(topic.items, 0, maxAlertExamples), func(item *clusterItem, _ int) string {
+		return fmt.Sprintf("* %s", item.link)
+	})
+	_, err = s.discordClient.ChannelMessageSendEmbed(moderatorChannelID, &discordgo.MessageEmbed{
+		Title:       "📈 Emerging topic: " + topic.label,
+		Description: topic.summary,
+		Color:       0xe67e22,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Messages in the last hour", Value: fmt.Sprintf("%d", volume), Inline: true},
+			{Name: "Usual volume", Value: fmt.Sprintf("%.1f per hour", baseline), Inline: true},
+			{Name: "Examples", Value: strings.Join(examples, "\n")},
+		},
+		Timestamp: bucket.Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't send emerging topic alert: %w", err)
+	}
+
+	_, err = db.Exec(ctx, "UPDATE emerging_topics SET last_alerted_at = now() WHERE id = $1", topic.id)
+	if err != nil {
+		return fmt.Errorf("couldn't update emerging topic: %w", err)
+	}
+
+	rlog.Info("Alerted about emerging topic", "topicId", topic.id, "label", topic.label, "volume", volume)
+	return nil
+}
+
+// mergeCentroid adds items to a centroid which is the mean of count embeddings, keeping it normalized
+func mergeCentroid(centroid []float32, count int, items []*clusterItem) []float32 {
+	if len(items) == 0 {
+		return centroid
+	}
+
+	sum := make([]float32, len(items[0].embedding))
+	for i := range centroid {
+		sum[i] = centroid[i] * float32(count)
+	}
+	for _, item := range items {
+		for i, value := range item.embedding {
+			sum[i] += value
+		}
+	}
+
+	var norm float64
+	for _, value := range sum {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return sum
+	}
+
+	for i := range sum {
+		sum[i] = float32(float64(sum[i]) / math.Sqrt(norm))
+	}
+
+	return sum
+}
+
+// cosineSimilarity of normalized embeddings
+func cosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+
+	return dot
+}
+
+type EmergingTopicsRequest struct {
+	// Hours is the recent period compared to the week before it, defaults to 24
+	Hours uint `json:"hours"`
+}
+
+type EmergingTopic struct {
+	ID      int64  `json:"id"`
+	Label   string `json:"label"`
+	Summary string `json:"summary"`
+	// Volume is the number of messages & forum posts in the period
+	Volume int `json:"volume"`
+	// HourlyBaseline is the average hourly volume during the week before the period
+	HourlyBaseline float64    `json:"hourlyBaseline"`
+	SpikeRatio     float64    `json:"spikeRatio"`
+	FirstSeenAt    time.Time  `json:"firstSeenAt"`
+	LastAlertedAt  *time.Time `json:"lastAlertedAt,omitempty"`
+}
+
+type EmergingTopicsResponse struct {
+	Topics []*EmergingTopic `json:"topics"`
+}
+
+// encore:api public path=/get-emerging-topics
+func (s *Service) GetEmergingTopics(ctx context.Context, req *EmergingTopicsRequest) (*EmergingTopicsResponse, error) {
+	hours := lo.Ternary(req.Hours == 0, 24, int(req.Hours))
+	if time.Duration(hours)*time.Hour > emergingTopicBaselineWindow {
+		return nil, errors.New("please provide a period of at most a week")
+	}
+
+	periodStart := lastCompletedHour().Add(time.Duration(-hours+1) * time.Hour)
+	rows, err := db.Query(ctx, `
+		SELECT id, label, summary, created_at, last_alerted_at, volume, baseline_volume
+		FROM (
+			SELECT
+				t.id, t.label, t.summary, t.created_at, t.last_alerted_at,
+				COALESCE(SUM(v.count) FILTER (WHERE v.bucket_start >= $1), 0) AS volume,
+				COALESCE(SUM(v.count) FILTER (WHERE v.bucket_start < $1), 0) AS baseline_volume
+			FROM emerging_topics t
+			LEFT JOIN emerging_topic_volumes v ON v.topic_id = t.id AND v.bucket_start >= $2
+			GROUP BY t.id
+		) topics
+		WHERE volume > 0
+	`, periodStart, periodStart.Add(-emergingTopicBaselineWindow))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get emerging topics: %w", err)
+	}
+	defer rows.Close()
+
+	topics, err := mapEmergingTopics(rows, hours)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].SpikeRatio > topics[j].SpikeRatio
+	})
+
+	return &EmergingTopicsResponse{Topics: topics}, nil
+}
+
+func mapEmergingTopics(rows *sqldb.Rows, hours int) ([]*EmergingTopic, error) {
+	topics := []*EmergingTopic{}
+	for rows.Next() {
+		var topic EmergingTopic
+		var baselineVolume int
+		err := rows.Scan(&topic.ID, &topic.Label, &topic.Summary, &topic.FirstSeenAt, &topic.LastAlertedAt,
+			&topic.Volume, &baselineVolume)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan emerging topic: %w", err)
+		}
+
+		topic.HourlyBaseline = float64(baselineVolume) / emergingTopicBaselineWindow.Hours()
+		topic.SpikeRatio = float64(topic.Volume) / float64(hours) / math.Max(topic.HourlyBaseline, baselineFloor)
+		topics = append(topics, &topic)
+	}
+
+	return topics, rows.Err()
+}
@@ -0,0 +1,170 @@
+package communityinsights
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestMergeCentroid(t *testing.T) {
+	tests := []struct {
+		name     string
+		centroid []float32
+		count    int
+		items    [][]float32
+		want     []float32
+	}{
+		{
+			name:  "first item",
+			items: [][]float32{{1, 0}},
+			want:  []float32{1, 0},
+		},
+		{
+			name:  "mean of new items is normalized",
+			items: [][]float32{{1, 0}, {0, 1}},
+			want:  []float32{math.Sqrt2 / 2, math.Sqrt2 / 2},
+		},
+		{
+			name:     "existing centroid is weighted by its count",
+			centroid: []float32{1, 0},
+			count:    3,
+			items:    [][]float32{{0, 1}},
+			want:     []float32{3 / float32(math.Sqrt(10)), 1 / float32(math.Sqrt(10))},
+		},
+		{
+			name:     "no items keep the centroid",
+			centroid: []float32{0.6, 0.8},
+			count:    2,
+			want:     []float32{0.6, 0.8},
+		},
+		{
+			name:  "opposite items cancel out",
+			items: [][]float32{{1, 0}, {-1, 0}},
+			want:  []float32{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := lo.Map(tt.items, func(embedding []float32, _ int) *clusterItem {
+				return &clusterItem{embedding: embedding}
+			})
+
+			got := mergeCentroid(tt.centroid, tt.count, items)
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeCentroid() = %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if math.Abs(float64(got[i]-tt.want[i])) > 1e-6 {
+					t.Fatalf("mergeCentroid() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		items map[string][]float32
+		order []string
+		want  [][]string
+	}{
+		{
+			name: "no items",
+		},
+		{
+			name: "similar items are grouped",
+			items: map[string][]float32{
+				"a": {1, 0},
+				"b": {0.9, 0.436},
+				"c": {0, 1},
+			},
+			order: []string{"a", "b", "c"},
+			want:  [][]string{{"a", "b"}, {"c"}},
+		},
+		{
+			name: "dissimilar items stay apart",
+			items: map[string][]float32{
+				"a": {1, 0, 0},
+				"b": {0, 1, 0},
+				"c": {0, 0, 1},
+			},
+			order: []string{"a", "b", "c"},
+			want:  [][]string{{"a"}, {"b"}, {"c"}},
+		},
+		{
+			name: "items join the first similar cluster",
+			items: map[string][]float32{
+				"a": {1, 0},
+				"b": {0, 1},
+				"c": {0.707, 0.707},
+			},
+			order: []string{"a", "b", "c"},
+			want:  [][]string{{"a", "c"}, {"b"}},
+		},
+		{
+			name: "the centroid follows the cluster",
+			items: map[string][]float32{
+				// d is too far from a, but close enough to the mean of a, b & c
+				"a": {1, 0},
+				"b": {0.8, 0.6},
+				"c": {0.8, 0.6},
+				"d": {0.5, 0.866},
+			},
+			order: []string{"a", "b", "c", "d"},
+			want:  [][]string{{"a", "b", "c", "d"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := lo.Map(tt.order, func(name string, _ int) *clusterItem {
+				return &clusterItem{text: name, embedding: tt.items[name]}
+			})
+
+			got := lo.Map(clusterItems(items), func(cluster []*clusterItem, _ int) []string {
+				return lo.Map(cluster, func(item *clusterItem, _ int) string {
+					return item.text
+				})
+			})
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("clusterItems() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClosestTopic(t *testing.T) {
+	topics := []*emergingTopic{
+		{id: 1, centroid: []float32{1, 0}},
+		{id: 2, centroid: []float32{0.8, 0.6}},
+	}
+
+	tests := []struct {
+		name      string
+		embedding []float32
+		want      int64
+	}{
+		{name: "most similar topic", embedding: []float32{0.6, 0.8}, want: 2},
+		{name: "exact match", embedding: []float32{1, 0}, want: 1},
+		{name: "no topic similar enough", embedding: []float32{0, -1}, want: 0},
+		{name: "mismatched dimensions", embedding: []float32{1, 0, 0}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int64
+			if topic := closestTopic(topics, tt.embedding); topic != nil {
+				got = topic.id
+			}
+
+			if got != tt.want {
+				t.Errorf("closestTopic() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package communityinsights
+
+import (
+	"context"
+	"fmt"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	deadletterqueue "encore.app/dead_letter_queue"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+const userErasureSubscription = "community-insights-user-erasure"
+
+var _ = pubsub.NewSubscription(
+	communitymessageindexer.UserDataErasureTopic,
+	"community-insights-user-erasure",
+	pubsub.SubscriptionConfig[*models.UserDataErasureEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("user-data-erasures", userErasureSubscription, 5, eraseUserInsights),
+	})
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"community-insights-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			switch evt.Subscription {
+			case userErasureSubscription:
+				return deadletter.Replay(ctx, evt, eraseUserInsights)
+			case duplicateForumPostsSubscription:
+				return deadletter.Replay(ctx, evt, markDuplicateForumPost)
+			case forumPostsSubscription:
+				return deadletter.Replay(ctx, evt, recordForumPost)
+			case forumMessagesSubscription:
+				return deadletter.Replay(ctx, evt, handleForumMessage)
+			case forumTagChangesSubscription:
+				return deadletter.Replay(ctx, evt, recordForumPostTags)
+			case interactionsSubscription:
+				return deadletter.Replay(ctx, evt, handleInteraction)
+			}
+
+			return nil
+		},
+	})
+
+// eraseUserInsights removes a user from the hourly & rolled up per-user aggregates & the analysis cache
+func eraseUserInsights(ctx context.Context, evt *models.UserDataErasureEvent) error {
+	erased, err := removeUserFromInsights(ctx, evt.UserID, "sentiment_per_user", "champion_scores")
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(ctx, "DELETE FROM user_profiles WHERE user_id = $1", evt.UserID); err != nil {
+		return fmt.Errorf("couldn't erase user profile: %w", err)
+	}
+
+	if _, err := db.Exec(ctx, "DELETE FROM message_analyses WHERE author_id = $1", evt.UserID); err != nil {
+		return fmt.Errorf("couldn't erase cached message analyses: %w", err)
+	}
+
+	rlog.Info("Erased user from insights", "requestId", evt.RequestID, "insights", erased)
+	return communitymessageindexer.ConfirmUserErasure(ctx, evt.RequestID, &communitymessageindexer.ConfirmUserErasureRequest{
+		Service: communitymessageindexer.ErasureServiceCommunityInsights,
+	})
+}
+
+// removeUserFromInsights removes a user's key from the hourly & rolled up insights of the given per-user types
+func removeUserFromInsights(ctx context.Context, userID string, insightTypes ...string) (int64, error) {
+	result, err := db.Exec(ctx, `
+		UPDATE community_insights
+		SET value = (value::JSONB - $1)::JSON
+		WHERE type = ANY($2) AND value::JSONB ? $1
+	`, userID, insightTypes)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't remove user from insights: %w", err)
+	}
+
+	rollupResult, err := db.Exec(ctx, `
+		UPDATE community_insight_rollups
+		SET value = value - $1, updated_at = now()
+		WHERE type = ANY($2) AND value ? $1
+	`, userID, insightTypes)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't remove user from insight rollups: %w", err)
+	}
+
+	return result.RowsAffected() + rollupResult.RowsAffected(), nil
+}
@@ -0,0 +1,624 @@
+package communityinsights
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+
+	"encore.app/discord_handler"
+	forumpostclassifier "encore.app/forum_post_classifier"
+	forumpostmapper "encore.app/forum_post_mapper"
+	forumposttagger "encore.app/forum_post_tagger"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/cron"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+// open forum posts without activity for forumPostStaleAfter are re-checked on Discord,
+// as they may have been archived or solved without an event reaching us
+const forumPostStaleAfter = 7 * 24 * time.Hour
+
+// maxStaleForumPostRechecks bounds the Discord calls of a single re-check run
+const maxStaleForumPostRechecks = 100
+
+// Re-check the open forum posts which went quiet.
+var _ = cron.NewJob("recheck-stale-forum-posts", cron.JobConfig{
+	Title:    "Re-check stale open forum posts",
+	Every:    24 * cron.Hour,
+	Endpoint: RecheckStaleForumPosts,
+})
+
+const forumPostsSubscription = "community-insights-forum-posts"
+
+var _ = pubsub.NewSubscription(
+	forumpostmapper.DiscordForumPostTopic,
+	"community-insights-forum-posts",
+	pubsub.SubscriptionConfig[*models.DiscordForumPostEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-forum-posts", forumPostsSubscription, 5, recordForumPost),
+	})
+
+const forumMessagesSubscription = "community-insights-forum-messages"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordRawMessageTopic,
+	"community-insights-forum-messages",
+	pubsub.SubscriptionConfig[*models.DiscordRawMessage]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-messages", forumMessagesSubscription, 5, handleForumMessage),
+	})
+
+const forumTagChangesSubscription = "community-insights-forum-tag-changes"
+
+var _ = pubsub.NewSubscription(
+	forumposttagger.ForumPostTagsChangedTopic,
+	"community-insights-forum-tag-changes",
+	pubsub.SubscriptionConfig[*models.ForumPostTagsChangedEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("forum-post-tag-changes", forumTagChangesSubscription, 5, recordForumPostTags),
+	})
+
+const duplicateForumPostsSubscription = "community-insights-duplicate-forum-posts"
+
+var _ = pubsub.NewSubscription(
+	forumpostclassifier.DuplicateDiscordForumPostTopic,
+	"community-insights-duplicate-forum-posts",
+	pubsub.SubscriptionConfig[*models.DuplicateDiscordForumPostEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler(
+			"dup-discord-forum-posts", duplicateForumPostsSubscription, 5, markDuplicateForumPost),
+	})
+
+func markDuplicateForumPost(ctx context.Context, evt *models.DuplicateDiscordForumPostEvent) error {
+	createdAt, err := discordgo.SnowflakeTimestamp(evt.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum post creation time: %w", err)
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO forum_post_activity (forum_post_id, created_at, last_activity_at, duplicate)
+		VALUES ($1, $2, $2, TRUE)
+		ON CONFLICT (forum_post_id) DO UPDATE SET duplicate = TRUE
+	`, evt.ID, createdAt)
+	if err != nil {
+		return fmt.Errorf("couldn't mark forum post as duplicate: %w", err)
+	}
+
+	return nil
+}
+
+// recordForumPost starts tracking the activity of a forum post stored by the forum post mapper
+func recordForumPost(ctx context.Context, evt *models.DiscordForumPostEvent) error {
+	createdAt, err := discordgo.SnowflakeTimestamp(evt.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum post creation time: %w", err)
+	}
+
+	// messages & tag changes of the post may have been recorded first
+	_, err = db.Exec(ctx, `
+		INSERT INTO forum_post_activity (forum_post_id, title, created_at, last_activity_at)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (forum_post_id) DO UPDATE SET title = EXCLUDED.title
+		WHERE forum_post_activity.title = ''
+	`, evt.ID, evt.Title, createdAt)
+	if err != nil {
+		return fmt.Errorf("couldn't insert forum post activity: %w", err)
+	}
+
+	return nil
+}
+
+// recordForumPostTags records the tags of a forum post & dates its resolution when it's tagged as solved.
+// Events older than the recorded tags are ignored, so redelivered events can't bring back old tags.
+func recordForumPostTags(ctx context.Context, evt *models.ForumPostTagsChangedEvent) error {
+	createdAt, err := discordgo.SnowflakeTimestamp(evt.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum post creation time: %w", err)
+	}
+
+	solved := lo.ContainsBy(evt.TagNames, func(name string) bool {
+		return strings.EqualFold(name, solvedTagName)
+	})
+	_, err = db.Exec(ctx, `
+		INSERT INTO forum_post_activity (
+			forum_post_id, created_at, last_activity_at, tag_names, tags_changed_at, resolved_at)
+		VALUES ($1, $2, $2, $3, $4, CASE WHEN $5 THEN $4::TIMESTAMPTZ END)
+		ON CONFLICT (forum_post_id) DO UPDATE SET
+			tag_names = EXCLUDED.tag_names,
+			tags_changed_at = EXCLUDED.tags_changed_at,
+			resolved_at = CASE WHEN $5 THEN COALESCE(forum_post_activity.resolved_at, EXCLUDED.tags_changed_at) END,
+			synced_at = now()
+		WHERE forum_post_activity.tags_changed_at IS NULL
+		   OR forum_post_activity.tags_changed_at < EXCLUDED.tags_changed_at
+	`, evt.ID, createdAt, evt.TagNames, evt.ChangedAt, solved)
+	if err != nil {
+		return fmt.Errorf("couldn't record forum post tags: %w", err)
+	}
+
+	return nil
+}
+
+func handleForumMessage(ctx context.Context, message *models.DiscordRawMessage) error {
+	if message.Structure == nil || message.Structure.ParentChannelID != forumChannelID {
+		return nil
+	}
+
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.recordForumMessage(ctx, message)
+}
+
+// recordForumMessage records the first human & bot responses in a forum post.
+// The starter message shares the thread's ID & tells who the post was created for.
+func (s *Service) recordForumMessage(ctx context.Context, message *models.DiscordRawMessage) error {
+	threadID := message.Structure.ThreadID
+	createdAt, err := discordgo.SnowflakeTimestamp(threadID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum post creation time: %w", err)
+	}
+
+	botUserID, err := s.getBotUserID()
+	if err != nil {
+		return err
+	}
+
+	var requesterID string
+	if message.ID == threadID {
+		requesterID = message.AuthorID
+		// posts the bot created belong to the member it mentions
+		if message.AuthorID == botUserID && len(message.Structure.MentionedUserIDs) > 0 {
+			requesterID = message.Structure.MentionedUserIDs[0]
+		}
+	} else {
+		activities, err := scanForumPostActivities(ctx, `
+			SELECT `+forumPostActivityColumns+`
+			FROM forum_post_activity
+			WHERE forum_post_id = $1
+		`, threadID)
+		if err != nil {
+			return err
+		}
+
+		if len(activities) > 0 && activities[0].RequesterID != "" {
+			requesterID = activities[0].RequesterID
+		} else if requesterID, err = s.resolveForumPostRequester(threadID, botUserID); err != nil {
+			return err
+		}
+	}
+
+	postedAt := message.Structure.Timestamp
+	if postedAt.IsZero() {
+		postedAt, _ = discordgo.SnowflakeTimestamp(message.ID)
+	}
+
+	isStarter := message.ID == threadID
+	botResponse := !isStarter && message.AuthorID == botUserID
+	humanResponse := !isStarter && !message.Structure.AuthorBot && message.AuthorID != requesterID
+	_, err = db.Exec(ctx, `
+		INSERT INTO forum_post_activity (
+			forum_post_id, requester_id, created_at, last_activity_at, first_human_response_at, first_bot_response_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN $4::TIMESTAMPTZ END, CASE WHEN $6 THEN $4::TIMESTAMPTZ END)
+		ON CONFLICT (forum_post_id) DO UPDATE SET
+			requester_id = CASE WHEN $7 OR forum_post_activity.requester_id = '' THEN EXCLUDED.requester_id
+				ELSE forum_post_activity.requester_id END,
+			first_human_response_at = LEAST(forum_post_activity.first_human_response_at, EXCLUDED.first_human_response_at),
+			first_bot_response_at = LEAST(forum_post_activity.first_bot_response_at, EXCLUDED.first_bot_response_at),
+			last_activity_at = GREATEST(forum_post_activity.last_activity_at, EXCLUDED.last_activity_at),
+			archived_at = NULL,
+			synced_at = now()
+	`, threadID, requesterID, createdAt, postedAt, humanResponse, botResponse, isStarter)
+	if err != nil {
+		return fmt.Errorf("couldn't record forum post message: %w", err)
+	}
+
+	return nil
+}
+
+// resolveForumPostRequester looks up who a forum post was created for on Discord,
+// which is only needed once per post when its starter message didn't reach us
+func (s *Service) resolveForumPostRequester(threadID, botUserID string) (string, error) {
+	thread, err := s.discordClient.Channel(threadID)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get forum post: %w", err)
+	} else if thread.OwnerID != botUserID {
+		return thread.OwnerID, nil
+	}
+
+	starter, err := s.discordClient.ChannelMessage(threadID, threadID)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get forum post starter message: %w", err)
+	} else if len(starter.Mentions) > 0 {
+		return starter.Mentions[0].ID, nil
+	}
+
+	return thread.OwnerID, nil
+}
+
+// forumPostActivity is the recorded support activity of a forum post
+type forumPostActivity struct {
+	ForumPostID          string
+	Title                string
+	RequesterID          string
+	TagNames             []string
+	CreatedAt            time.Time
+	FirstHumanResponseAt *time.Time
+	FirstBotResponseAt   *time.Time
+	ResolvedAt           *time.Time
+	Duplicate            bool
+	ArchivedAt           *time.Time
+}
+
+// firstAIResponseAt is when the AI assistant answered, duplicates are answered with a notice instead
+func (a *forumPostActivity) firstAIResponseAt() *time.Time {
+	return lo.Ternary(a.Duplicate, nil, a.FirstBotResponseAt)
+}
+
+// deflected means the AI assistant's answer resolved the post before any human responded
+func (a *forumPostActivity) deflected() bool {
+	return a.firstAIResponseAt() != nil && a.ResolvedAt != nil &&
+		(a.FirstHumanResponseAt == nil || a.FirstHumanResponseAt.After(*a.ResolvedAt))
+}
+
+const forumPostActivityColumns = `
+	forum_post_id, title, requester_id, tag_names, created_at, first_human_response_at,
+	first_bot_response_at, resolved_at, duplicate, archived_at`
+
+func scanForumPostActivities(ctx context.Context, query string, args ...any) ([]*forumPostActivity, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get forum post activity: %w", err)
+	}
+	defer rows.Close()
+
+	var activities []*forumPostActivity
+	for rows.Next() {
+		var a forumPostActivity
+		err := rows.Scan(&a.ForumPostID, &a.Title, &a.RequesterID, &a.TagNames, &a.CreatedAt, &a.FirstHumanResponseAt,
+			&a.FirstBotResponseAt, &a.ResolvedAt, &a.Duplicate, &a.ArchivedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan forum post activity: %w", err)
+		}
+		activities = append(activities, &a)
+	}
+
+	return activities, rows.Err()
+}
+
+// RecheckStaleForumPosts looks up the open forum posts without recent activity on Discord,
+// recording their tags & whether they were archived or deleted.
+// Archived posts are left out of the backlog until someone posts in them again.
+//
+//encore:api private method=POST path=/forum-post-activity/recheck-stale
+func RecheckStaleForumPosts(ctx context.Context) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.recheckStaleForumPosts(ctx)
+}
+
+func (s *Service) recheckStaleForumPosts(ctx context.Context) error {
+	activities, err := scanForumPostActivities(ctx, `
+		SELECT `+forumPostActivityColumns+`
+		FROM forum_post_activity
+		WHERE resolved_at IS NULL AND archived_at IS NULL AND NOT duplicate AND last_activity_at < $1
+		ORDER BY synced_at
+		LIMIT $2
+	`, time.Now().Add(-forumPostStaleAfter), maxStaleForumPostRechecks)
+	if err != nil {
+		return err
+	}
+
+	if len(activities) == 0 {
+		return nil
+	}
+
+	forumChannel, err := s.discordClient.Channel(forumChannelID)
+	if err != nil {
+		return fmt.Errorf("couldn't get forum channel: %w", err)
+	}
+
+	for _, activity := range activities {
+		if err := s.recheckForumPost(ctx, forumChannel, activity); err != nil {
+			rlog.Error("Couldn't re-check forum post", "forumPostId", activity.ForumPostID, "error", err)
+		}
+	}
+
+	rlog.Info("Re-checked stale forum posts", "count", len(activities))
+	return nil
+}
+
+func (s *Service) recheckForumPost(ctx context.Context, forumChannel *discordgo.Channel, activity *forumPostActivity) error {
+	thread, err := s.discordClient.Channel(activity.ForumPostID)
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound {
+		_, err := db.Exec(ctx, `
+			UPDATE forum_post_activity SET archived_at = now(), synced_at = now() WHERE forum_post_id = $1
+		`, activity.ForumPostID)
+		if err != nil {
+			return fmt.Errorf("couldn't mark deleted forum post as archived: %w", err)
+		}
+
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't get forum post: %w", err)
+	}
+
+	tagNames := lo.FilterMap(forumChannel.AvailableTags, func(tag discordgo.ForumTag, _ int) (string, bool) {
+		return tag.Name, lo.Contains(thread.AppliedTags, tag.ID)
+	})
+	solved := lo.ContainsBy(tagNames, func(name string) bool {
+		return strings.EqualFold(name, solvedTagName)
+	})
+
+	// a tag change which didn't reach us is dated when the thread was archived, or now
+	var archivedAt *time.Time
+	checkedAt := time.Now()
+	if thread.ThreadMetadata != nil && thread.ThreadMetadata.Archived {
+		archivedAt = &thread.ThreadMetadata.ArchiveTimestamp
+		checkedAt = thread.ThreadMetadata.ArchiveTimestamp
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE forum_post_activity
+		SET tag_names = $2, resolved_at = CASE WHEN $3 THEN $4::TIMESTAMPTZ END, archived_at = $5, title = $6,
+			synced_at = now()
+		WHERE forum_post_id = $1
+	`, activity.ForumPostID, tagNames, solved, checkedAt, archivedAt, thread.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't update forum post activity: %w", err)
+	}
+
+	return nil
+}
+
+// botUserID is looked up once, the bot's user never changes
+var botUserID struct {
+	sync.Mutex
+	id string
+}
+
+func (s *Service) getBotUserID() (string, error) {
+	botUserID.Lock()
+	defer botUserID.Unlock()
+	if botUserID.id != "" {
+		return botUserID.id, nil
+	}
+
+	botUser, err := s.discordClient.User("@me")
+	if err != nil {
+		return "", fmt.Errorf("couldn't get bot user: %w", err)
+	}
+
+	botUserID.id = botUser.ID
+	return botUserID.id, nil
+}
+
+type ForumSupportMetricsRequest struct {
+	// From defaults to 30 days before To
+	From time.Time `json:"from"`
+	// To defaults to now
+	To time.Time `json:"to"`
+	// Granularity of the buckets: hour, day (default), week or month
+	Granularity models.InsightGranularity `json:"granularity"`
+	// GuildID selects the timezone of the buckets, UTC is used without it
+	GuildID string `json:"guildId"`
+	// Tag limits the metrics to the posts with the given tag
+	Tag string `json:"tag"`
+}
+
+type ForumSupportMetrics struct {
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Tag       string     `json:"tag,omitempty"`
+	// Posts created in the bucket, the other metrics are about these posts
+	Posts      int `json:"posts"`
+	Resolved   int `json:"resolved"`
+	Unanswered int `json:"unanswered"`
+	// the median durations are empty when no post got such a response
+	MedianFirstHumanResponseSeconds *float64 `json:"medianFirstHumanResponseSeconds"`
+	MedianFirstAIResponseSeconds    *float64 `json:"medianFirstAIResponseSeconds"`
+	MedianResolutionSeconds         *float64 `json:"medianResolutionSeconds"`
+	DuplicateRate                   float64  `json:"duplicateRate"`
+	// AIDeflectionRate is the share of posts answered by the AI assistant which were resolved before a human responded
+	AIDeflectionRate float64 `json:"aiDeflectionRate"`
+}
+
+type ForumBacklog struct {
+	// Open posts aren't resolved, duplicates & posts archived without being resolved excluded
+	Open int `json:"open"`
+	// Unanswered posts are open without a human response
+	Unanswered             int        `json:"unanswered"`
+	OldestUnansweredPostAt *time.Time `json:"oldestUnansweredPostAt,omitempty"`
+}
+
+type ForumSupportMetricsResponse struct {
+	Buckets []*ForumSupportMetrics `json:"buckets"`
+	// Tags are the metrics of the whole range per tag
+	Tags    []*ForumSupportMetrics `json:"tags"`
+	Backlog *ForumBacklog          `json:"backlog"`
+}
+
+// encore:api public path=/get-forum-support-metrics
+func (s *Service) GetForumSupportMetrics(
+	ctx context.Context, req *ForumSupportMetricsRequest,
+) (*ForumSupportMetricsResponse, error) {
+	r, err := resolveInsightRange(ctx, &MetricDurationRequest{
+		From: req.From,
+		To:   req.To,
+		// the last 30 days, unless a range is given
+		Hours:       30 * 24,
+		Granularity: lo.Ternary(req.Granularity == "", models.InsightGranularityDay, req.Granularity),
+		GuildID:     req.GuildID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(r.timezone)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load timezone: %w", err)
+	}
+
+	activities, err := scanForumPostActivities(ctx, `
+		SELECT `+forumPostActivityColumns+`
+		FROM forum_post_activity
+		WHERE created_at >= $1 AND created_at < $2 AND ($3 = '' OR $3 = ANY(tag_names))
+	`, r.buckets[0], nextBucketStart(r.buckets[len(r.buckets)-1], r.granularity), req.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[int64]*forumMetricsAccumulator)
+	tags := make(map[string]*forumMetricsAccumulator)
+	for _, activity := range activities {
+		bucket := bucketStart(activity.CreatedAt, r.granularity, loc).Unix()
+		if _, ok := buckets[bucket]; !ok {
+			buckets[bucket] = &forumMetricsAccumulator{}
+		}
+		buckets[bucket].add(activity)
+
+		for _, tag := range activity.TagNames {
+			if _, ok := tags[tag]; !ok {
+				tags[tag] = &forumMetricsAccumulator{}
+			}
+			tags[tag].add(activity)
+		}
+	}
+
+	resp := &ForumSupportMetricsResponse{}
+	for _, bucket := range r.buckets {
+		accumulator, ok := buckets[bucket.Unix()]
+		if !ok {
+			accumulator = &forumMetricsAccumulator{}
+		}
+
+		timestamp := bucket
+		metrics := accumulator.metrics()
+		metrics.Timestamp = &timestamp
+		resp.Buckets = append(resp.Buckets, metrics)
+	}
+
+	for _, tag := range lo.Keys(tags) {
+		metrics := tags[tag].metrics()
+		metrics.Tag = tag
+		resp.Tags = append(resp.Tags, metrics)
+	}
+	sort.Slice(resp.Tags, func(i, j int) bool {
+		return resp.Tags[i].Posts > resp.Tags[j].Posts
+	})
+
+	resp.Backlog, err = getForumBacklog(ctx, req.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func getForumBacklog(ctx context.Context, tag string) (*ForumBacklog, error) {
+	backlog := &ForumBacklog{}
+	err := db.QueryRow(ctx, `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE first_human_response_at IS NULL),
+			MIN(created_at) FILTER (WHERE first_human_response_at IS NULL)
+		FROM forum_post_activity
+		WHERE resolved_at IS NULL AND archived_at IS NULL AND NOT duplicate AND ($1 = '' OR $1 = ANY(tag_names))
+	`, tag).Scan(&backlog.Open, &backlog.Unanswered, &backlog.OldestUnansweredPostAt)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get forum backlog: %w", err)
+	}
+
+	return backlog, nil
+}
+
+type forumMetricsAccumulator struct {
+	posts, resolved, unanswered, duplicates, aiAnswered, deflected int
+	humanResponses, aiResponses, resolutions                       []float64
+}
+
+func (f *forumMetricsAccumulator) add(a *forumPostActivity) {
+	f.posts++
+	if a.Duplicate {
+		f.duplicates++
+	}
+
+	if a.ResolvedAt != nil {
+		f.resolved++
+		f.resolutions = append(f.resolutions, a.ResolvedAt.Sub(a.CreatedAt).Seconds())
+	}
+
+	if a.FirstHumanResponseAt != nil {
+		f.humanResponses = append(f.humanResponses, a.FirstHumanResponseAt.Sub(a.CreatedAt).Seconds())
+	} else if a.ResolvedAt == nil && !a.Duplicate {
+		f.unanswered++
+	}
+
+	if aiResponseAt := a.firstAIResponseAt(); aiResponseAt != nil {
+		f.aiAnswered++
+		f.aiResponses = append(f.aiResponses, aiResponseAt.Sub(a.CreatedAt).Seconds())
+		if a.deflected() {
+			f.deflected++
+		}
+	}
+}
+
+func (f *forumMetricsAccumulator) metrics() *ForumSupportMetrics {
+	metrics := &ForumSupportMetrics{
+		Posts:                           f.posts,
+		Resolved:                        f.resolved,
+		Unanswered:                      f.unanswered,
+		MedianFirstHumanResponseSeconds: median(f.humanResponses),
+		MedianFirstAIResponseSeconds:    median(f.aiResponses),
+		MedianResolutionSeconds:         median(f.resolutions),
+	}
+
+	if f.posts > 0 {
+		metrics.DuplicateRate = float64(f.duplicates) / float64(f.posts)
+	}
+
+	if f.aiAnswered > 0 {
+		metrics.AIDeflectionRate = float64(f.deflected) / float64(f.aiAnswered)
+	}
+
+	return metrics
+}
+
+func median(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	result := sorted[mid]
+	if len(sorted)%2 == 0 {
+		result = (sorted[mid-1] + sorted[mid]) / 2
+	}
+
+	return &result
+}
@@ -0,0 +1,98 @@
+package communityinsights
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   *float64
+	}{
+		{name: "no values", values: nil, want: nil},
+		{name: "single value", values: []float64{3}, want: ptr(3)},
+		{name: "odd count", values: []float64{9, 1, 5}, want: ptr(5)},
+		{name: "even count averages the middle values", values: []float64{4, 1, 10, 2}, want: ptr(3)},
+		{name: "duplicates", values: []float64{2, 2, 2, 8}, want: ptr(2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := median(tt.values)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("median(%v) = %v, want %v", tt.values, deref(got), deref(tt.want))
+			}
+		})
+	}
+}
+
+func TestMedianKeepsValuesUnsorted(t *testing.T) {
+	values := []float64{3, 1, 2}
+	median(values)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Errorf("median() sorted its input: %v", values)
+	}
+}
+
+func TestForumPostActivityDeflected(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) *time.Time {
+		ts := createdAt.Add(time.Duration(minutes) * time.Minute)
+		return &ts
+	}
+
+	tests := []struct {
+		name     string
+		activity *forumPostActivity
+		want     bool
+	}{
+		{
+			name:     "resolved after the AI answered & before any human",
+			activity: &forumPostActivity{FirstBotResponseAt: at(1), ResolvedAt: at(10), FirstHumanResponseAt: at(20)},
+			want:     true,
+		},
+		{
+			name:     "resolved without any human response",
+			activity: &forumPostActivity{FirstBotResponseAt: at(1), ResolvedAt: at(10)},
+			want:     true,
+		},
+		{
+			name:     "a human responded before the resolution",
+			activity: &forumPostActivity{FirstBotResponseAt: at(1), FirstHumanResponseAt: at(5), ResolvedAt: at(10)},
+			want:     false,
+		},
+		{
+			name:     "not resolved",
+			activity: &forumPostActivity{FirstBotResponseAt: at(1)},
+			want:     false,
+		},
+		{
+			name:     "duplicates are answered with a notice, not by the AI",
+			activity: &forumPostActivity{FirstBotResponseAt: at(1), ResolvedAt: at(10), Duplicate: true},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.activity.CreatedAt = createdAt
+			if got := tt.activity.deflected(); got != tt.want {
+				t.Errorf("deflected() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr(value float64) *float64 {
+	return &value
+}
+
+func deref(value *float64) any {
+	if value == nil {
+		return nil
+	}
+
+	return *value
+}
@@ -0,0 +1,12 @@
+-- forum post activity is recorded from the forum post, message & tag change events instead of syncing threads,
+-- open posts which went quiet are re-checked & left out of the backlog once archived
+ALTER TABLE forum_post_activity
+    ADD COLUMN tags_changed_at TIMESTAMPTZ,
+    ADD COLUMN last_activity_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN archived_at TIMESTAMPTZ,
+    DROP COLUMN last_message_id;
+
+UPDATE forum_post_activity SET last_activity_at = synced_at;
+
+CREATE INDEX forum_post_activity_stale_idx ON forum_post_activity (last_activity_at)
+    WHERE resolved_at IS NULL AND archived_at IS NULL;
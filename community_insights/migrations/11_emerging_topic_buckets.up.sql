@@ -0,0 +1,14 @@
+-- the clustered hours are tracked on insight_buckets, so hours missed by the emerging topics cron are backfilled
+ALTER TABLE insight_buckets
+    ADD COLUMN topics_clustered_at TIMESTAMPTZ,
+    ADD COLUMN clustered_items INT NOT NULL DEFAULT 0;
+
+INSERT INTO insight_buckets (bucket_start, topics_clustered_at, clustered_items)
+SELECT bucket_start, created_at, items FROM emerging_topic_runs
+ON CONFLICT (bucket_start) DO UPDATE SET
+    topics_clustered_at = EXCLUDED.topics_clustered_at,
+    clustered_items = EXCLUDED.clustered_items;
+
+DROP TABLE emerging_topic_runs;
+
+CREATE INDEX insight_buckets_unclustered_idx ON insight_buckets (bucket_start) WHERE topics_clustered_at IS NULL;
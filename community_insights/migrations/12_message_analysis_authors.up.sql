@@ -0,0 +1,7 @@
+-- the author of cached analyses, so the sentiment of members who opt out can be purged from the cache
+ALTER TABLE message_analyses ADD COLUMN author_id TEXT NOT NULL DEFAULT '';
+
+-- cached analyses without an author can't be purged, they're dropped & analyzed again on the next recompute
+DELETE FROM message_analyses;
+
+CREATE INDEX message_analyses_author_id_idx ON message_analyses (author_id);
@@ -0,0 +1,2 @@
+-- the title of forum posts, recorded with the post so clustering doesn't look it up on Discord
+ALTER TABLE forum_post_activity ADD COLUMN title TEXT NOT NULL DEFAULT '';
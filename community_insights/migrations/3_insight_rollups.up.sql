@@ -0,0 +1,16 @@
+CREATE TABLE guild_insight_settings (
+    guild_id TEXT PRIMARY KEY,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- day, week & month aggregates of the hourly community_insights rows, per timezone
+CREATE TABLE community_insight_rollups (
+    type VARCHAR(255) NOT NULL,
+    granularity TEXT NOT NULL,
+    timezone TEXT NOT NULL,
+    bucket_start TIMESTAMPTZ NOT NULL,
+    value JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (type, granularity, timezone, bucket_start)
+);
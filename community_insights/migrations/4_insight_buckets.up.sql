@@ -0,0 +1,12 @@
+-- one row per hour of community_insights, so missed & failed hours are backfilled
+CREATE TABLE insight_buckets (
+    bucket_start TIMESTAMP PRIMARY KEY,
+    status TEXT NOT NULL DEFAULT 'PENDING',
+    attempts INT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    processed_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX insight_buckets_status_idx ON insight_buckets (status, bucket_start);
+
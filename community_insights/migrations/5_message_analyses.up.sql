@@ -0,0 +1,16 @@
+-- LLM analyses of messages, so recomputing an hour only pays for messages which weren't analyzed yet
+CREATE TABLE message_analyses (
+    message_id TEXT NOT NULL,
+    -- version changes with the prompt or model, so a recompute after such changes analyzes messages again
+    version TEXT NOT NULL,
+    topic TEXT NOT NULL,
+    sentiment TEXT NOT NULL,
+    language TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, version)
+);
+
+ALTER TABLE insight_buckets
+    ADD COLUMN analyzed_messages INT NOT NULL DEFAULT 0,
+    ADD COLUMN skipped_messages INT NOT NULL DEFAULT 0,
+    ADD COLUMN estimated_tokens INT NOT NULL DEFAULT 0;
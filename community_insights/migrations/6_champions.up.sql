@@ -0,0 +1 @@
+ALTER TABLE guild_insight_settings ADD COLUMN champions_channel_id TEXT NOT NULL DEFAULT '';
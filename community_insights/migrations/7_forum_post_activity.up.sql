@@ -0,0 +1,18 @@
+-- support activity of forum posts, synced from their Discord threads
+CREATE TABLE forum_post_activity (
+    forum_post_id TEXT PRIMARY KEY,
+    -- requester_id is the thread owner, or the member a bot created the post for
+    requester_id TEXT NOT NULL DEFAULT '',
+    tag_names TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL,
+    first_human_response_at TIMESTAMPTZ,
+    -- the bot answers unique posts with the AI assistant & flags duplicates
+    first_bot_response_at TIMESTAMPTZ,
+    resolved_at TIMESTAMPTZ,
+    duplicate BOOLEAN NOT NULL DEFAULT FALSE,
+    last_message_id TEXT NOT NULL DEFAULT '',
+    synced_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX forum_post_activity_created_at_idx ON forum_post_activity (created_at);
+CREATE INDEX forum_post_activity_open_idx ON forum_post_activity (created_at) WHERE resolved_at IS NULL;
@@ -0,0 +1,25 @@
+-- clusters of similar messages & forum posts, tracked over time to detect spikes
+CREATE TABLE emerging_topics (
+    id BIGSERIAL PRIMARY KEY,
+    label TEXT NOT NULL,
+    summary TEXT NOT NULL,
+    centroid REAL[] NOT NULL,
+    item_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_alerted_at TIMESTAMPTZ
+);
+
+CREATE TABLE emerging_topic_volumes (
+    topic_id BIGINT NOT NULL REFERENCES emerging_topics (id) ON DELETE CASCADE,
+    bucket_start TIMESTAMP NOT NULL,
+    count INT NOT NULL,
+    PRIMARY KEY (topic_id, bucket_start)
+);
+
+-- hours already clustered, as clustering updates the topics it isn't repeatable
+CREATE TABLE emerging_topic_runs (
+    bucket_start TIMESTAMP PRIMARY KEY,
+    items INT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,16 @@
+ALTER TABLE guild_insight_settings
+    ADD COLUMN sentiment_mode TEXT NOT NULL DEFAULT 'per_user',
+    ADD COLUMN min_sentiment_messages INT NOT NULL DEFAULT 5;
+
+-- members whose messages are left out of the sentiment insights
+CREATE TABLE sentiment_opt_outs (
+    user_id TEXT PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- usernames resolved from Discord, refreshed once they're stale
+CREATE TABLE user_profiles (
+    user_id TEXT PRIMARY KEY,
+    username TEXT NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
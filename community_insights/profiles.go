@@ -0,0 +1,63 @@
+package communityinsights
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/rlog"
+	"github.com/samber/lo"
+)
+
+// usernames rarely change, they're fetched from Discord again once a day
+const userProfileTTL = 24 * time.Hour
+
+// resolveUsernames returns the usernames of the users, users which couldn't be resolved are missing
+func (s *Service) resolveUsernames(ctx context.Context, userIDs []string) (map[string]string, error) {
+	userIDs = lo.Uniq(userIDs)
+	rows, err := db.Query(ctx, `
+		SELECT user_id, username
+		FROM user_profiles
+		WHERE user_id = ANY($1) AND fetched_at > $2
+	`, userIDs, time.Now().Add(-userProfileTTL))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get user profiles: %w", err)
+	}
+	defer rows.Close()
+
+	usernames := make(map[string]string, len(userIDs))
+	for rows.Next() {
+		var userID, username string
+		if err := rows.Scan(&userID, &username); err != nil {
+			return nil, fmt.Errorf("couldn't scan user profile: %w", err)
+		}
+		usernames[userID] = username
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, userID := range userIDs {
+		if _, ok := usernames[userID]; ok {
+			continue
+		}
+
+		user, err := s.discordClient.User(userID)
+		if err != nil {
+			rlog.Warn("Couldn't resolve username", "userId", userID, "error", err)
+			continue
+		}
+
+		_, err = db.Exec(ctx, `
+			INSERT INTO user_profiles (user_id, username) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET username = EXCLUDED.username, fetched_at = now()
+		`, userID, user.Username)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't cache user profile: %w", err)
+		}
+		usernames[userID] = user.Username
+	}
+
+	return usernames, nil
+}
@@ -0,0 +1,340 @@
+package communityinsights
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	// bucket boundaries need the timezone database, which slim containers don't ship
+	_ "time/tzdata"
+
+	"encore.app/models"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
+)
+
+// hourly insights are only added or corrected for recent hours, so the cron only recomputes their buckets
+const rollupLookback = 48 * time.Hour
+
+const defaultInsightTimezone = "UTC"
+
+var rolledUpGranularities = []models.InsightGranularity{
+	models.InsightGranularityDay,
+	models.InsightGranularityWeek,
+	models.InsightGranularityMonth,
+}
+
+var _ = cron.NewJob("rollup-community-insights", cron.JobConfig{
+	Title:    "Roll up hourly community insights into days, weeks & months",
+	Every:    1 * cron.Hour,
+	Endpoint: RollupRecentInsights,
+})
+
+// RollupRecentInsights recomputes the rollups containing the hours of the last two days.
+//
+//encore:api private method=POST path=/insight-rollups/recent
+func RollupRecentInsights(ctx context.Context) error {
+	now := time.Now().UTC()
+	return rollupInsights(ctx, now.Add(-rollupLookback), now)
+}
+
+type RollupInsightsRequest struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// RollupInsights recomputes the rollups containing the hours between from & to, in every configured timezone.
+//
+//encore:api private method=POST path=/insight-rollups
+func RollupInsights(ctx context.Context, req *RollupInsightsRequest) error {
+	if req.From.IsZero() || req.To.IsZero() {
+		return errors.New("please provide a range to roll up")
+	} else if req.To.Before(req.From) {
+		return errors.New("to must be after from")
+	}
+
+	return rollupInsights(ctx, req.From, req.To)
+}
+
+func rollupInsights(ctx context.Context, from, to time.Time) error {
+	rows, err := db.Query(ctx, "SELECT DISTINCT timezone FROM guild_insight_settings")
+	if err != nil {
+		return fmt.Errorf("couldn't get insight timezones: %w", err)
+	}
+
+	timezones := []string{defaultInsightTimezone}
+	for rows.Next() {
+		var timezone string
+		if err := rows.Scan(&timezone); err != nil {
+			rows.Close()
+			return fmt.Errorf("couldn't scan insight timezone: %w", err)
+		}
+		timezones = append(timezones, timezone)
+	}
+	rows.Close()
+
+	for _, timezone := range lo.Uniq(timezones) {
+		if err := rollupInsightsInTimezone(ctx, timezone, from, to); err != nil {
+			return fmt.Errorf("couldn't roll up insights in %s: %w", timezone, err)
+		}
+	}
+
+	return nil
+}
+
+type rollupKey struct {
+	insightType string
+	bucket      time.Time
+}
+
+func rollupInsightsInTimezone(ctx context.Context, timezone string, from, to time.Time) error {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return fmt.Errorf("couldn't load timezone: %w", err)
+	}
+
+	for _, granularity := range rolledUpGranularities {
+		start := bucketStart(from, granularity, loc)
+		end := nextBucketStart(bucketStart(to, granularity, loc), granularity)
+
+		rows, err := db.Query(ctx, `
+			SELECT type, timestamp, value::TEXT
+			FROM community_insights
+			WHERE timestamp >= $1 AND timestamp < $2
+		`, start.UTC(), end.UTC())
+		if err != nil {
+			return fmt.Errorf("couldn't get hourly insights: %w", err)
+		}
+
+		hourlyValues := make(map[rollupKey][]string)
+		var keys []rollupKey
+		for rows.Next() {
+			var insightType, value string
+			var timestamp time.Time
+			if err := rows.Scan(&insightType, &timestamp, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("couldn't scan hourly insight: %w", err)
+			}
+
+			key := rollupKey{insightType: insightType, bucket: bucketStart(timestamp, granularity, loc)}
+			if _, ok := hourlyValues[key]; !ok {
+				keys = append(keys, key)
+			}
+			hourlyValues[key] = append(hourlyValues[key], value)
+		}
+		rows.Close()
+
+		for _, key := range keys {
+			value, ok, err := mergeInsightValues(key.insightType, hourlyValues[key])
+			if err != nil {
+				return fmt.Errorf("couldn't merge %s insights: %w", key.insightType, err)
+			} else if !ok {
+				continue
+			}
+
+			_, err = db.Exec(ctx, `
+				INSERT INTO community_insight_rollups (type, granularity, timezone, bucket_start, value)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (type, granularity, timezone, bucket_start)
+				DO UPDATE SET value = EXCLUDED.value, updated_at = now()
+			`, key.insightType, granularity, timezone, key.bucket, value)
+			if err != nil {
+				return fmt.Errorf("couldn't upsert insight rollup: %w", err)
+			}
+		}
+
+		rlog.Info("Rolled up insights", "timezone", timezone, "granularity", granularity, "buckets", len(keys))
+	}
+
+	return nil
+}
+
+// mergeInsightValues sums the hourly values of an insight, ok is false for insights which aren't rolled up
+func mergeInsightValues(insightType string, values []string) (string, bool, error) {
+	var merged any
+	switch insightType {
+	case "message_count":
+		total := struct {
+			Count int `json:"count"`
+		}{}
+		for _, value := range values {
+			var count struct {
+				Count int `json:"count"`
+			}
+			if err := json.Unmarshal([]byte(value), &count); err != nil {
+				return "", false, err
+			}
+			total.Count += count.Count
+		}
+		merged = total
+	case "messages_count_per_topic", "messages_count_per_language":
+		total := make(map[string]int)
+		for _, value := range values {
+			var topicCounts map[string]int
+			if err := json.Unmarshal([]byte(value), &topicCounts); err != nil {
+				return "", false, err
+			}
+			for topic, count := range topicCounts {
+				total[topic] += count
+			}
+		}
+		merged = total
+	case "champion_scores":
+		total := make(map[string]*models.ChampionStats)
+		for _, value := range values {
+			var championStats map[string]*models.ChampionStats
+			if err := json.Unmarshal([]byte(value), &championStats); err != nil {
+				return "", false, err
+			}
+			for userID, stats := range championStats {
+				if _, ok := total[userID]; !ok {
+					total[userID] = &models.ChampionStats{}
+				}
+				addChampionStats(total[userID], stats)
+			}
+		}
+		merged = total
+	case "sentiment_per_user", "sentiment_per_channel", "sentiment_per_topic":
+		total := make(map[string]*models.MessageSentimentStats)
+		for _, value := range values {
+			var sentimentStats map[string]*models.MessageSentimentStats
+			if err := json.Unmarshal([]byte(value), &sentimentStats); err != nil {
+				return "", false, err
+			}
+			for key, stats := range sentimentStats {
+				if _, ok := total[key]; !ok {
+					total[key] = &models.MessageSentimentStats{}
+				}
+				addSentimentStats(total[key], stats)
+			}
+		}
+		merged = total
+	default:
+		return "", false, nil
+	}
+
+	jsonVal, err := json.Marshal(merged)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(jsonVal), true, nil
+}
+
+// bucketStart returns the start of the bucket containing t, weeks start on Monday
+func bucketStart(t time.Time, granularity models.InsightGranularity, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch granularity {
+	case models.InsightGranularityDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case models.InsightGranularityWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case models.InsightGranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	default:
+		return t.Truncate(time.Hour)
+	}
+}
+
+func nextBucketStart(start time.Time, granularity models.InsightGranularity) time.Time {
+	switch granularity {
+	case models.InsightGranularityDay:
+		return start.AddDate(0, 0, 1)
+	case models.InsightGranularityWeek:
+		return start.AddDate(0, 0, 7)
+	case models.InsightGranularityMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.Add(time.Hour)
+	}
+}
+
+type SetGuildInsightSettingsRequest struct {
+	GuildID  string `json:"guild_id"`
+	Timezone string `json:"timezone"`
+	// ChampionsChannelID enables the weekly champions post in the channel, it's disabled if empty
+	ChampionsChannelID string `json:"champions_channel_id"`
+	// SentimentMode is per_user (default) or aggregate, which disables the per-user sentiment ranking.
+	// The per-user insights aren't split by guild, so a single guild in aggregate mode disables it for all.
+	SentimentMode models.SentimentMode `json:"sentiment_mode"`
+	// MinSentimentMessages defaults to 5
+	MinSentimentMessages int `json:"min_sentiment_messages"`
+}
+
+// SetGuildInsightSettings sets the timezone of a guild's insight buckets & rolls up the existing insights in it.
+//
+//encore:api private method=PUT path=/guild-insight-settings
+func SetGuildInsightSettings(ctx context.Context, req *SetGuildInsightSettingsRequest) (*models.GuildInsightSettings, error) {
+	if req.GuildID == "" {
+		return nil, errors.New("please provide a guild")
+	} else if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "" {
+		return nil, fmt.Errorf("unknown timezone %q", req.Timezone)
+	} else if req.MinSentimentMessages < 0 {
+		return nil, errors.New("please provide a non-negative minimum number of sentiment messages")
+	}
+
+	sentimentMode := lo.Ternary(req.SentimentMode == "", models.SentimentModePerUser, req.SentimentMode)
+	if sentimentMode != models.SentimentModePerUser && sentimentMode != models.SentimentModeAggregate {
+		return nil, fmt.Errorf("unsupported sentiment mode %q, use per_user or aggregate", req.SentimentMode)
+	}
+	minSentimentMessages := lo.Ternary(req.MinSentimentMessages == 0, defaultMinSentimentMessages, req.MinSentimentMessages)
+
+	settings := &models.GuildInsightSettings{}
+	err := db.QueryRow(ctx, `
+		INSERT INTO guild_insight_settings (guild_id, timezone, champions_channel_id, sentiment_mode, min_sentiment_messages)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (guild_id) DO UPDATE SET
+			timezone = EXCLUDED.timezone,
+			champions_channel_id = EXCLUDED.champions_channel_id,
+			sentiment_mode = EXCLUDED.sentiment_mode,
+			min_sentiment_messages = EXCLUDED.min_sentiment_messages,
+			updated_at = now()
+		RETURNING guild_id, timezone, champions_channel_id, sentiment_mode, min_sentiment_messages, updated_at
+	`, req.GuildID, req.Timezone, req.ChampionsChannelID, sentimentMode, minSentimentMessages).Scan(
+		&settings.GuildID, &settings.Timezone, &settings.ChampionsChannelID,
+		&settings.SentimentMode, &settings.MinSentimentMessages, &settings.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set guild insight settings: %w", err)
+	}
+
+	// a new timezone has no rollups yet, build them for the whole history
+	var oldest *time.Time
+	if err := db.QueryRow(ctx, "SELECT MIN(timestamp) FROM community_insights").Scan(&oldest); err != nil {
+		return nil, fmt.Errorf("couldn't get oldest insight: %w", err)
+	}
+
+	if oldest != nil {
+		if err := rollupInsightsInTimezone(ctx, req.Timezone, *oldest, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, nil
+}
+
+// GetGuildInsightSettings returns the insight settings of a guild, guilds without settings use the defaults.
+//
+//encore:api private method=GET path=/guild-insight-settings/:guildID
+func GetGuildInsightSettings(ctx context.Context, guildID string) (*models.GuildInsightSettings, error) {
+	settings := &models.GuildInsightSettings{
+		GuildID:              guildID,
+		Timezone:             defaultInsightTimezone,
+		SentimentMode:        models.SentimentModePerUser,
+		MinSentimentMessages: defaultMinSentimentMessages,
+	}
+	err := db.QueryRow(ctx, `
+		SELECT timezone, champions_channel_id, sentiment_mode, min_sentiment_messages, updated_at
+		FROM guild_insight_settings
+		WHERE guild_id = $1
+	`, guildID).Scan(&settings.Timezone, &settings.ChampionsChannelID,
+		&settings.SentimentMode, &settings.MinSentimentMessages, &settings.UpdatedAt)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, fmt.Errorf("couldn't get guild insight settings: %w", err)
+	}
+
+	return settings, nil
+}
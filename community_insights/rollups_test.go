@@ -0,0 +1,233 @@
+package communityinsights
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/models"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loc
+}
+
+func utc(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return parsed
+}
+
+func TestBucketStart(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name        string
+		t           time.Time
+		granularity models.InsightGranularity
+		loc         *time.Location
+		want        time.Time
+	}{
+		{
+			name:        "hour right after spring forward",
+			t:           utc("2024-03-31T01:30:00Z"),
+			granularity: models.InsightGranularityHour,
+			loc:         berlin,
+			want:        utc("2024-03-31T01:00:00Z"),
+		},
+		{
+			name:        "day of spring forward starts before the change",
+			t:           utc("2024-03-31T12:00:00Z"),
+			granularity: models.InsightGranularityDay,
+			loc:         berlin,
+			want:        utc("2024-03-30T23:00:00Z"),
+		},
+		{
+			name:        "day of fall back starts before the change",
+			t:           utc("2024-10-27T20:00:00Z"),
+			granularity: models.InsightGranularityDay,
+			loc:         berlin,
+			want:        utc("2024-10-26T22:00:00Z"),
+		},
+		{
+			name:        "day is the local day, not the UTC one",
+			t:           utc("2024-03-10T04:30:00Z"),
+			granularity: models.InsightGranularityDay,
+			loc:         newYork,
+			want:        utc("2024-03-09T05:00:00Z"),
+		},
+		{
+			name:        "week of a Sunday starts on the Monday before",
+			t:           utc("2024-03-31T12:00:00Z"),
+			granularity: models.InsightGranularityWeek,
+			loc:         berlin,
+			want:        utc("2024-03-24T23:00:00Z"),
+		},
+		{
+			name:        "week of a Monday starts on that Monday",
+			t:           utc("2024-03-25T10:00:00Z"),
+			granularity: models.InsightGranularityWeek,
+			loc:         berlin,
+			want:        utc("2024-03-24T23:00:00Z"),
+		},
+		{
+			name:        "month is the local month, not the UTC one",
+			t:           utc("2024-03-31T23:30:00Z"),
+			granularity: models.InsightGranularityMonth,
+			loc:         berlin,
+			want:        utc("2024-03-31T22:00:00Z"),
+		},
+		{
+			name:        "month in UTC",
+			t:           utc("2024-02-29T23:59:59Z"),
+			granularity: models.InsightGranularityMonth,
+			loc:         time.UTC,
+			want:        utc("2024-02-01T00:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketStart(tt.t, tt.granularity, tt.loc); !got.Equal(tt.want) {
+				t.Errorf("bucketStart() = %v, want %v", got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNextBucketStart(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	tests := []struct {
+		name        string
+		start       time.Time
+		granularity models.InsightGranularity
+		want        time.Time
+	}{
+		{
+			name:        "hour",
+			start:       utc("2024-03-31T00:00:00Z").In(berlin),
+			granularity: models.InsightGranularityHour,
+			want:        utc("2024-03-31T01:00:00Z"),
+		},
+		{
+			name:        "day of spring forward lasts 23 hours",
+			start:       utc("2024-03-30T23:00:00Z").In(berlin),
+			granularity: models.InsightGranularityDay,
+			want:        utc("2024-03-31T22:00:00Z"),
+		},
+		{
+			name:        "day of fall back lasts 25 hours",
+			start:       utc("2024-10-26T22:00:00Z").In(berlin),
+			granularity: models.InsightGranularityDay,
+			want:        utc("2024-10-27T23:00:00Z"),
+		},
+		{
+			name:        "week across spring forward",
+			start:       utc("2024-03-24T23:00:00Z").In(berlin),
+			granularity: models.InsightGranularityWeek,
+			want:        utc("2024-03-31T22:00:00Z"),
+		},
+		{
+			name:        "month across fall back",
+			start:       utc("2024-09-30T22:00:00Z").In(berlin),
+			granularity: models.InsightGranularityMonth,
+			want:        utc("2024-10-31T23:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextBucketStart(tt.start, tt.granularity); !got.Equal(tt.want) {
+				t.Errorf("nextBucketStart() = %v, want %v", got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeInsightValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		insightType string
+		values      []string
+		want        string
+		wantOK      bool
+		wantErr     bool
+	}{
+		{
+			name:        "message count",
+			insightType: "message_count",
+			values:      []string{`{"count": 2}`, `{"count": 3}`},
+			want:        `{"count":5}`,
+			wantOK:      true,
+		},
+		{
+			name:        "no values",
+			insightType: "message_count",
+			want:        `{"count":0}`,
+			wantOK:      true,
+		},
+		{
+			name:        "counts per topic",
+			insightType: "messages_count_per_topic",
+			values:      []string{`{"bugs": 1, "deploys": 2}`, `{"bugs": 3}`},
+			want:        `{"bugs":4,"deploys":2}`,
+			wantOK:      true,
+		},
+		{
+			name:        "sentiment per user",
+			insightType: "sentiment_per_user",
+			values: []string{
+				`{"1": {"positive": 1, "neutral": 0, "negative": 2}}`,
+				`{"1": {"positive": 1, "neutral": 1, "negative": 0}, "2": {"positive": 0, "neutral": 1, "negative": 0}}`,
+			},
+			want:   `{"1":{"positive":2,"neutral":1,"negative":2},"2":{"positive":0,"neutral":1,"negative":0}}`,
+			wantOK: true,
+		},
+		{
+			name:        "champion scores",
+			insightType: "champion_scores",
+			values: []string{
+				`{"1": {"replies": 2, "score": 4}}`,
+				`{"1": {"replies": 1, "solvedThreads": 1, "score": 6}}`,
+			},
+			want: `{"1":{"repliesToQuestions":0,"replies":3,"forumThreadsHelped":0,"solvedThreads":1,` +
+				`"positiveReactions":0,"score":10}}`,
+			wantOK: true,
+		},
+		{
+			name:        "insights which aren't rolled up",
+			insightType: "unknown",
+			values:      []string{`{"count": 2}`},
+		},
+		{
+			name:        "invalid value",
+			insightType: "messages_count_per_topic",
+			values:      []string{`{"bugs": "one"}`},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := mergeInsightValues(tt.insightType, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeInsightValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("mergeInsightValues() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
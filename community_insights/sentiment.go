@@ -0,0 +1,318 @@
+package communityinsights
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/discord_handler"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+)
+
+const sentimentCommandName = "sentiment"
+
+const defaultMinSentimentMessages = 5
+
+const interactionsSubscription = "community-insights-interactions"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordInteractionTopic,
+	"community-insights-interactions",
+	pubsub.SubscriptionConfig[*models.DiscordInteractionEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-interactions", interactionsSubscription, 5, handleInteraction),
+	})
+
+func handleInteraction(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	if interaction.Type != discordgo.InteractionApplicationCommand || interaction.CommandName != sentimentCommandName {
+		return nil
+	}
+
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.handleSentimentCommand(ctx, interaction)
+}
+
+func (s *Service) handleSentimentCommand(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	var reply string
+	switch interaction.SubCommandName {
+	case "opt-out":
+		if err := setSentimentOptOut(ctx, interaction.UserID, true); err != nil {
+			return err
+		}
+		reply = "Got it, your messages are no longer included in the sentiment insights."
+	case "opt-in":
+		if err := setSentimentOptOut(ctx, interaction.UserID, false); err != nil {
+			return err
+		}
+		reply = "Got it, your messages are included in the sentiment insights again."
+	default:
+		reply = "Unknown command, use `/sentiment opt-out` or `/sentiment opt-in`."
+	}
+
+	_, err := s.discordClient.FollowupMessageCreate(interaction.Interaction(), false, &discordgo.WebhookParams{
+		Content: reply,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't respond to interaction: %w", err)
+	}
+
+	return nil
+}
+
+type RegisterSentimentCommandsRequest struct {
+	ApplicationID string `json:"applicationId"`
+	GuildID       string `json:"guildId"`
+}
+
+// RegisterSentimentCommands registers the /sentiment slash command in a guild.
+//
+//encore:api private method=POST path=/sentiment-commands/register
+func RegisterSentimentCommands(ctx context.Context, req *RegisterSentimentCommandsRequest) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	_, err = service.discordClient.ApplicationCommandCreate(req.ApplicationID, req.GuildID, &discordgo.ApplicationCommand{
+		Name:        sentimentCommandName,
+		Description: "Control whether your messages are included in the sentiment insights",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "opt-out",
+				Description: "Leave your messages out of the sentiment insights",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "opt-in",
+				Description: "Include your messages in the sentiment insights again",
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't register slash command: %w", err)
+	}
+
+	return nil
+}
+
+type SetSentimentOptOutRequest struct {
+	UserID   string `json:"user_id"`
+	OptedOut bool   `json:"opted_out"`
+}
+
+// SetSentimentOptOut opts a member out of, or back into, the sentiment insights.
+//
+//encore:api private method=PUT path=/sentiment-opt-outs
+func SetSentimentOptOut(ctx context.Context, req *SetSentimentOptOutRequest) error {
+	if req.UserID == "" {
+		return errors.New("please provide a user")
+	}
+
+	return setSentimentOptOut(ctx, req.UserID, req.OptedOut)
+}
+
+// setSentimentOptOut records the preference & removes the sentiment already computed or cached for a member who opts out.
+// Their sentiment is removed from the per user insights right away, the hours of the last maxRecomputeRange their
+// messages contributed to the per channel & per topic sentiment are queued to be recomputed without them.
+// Older hours & their rollups keep the member's past contribution to those aggregates.
+func setSentimentOptOut(ctx context.Context, userID string, optedOut bool) error {
+	if !optedOut {
+		if _, err := db.Exec(ctx, "DELETE FROM sentiment_opt_outs WHERE user_id = $1", userID); err != nil {
+			return fmt.Errorf("couldn't remove sentiment opt-out: %w", err)
+		}
+
+		return nil
+	}
+
+	_, err := db.Exec(ctx, `
+		INSERT INTO sentiment_opt_outs (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("couldn't add sentiment opt-out: %w", err)
+	}
+
+	removed, err := removeUserFromInsights(ctx, userID, "sentiment_per_user")
+	if err != nil {
+		return err
+	}
+
+	// recomputed hours reuse the cached analyses, which mustn't bring the member's sentiment back
+	rows, err := db.Query(ctx, `
+		UPDATE message_analyses SET sentiment = ''
+		WHERE author_id = $1 AND sentiment <> ''
+		RETURNING message_id
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("couldn't purge cached sentiment: %w", err)
+	}
+	defer rows.Close()
+
+	last := lastCompletedHour()
+	affected := make(map[time.Time]bool)
+	for rows.Next() {
+		var messageID string
+		if err := rows.Scan(&messageID); err != nil {
+			return fmt.Errorf("couldn't scan purged message analysis: %w", err)
+		}
+
+		createdAt, err := discordgo.SnowflakeTimestamp(messageID)
+		if err != nil {
+			continue
+		}
+
+		hour := createdAt.UTC().Truncate(time.Hour)
+		if !hour.After(last) && last.Sub(hour) <= maxRecomputeRange {
+			affected[hour] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("couldn't purge cached sentiment: %w", err)
+	}
+
+	queued, err := requeueInsightBuckets(ctx, lo.Keys(affected))
+	if err != nil {
+		return err
+	}
+
+	rlog.Info("User opted out of sentiment insights", "userId", userID, "insights", removed, "recomputedHours", queued)
+	return nil
+}
+
+// listSentimentOptOuts returns which of the users opted out of the sentiment insights
+func listSentimentOptOuts(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	rows, err := db.Query(ctx, "SELECT user_id FROM sentiment_opt_outs WHERE user_id = ANY($1)", userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get sentiment opt-outs: %w", err)
+	}
+	defer rows.Close()
+
+	optedOut := make(map[string]bool)
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("couldn't scan sentiment opt-out: %w", err)
+		}
+		optedOut[userID] = true
+	}
+
+	return optedOut, rows.Err()
+}
+
+func addSentimentStats(total, stats *models.MessageSentimentStats) {
+	total.Positive += stats.Positive
+	total.Neutral += stats.Neutral
+	total.Negative += stats.Negative
+}
+
+func countSentiment(stats *models.MessageSentimentStats, sentiment models.MessageSentiment) {
+	switch sentiment {
+	case models.MessageSentimentPositive:
+		stats.Positive++
+	case models.MessageSentimentNeutral:
+		stats.Neutral++
+	case models.MessageSentimentNegative:
+		stats.Negative++
+	}
+}
+
+// sentimentScore ranges from -1 when all messages are negative to 1 when they're all positive
+func sentimentScore(stats *models.MessageSentimentStats) float32 {
+	total := stats.Positive + stats.Neutral + stats.Negative
+	if total == 0 {
+		return 0
+	}
+
+	return float32(stats.Positive-stats.Negative) / float32(total)
+}
+
+type SentimentSummary struct {
+	*models.MessageSentimentStats
+	Score float32 `json:"score"`
+}
+
+type TimeSentimentPerGroup struct {
+	Timestamp  time.Time                    `json:"timestamp"`
+	Sentiments map[string]*SentimentSummary `json:"sentiments"`
+}
+
+type GroupSentimentResponse struct {
+	TimeSentiments []TimeSentimentPerGroup `json:"timeSentiments"`
+	// Totals summarizes the whole range
+	Totals map[string]*SentimentSummary `json:"totals"`
+}
+
+// GetChannelSentiment returns the sentiment per channel, without any per-user data.
+//
+// encore:api public path=/get-channel-sentiment
+func (s *Service) GetChannelSentiment(ctx context.Context, req *MetricDurationRequest) (*GroupSentimentResponse, error) {
+	return getGroupSentiment(ctx, "sentiment_per_channel", req)
+}
+
+// GetTopicSentiment returns the sentiment per topic, without any per-user data.
+//
+// encore:api public path=/get-topic-sentiment
+func (s *Service) GetTopicSentiment(ctx context.Context, req *MetricDurationRequest) (*GroupSentimentResponse, error) {
+	return getGroupSentiment(ctx, "sentiment_per_topic", req)
+}
+
+func getGroupSentiment(ctx context.Context, insightType string, req *MetricDurationRequest) (*GroupSentimentResponse, error) {
+	r, err := resolveInsightRange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := loadInsightValues(ctx, insightType, r)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]*models.MessageSentimentStats)
+	timeSentiments := make([]TimeSentimentPerGroup, 0, len(r.buckets))
+	for _, bucket := range r.buckets {
+		groupsToSentimentStats := make(map[string]*models.MessageSentimentStats)
+		if value, ok := values[bucket.Unix()]; ok {
+			if err := json.Unmarshal([]byte(value), &groupsToSentimentStats); err != nil {
+				return nil, fmt.Errorf("unmarshal error: %v", err)
+			}
+		}
+
+		for group, stats := range groupsToSentimentStats {
+			if _, ok := totals[group]; !ok {
+				totals[group] = &models.MessageSentimentStats{}
+			}
+			addSentimentStats(totals[group], stats)
+		}
+
+		timeSentiments = append(timeSentiments, TimeSentimentPerGroup{
+			Timestamp:  bucket,
+			Sentiments: summarizeSentiments(groupsToSentimentStats),
+		})
+	}
+
+	return &GroupSentimentResponse{TimeSentiments: timeSentiments, Totals: summarizeSentiments(totals)}, nil
+}
+
+func summarizeSentiments(sentimentStats map[string]*models.MessageSentimentStats) map[string]*SentimentSummary {
+	summaries := make(map[string]*SentimentSummary, len(sentimentStats))
+	for group, stats := range sentimentStats {
+		summaries[group] = &SentimentSummary{MessageSentimentStats: stats, Score: sentimentScore(stats)}
+	}
+
+	return summaries
+}
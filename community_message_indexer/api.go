@@ -2,16 +2,22 @@ package communitymessageindexer
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"encore.app/models"
+	"github.com/samber/lo"
 )
 
 type SearchMessagesRequest struct {
 	Start      time.Time `query:"start"`
 	End        time.Time `query:"end"`
 	SearchTerm string    `query:"search_term"`
+	// ChannelIDs limits the search to the given channels, all channels are searched if empty
+	ChannelIDs []string `query:"channel_ids"`
 }
 
 type SearchMessagesResponse struct {
@@ -25,12 +31,13 @@ func SearchMessages(ctx context.Context, req *SearchMessagesRequest) (*SearchMes
 	rows, err := db.Query(ctx, `
 		SELECT 
 			dm.id, dm.interaction_type, dm.channel_id, dm.guild_id, 
-			dm.author_id, dm.content, dm.clean_content
+			dm.author_id, dm.content, dm.clean_content, dm.created_at
 		FROM discord_messages_search dms 
 		JOIN discord_messages dm ON dms.id = dm.id
 		WHERE dm.created_at BETWEEN $1 AND $2 
 		  AND $3 % ANY(STRING_TO_ARRAY(dms.content_normalized, ' '))
-	`, req.Start, req.End, req.SearchTerm)
+		  AND (CARDINALITY($4::TEXT[]) = 0 OR dm.channel_id = ANY($4))
+	`, req.Start, req.End, req.SearchTerm, req.ChannelIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -45,9 +52,12 @@ func SearchMessages(ctx context.Context, req *SearchMessagesRequest) (*SearchMes
 }
 
 type ListMessagesRequest struct {
+	// ChannelID limits the messages to the given channel, messages of all channels are listed if empty
 	ChannelID string    `query:"channel_id"`
 	Start     time.Time `query:"start"`
 	End       time.Time `query:"end"`
+	// Limit caps the number of messages, the oldest first, all messages of the range are listed if 0
+	Limit int `query:"limit"`
 }
 
 // ListMessages searches for messages in the specified time range.
@@ -59,10 +69,12 @@ func ListMessages(
 	rows, err := db.Query(ctx, `
 		SELECT 
 			id, interaction_type, channel_id, guild_id, 
-			author_id, content, clean_content
+			author_id, content, clean_content, created_at
 		FROM discord_messages
-		WHERE created_at BETWEEN $1 AND $2 AND channel_id = $3
-	`, request.Start, request.End, request.ChannelID)
+		WHERE created_at BETWEEN $1 AND $2 AND ($3 = '' OR channel_id = $3)
+		ORDER BY created_at
+		LIMIT NULLIF($4, 0)
+	`, request.Start, request.End, request.ChannelID, max(request.Limit, 0))
 	if err != nil {
 		return nil, err
 	}
@@ -75,3 +87,303 @@ func ListMessages(
 
 	return &SearchMessagesResponse{Messages: messages}, nil
 }
+
+const defaultFullTextSearchLimit = 20
+const maxFullTextSearchLimit = 100
+
+// fullTextSearchFilter is shared by the result & count queries of FullTextSearchMessages
+const fullTextSearchFilter = `
+	search_vector @@ to_tsquery('english', $1)
+	AND (CARDINALITY($2::TEXT[]) = 0 OR channel_id = ANY($2))
+	AND (CARDINALITY($3::TEXT[]) = 0 OR author_id = ANY($3))
+	AND created_at BETWEEN $4 AND $5`
+
+type FullTextSearchRequest struct {
+	// Query supports "quoted phrases", -excluded words, OR & prefix* matching, words are combined with AND
+	Query      string    `query:"q"`
+	ChannelIDs []string  `query:"channel_ids"`
+	AuthorIDs  []string  `query:"author_ids"`
+	Start      time.Time `query:"start"`
+	// End defaults to now
+	End time.Time `query:"end"`
+	// Limit defaults to 20 results per page, at most 100
+	Limit int `query:"limit"`
+	// Cursor is the NextCursor of the previous page
+	Cursor string `query:"cursor"`
+}
+
+type FullTextSearchResult struct {
+	Message *models.DiscordRawMessage `json:"message"`
+	Rank    float32                   `json:"rank"`
+	// Snippet is an excerpt of the message with the matching words in **bold**
+	Snippet string `json:"snippet"`
+}
+
+type FullTextSearchResponse struct {
+	Results    []*FullTextSearchResult `json:"results"`
+	TotalCount int                     `json:"totalCount"`
+	// NextCursor is empty on the last page
+	NextCursor string `json:"nextCursor"`
+}
+
+// searchCursor points after the last result of a page, results are ordered by rank & id
+type searchCursor struct {
+	Rank float32 `json:"rank"`
+	ID   string  `json:"id"`
+}
+
+// FullTextSearchMessages searches community messages by relevance.
+//
+//encore:api private method=GET path=/message-search
+func FullTextSearchMessages(ctx context.Context, req *FullTextSearchRequest) (*FullTextSearchResponse, error) {
+	tsQuery := parseSearchQuery(req.Query)
+	if tsQuery == "" {
+		return nil, errors.New("please provide at least one word to search for")
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultFullTextSearchLimit
+	} else if limit > maxFullTextSearchLimit {
+		limit = maxFullTextSearchLimit
+	}
+
+	end := req.End
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+
+	var cursor *searchCursor
+	if req.Cursor != "" {
+		var err error
+		if cursor, err = decodeSearchCursor(req.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	filterArgs := []any{tsQuery, req.ChannelIDs, req.AuthorIDs, req.Start, end}
+
+	var totalCount int
+	err := db.QueryRow(ctx, "SELECT COUNT(*) FROM discord_messages WHERE "+fullTextSearchFilter, filterArgs...).
+		Scan(&totalCount)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count search results: %w", err)
+	}
+
+	cursorRank, cursorID := float32(0), ""
+	if cursor != nil {
+		cursorRank, cursorID = cursor.Rank, cursor.ID
+	}
+
+	// fetch one result more than the limit to know if there's a next page
+	rows, err := db.Query(ctx, `
+		WITH matches AS (
+			SELECT
+				id, interaction_type, channel_id, guild_id, author_id, content, clean_content, created_at,
+				ts_rank_cd(search_vector, to_tsquery('english', $1)) AS rank
+			FROM discord_messages
+			WHERE `+fullTextSearchFilter+`
+		)
+		SELECT
+			id, interaction_type, channel_id, guild_id, author_id, content, clean_content, created_at, rank,
+			ts_headline('english', clean_content, to_tsquery('english', $1),
+				'StartSel=**, StopSel=**, MaxFragments=2, MinWords=10, MaxWords=30')
+		FROM matches
+		WHERE NOT $6 OR (rank, id) < ($7::REAL, $8)
+		ORDER BY rank DESC, id DESC
+		LIMIT $9
+	`, append(filterArgs, cursor != nil, cursorRank, cursorID, limit+1)...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't search messages: %w", err)
+	}
+	defer rows.Close()
+
+	resp := &FullTextSearchResponse{Results: []*FullTextSearchResult{}, TotalCount: totalCount}
+	for rows.Next() {
+		var message models.DiscordRawMessage
+		var createdAt time.Time
+		result := &FullTextSearchResult{Message: &message}
+		err := rows.Scan(&message.ID, &message.InteractionType, &message.ChannelID, &message.GuildID,
+			&message.AuthorID, &message.Content, &message.CleanContent, &createdAt, &result.Rank, &result.Snippet)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan search result: %w", err)
+		}
+
+		message.CreatedAt = createdAt.Format(time.RFC3339)
+		resp.Results = append(resp.Results, result)
+	}
+
+	if len(resp.Results) > limit {
+		resp.Results = resp.Results[:limit]
+		last := resp.Results[limit-1]
+		nextCursor, err := encodeSearchCursor(&searchCursor{Rank: last.Rank, ID: last.Message.ID})
+		if err != nil {
+			return nil, err
+		}
+
+		resp.NextCursor = nextCursor
+	}
+
+	return resp, nil
+}
+
+func encodeSearchCursor(cursor *searchCursor) (string, error) {
+	encoded, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode cursor: %w", err)
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeSearchCursor(cursor string) (*searchCursor, error) {
+	decoded, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var result searchCursor
+	if err := json.Unmarshal(decoded, &result); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	} else if result.ID == "" {
+		return nil, errors.New("invalid cursor: missing id")
+	}
+
+	return &result, nil
+}
+
+type ListMessageRepliesRequest struct {
+	// ChannelID limits the replies to the channel & its threads, replies in all channels are listed if empty
+	ChannelID string    `query:"channel_id"`
+	Start     time.Time `query:"start"`
+	End       time.Time `query:"end"`
+}
+
+type ListMessageRepliesResponse struct {
+	Replies []*models.MessageReply `json:"replies"`
+}
+
+// ListMessageReplies lists the messages posted in the time range which reply to another author,
+// either through a reply reference or by posting in a thread started on the other author's message.
+//
+//encore:api private method=GET path=/message-replies
+func ListMessageReplies(ctx context.Context, req *ListMessageRepliesRequest) (*ListMessageRepliesResponse, error) {
+	// threads started on a message share its ID
+	rows, err := db.Query(ctx, `
+		SELECT r.id, r.author_id, r.channel_id, r.created_at, o.id, o.author_id
+		FROM discord_messages r
+		JOIN discord_messages o ON o.id = COALESCE(r.referenced_message_id, r.thread_id)
+		WHERE r.created_at BETWEEN $1 AND $2 AND r.author_id <> o.author_id
+		  AND ($3 = '' OR $3 IN (r.channel_id, r.parent_channel_id))
+		ORDER BY r.created_at
+	`, req.Start, req.End, req.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get message replies: %w", err)
+	}
+	defer rows.Close()
+
+	replies, err := models.MapMessageRepliesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map message replies: %w", err)
+	}
+
+	return &ListMessageRepliesResponse{Replies: replies}, nil
+}
+
+// maxReplyChainLength bounds how far up a reply chain is followed
+const maxReplyChainLength = 20
+
+type MessageConversationResponse struct {
+	Message   *models.DiscordRawMessage       `json:"message"`
+	Structure *models.DiscordMessageStructure `json:"structure"`
+	// ReplyChain are the messages the message replies to, directly or indirectly, oldest first
+	ReplyChain []*models.DiscordRawMessage `json:"replyChain"`
+	// Replies are the messages directly replying to the message, oldest first
+	Replies []*models.DiscordRawMessage `json:"replies"`
+}
+
+// GetMessageConversation returns a message together with its structure, the reply chain it's part of
+// & its replies, to reconstruct who replied to whom.
+//
+//encore:api private method=GET path=/messages/:id/conversation
+func GetMessageConversation(ctx context.Context, id string) (*MessageConversationResponse, error) {
+	var message models.DiscordRawMessage
+	var structure models.DiscordMessageStructure
+	var createdAt time.Time
+	var referencedMessageID, threadID, parentChannelID *string
+	err := db.QueryRow(ctx, `
+		SELECT
+			id, interaction_type, channel_id, guild_id, author_id, content, clean_content, created_at,
+			referenced_message_id, thread_id, parent_channel_id, attachments, embeds,
+			mentioned_user_ids, mentioned_role_ids, mentions_everyone, edited_at
+		FROM discord_messages
+		WHERE id = $1
+	`, id).Scan(
+		&message.ID, &message.InteractionType, &message.ChannelID, &message.GuildID, &message.AuthorID,
+		&message.Content, &message.CleanContent, &createdAt,
+		&referencedMessageID, &threadID, &parentChannelID, &structure.Attachments, &structure.Embeds,
+		&structure.MentionedUserIDs, &structure.MentionedRoleIDs, &structure.MentionsEveryone,
+		&structure.EditedTimestamp)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get message: %w", err)
+	}
+
+	message.CreatedAt = createdAt.Format(time.RFC3339)
+	structure.Timestamp = createdAt
+	structure.ReferencedMessageID = lo.FromPtr(referencedMessageID)
+	structure.ThreadID = lo.FromPtr(threadID)
+	structure.ParentChannelID = lo.FromPtr(parentChannelID)
+
+	rows, err := db.Query(ctx, `
+		WITH RECURSIVE chain AS (
+			SELECT referenced_message_id AS id, 1 AS depth
+			FROM discord_messages
+			WHERE id = $1 AND referenced_message_id IS NOT NULL
+			UNION ALL
+			SELECT dm.referenced_message_id, chain.depth + 1
+			FROM chain
+			JOIN discord_messages dm ON dm.id = chain.id
+			WHERE dm.referenced_message_id IS NOT NULL AND chain.depth < $2
+		)
+		SELECT
+			dm.id, dm.interaction_type, dm.channel_id, dm.guild_id,
+			dm.author_id, dm.content, dm.clean_content, dm.created_at
+		FROM chain
+		JOIN discord_messages dm ON dm.id = chain.id
+		ORDER BY dm.created_at
+	`, id, maxReplyChainLength)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get reply chain: %w", err)
+	}
+
+	replyChain, err := models.MapDiscordRawMessagesFromSQLRows(rows)
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map reply chain: %w", err)
+	}
+
+	rows, err = db.Query(ctx, `
+		SELECT
+			id, interaction_type, channel_id, guild_id,
+			author_id, content, clean_content, created_at
+		FROM discord_messages
+		WHERE referenced_message_id = $1
+		ORDER BY created_at
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get replies: %w", err)
+	}
+	defer rows.Close()
+
+	replies, err := models.MapDiscordRawMessagesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map replies: %w", err)
+	}
+
+	return &MessageConversationResponse{
+		Message:    &message,
+		Structure:  &structure,
+		ReplyChain: lo.Ternary(replyChain == nil, []*models.DiscordRawMessage{}, replyChain),
+		Replies:    lo.Ternary(replies == nil, []*models.DiscordRawMessage{}, replies),
+	}, nil
+}
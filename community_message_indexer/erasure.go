@@ -0,0 +1,348 @@
+package communitymessageindexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"encore.app/models"
+	"encore.dev/rlog"
+	"github.com/samber/lo"
+)
+
+const userErasureRequestColumns = `
+	id, user_id, requested_by, reason, status, erased_messages, erased_vectors,
+	rewritten_archives, insights_erased_at, confirmed_services, created_at, completed_at`
+
+// Services storing data derived from the messages of users, each erases its data when notified
+// through UserDataErasureTopic & confirms it with ConfirmUserErasure.
+const (
+	ErasureServiceCommunityInsights   = "community-insights"
+	ErasureServiceConversationAlerter = "conversation-alerter"
+	ErasureServiceForumPostUpserter   = "forum-post-upserter"
+)
+
+// erasureServices all have to confirm an erasure request before it's completed
+var erasureServices = []string{
+	ErasureServiceCommunityInsights,
+	ErasureServiceConversationAlerter,
+	ErasureServiceForumPostUpserter,
+}
+
+type EraseUserDataRequest struct {
+	UserID      string `json:"user_id"`
+	RequestedBy string `json:"requested_by"`
+	Reason      string `json:"reason"`
+}
+
+// EraseUserData removes every message of a user from the index, the semantic index & the archives,
+// then notifies the other services to erase their derived data. The request is completed once all of
+// them confirmed, see ConfirmUserErasure. Each request is kept as an audit log entry.
+//
+//encore:api private method=POST path=/user-erasures
+func EraseUserData(ctx context.Context, req *EraseUserDataRequest) (*models.UserErasureRequest, error) {
+	if req.UserID == "" {
+		return nil, errors.New("please provide the user whose data should be erased")
+	} else if req.RequestedBy == "" {
+		return nil, errors.New("please provide who requested the erasure")
+	}
+
+	var requestID int64
+	err := db.QueryRow(ctx, `
+		INSERT INTO user_erasure_requests (user_id, requested_by, reason)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, req.UserID, req.RequestedBy, req.Reason).Scan(&requestID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't insert user erasure request: %w", err)
+	}
+
+	erasedMessages, erasedVectors, err := eraseUserMessages(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrittenArchives, err := eraseUserFromArchives(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE user_erasure_requests
+		SET status = $2, erased_messages = $3, erased_vectors = $4, rewritten_archives = $5
+		WHERE id = $1
+	`, requestID, models.UserErasureStatusMessagesErased, erasedMessages, erasedVectors, rewrittenArchives)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update user erasure request: %w", err)
+	}
+
+	_, err = UserDataErasureTopic.Publish(ctx, &models.UserDataErasureEvent{
+		RequestID: requestID,
+		UserID:    req.UserID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't publish user data erasure: %w", err)
+	}
+
+	rlog.Info("Erased user messages",
+		"requestId", requestID, "messages", erasedMessages, "vectors", erasedVectors, "archives", rewrittenArchives)
+	return getUserErasureRequest(ctx, requestID)
+}
+
+// eraseUserMessages deletes the indexed messages of a user in batches, returning the number of messages & vectors deleted
+func eraseUserMessages(ctx context.Context, userID string) (int, int, error) {
+	var erasedMessages, erasedVectors int
+	for {
+		messages, vectors, err := eraseUserMessagesBatch(ctx, userID)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		erasedMessages += messages
+		erasedVectors += vectors
+		if messages < archiveBatchSize {
+			return erasedMessages, erasedVectors, nil
+		}
+	}
+}
+
+func eraseUserMessagesBatch(ctx context.Context, userID string) (int, int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, embedded_at IS NOT NULL
+		FROM discord_messages
+		WHERE author_id = $1
+		LIMIT $2
+		FOR UPDATE
+	`, userID, archiveBatchSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("couldn't get user messages: %w", err)
+	}
+
+	var ids, embeddedIDs []string
+	for rows.Next() {
+		var id string
+		var embedded bool
+		if err := rows.Scan(&id, &embedded); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("couldn't scan user message: %w", err)
+		}
+
+		ids = append(ids, id)
+		if embedded {
+			embeddedIDs = append(embeddedIDs, id)
+		}
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := deleteMessageVectors(ctx, embeddedIDs); err != nil {
+		return 0, 0, err
+	}
+
+	if err := deleteMessages(ctx, tx, ids); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return len(ids), len(embeddedIDs), nil
+}
+
+// eraseUserFromArchives rewrites every archive containing messages of a user without them,
+// archives left empty are deleted
+func eraseUserFromArchives(ctx context.Context, userID string) (int, error) {
+	rows, err := db.Query(ctx, "SELECT id FROM message_archives WHERE author_ids @> ARRAY[$1]", userID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get user archives: %w", err)
+	}
+
+	var archiveIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("couldn't scan archive id: %w", err)
+		}
+		archiveIDs = append(archiveIDs, id)
+	}
+	rows.Close()
+
+	for _, archiveID := range archiveIDs {
+		if err := eraseUserFromArchive(ctx, archiveID, userID); err != nil {
+			return 0, fmt.Errorf("couldn't erase user from archive %d: %w", archiveID, err)
+		}
+	}
+
+	return len(archiveIDs), nil
+}
+
+func eraseUserFromArchive(ctx context.Context, archiveID int64, userID string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow(ctx, "SELECT data FROM message_archives WHERE id = $1 FOR UPDATE", archiveID).Scan(&data)
+	if err != nil {
+		return fmt.Errorf("couldn't get archive: %w", err)
+	}
+
+	lines, err := decompressArchive(data)
+	if err != nil {
+		return err
+	}
+
+	var kept [][]byte
+	for _, line := range lines {
+		var message struct {
+			AuthorID string `json:"author_id"`
+		}
+		if err := json.Unmarshal(line, &message); err != nil {
+			return fmt.Errorf("couldn't parse archived message: %w", err)
+		}
+
+		if message.AuthorID != userID {
+			kept = append(kept, line)
+		}
+	}
+
+	if len(kept) == 0 {
+		if _, err := tx.Exec(ctx, "DELETE FROM message_archives WHERE id = $1", archiveID); err != nil {
+			return fmt.Errorf("couldn't delete archive: %w", err)
+		}
+	} else {
+		data, err := compressArchive(kept)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE message_archives
+			SET data = $2, message_count = $3, author_ids = array_remove(author_ids, $4), updated_at = now()
+			WHERE id = $1
+		`, archiveID, data, len(kept), userID)
+		if err != nil {
+			return fmt.Errorf("couldn't update archive: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+type ConfirmUserErasureRequest struct {
+	// Service is the service which erased its data of the user, one of the ErasureService constants
+	Service string `json:"service"`
+}
+
+// ConfirmUserErasure records that a service erased its data of the user,
+// the request is completed once every service storing user data confirmed.
+//
+//encore:api private method=POST path=/user-erasures/:id/confirmations
+func ConfirmUserErasure(ctx context.Context, id int64, req *ConfirmUserErasureRequest) error {
+	if !lo.Contains(erasureServices, req.Service) {
+		return fmt.Errorf("unknown erasure service %q", req.Service)
+	}
+
+	// the row lock serializes concurrent confirmations, so each one sees the services confirmed before it
+	result, err := db.Exec(ctx, `
+		UPDATE user_erasure_requests
+		SET confirmed_services = CASE
+				WHEN $2 = ANY(confirmed_services) THEN confirmed_services
+				ELSE array_append(confirmed_services, $2)
+			END,
+			insights_erased_at = CASE WHEN $2 = $3::TEXT THEN COALESCE(insights_erased_at, now()) ELSE insights_erased_at END
+		WHERE id = $1
+	`, id, req.Service, ErasureServiceCommunityInsights)
+	if err != nil {
+		return fmt.Errorf("couldn't confirm user erasure request: %w", err)
+	} else if result.RowsAffected() == 0 {
+		return fmt.Errorf("user erasure request %d not found", id)
+	}
+
+	result, err = db.Exec(ctx, `
+		UPDATE user_erasure_requests
+		SET status = $2, completed_at = now()
+		WHERE id = $1 AND status <> $2 AND confirmed_services @> $3
+	`, id, models.UserErasureStatusCompleted, erasureServices)
+	if err != nil {
+		return fmt.Errorf("couldn't complete user erasure request: %w", err)
+	}
+
+	if result.RowsAffected() > 0 {
+		rlog.Info("Completed user erasure request", "requestId", id)
+	}
+
+	return nil
+}
+
+type ListUserErasureRequestsRequest struct {
+	UserID string `query:"user_id"`
+}
+
+type ListUserErasureRequestsResponse struct {
+	Requests []*models.UserErasureRequest `json:"requests"`
+}
+
+// ListUserErasureRequests returns the audit log of erasure requests, optionally for a single user.
+//
+//encore:api private method=GET path=/user-erasures
+func ListUserErasureRequests(
+	ctx context.Context, req *ListUserErasureRequestsRequest,
+) (*ListUserErasureRequestsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+userErasureRequestColumns+`
+		FROM user_erasure_requests
+		WHERE $1 = '' OR user_id = $1
+		ORDER BY id DESC
+	`, req.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get user erasure requests: %w", err)
+	}
+	defer rows.Close()
+
+	requests, err := models.MapUserErasureRequestsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map user erasure requests: %w", err)
+	}
+
+	return &ListUserErasureRequestsResponse{Requests: requests}, nil
+}
+
+func getUserErasureRequest(ctx context.Context, id int64) (*models.UserErasureRequest, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+userErasureRequestColumns+`
+		FROM user_erasure_requests
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get user erasure request: %w", err)
+	}
+	defer rows.Close()
+
+	requests, err := models.MapUserErasureRequestsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map user erasure request: %w", err)
+	} else if len(requests) == 0 {
+		return nil, fmt.Errorf("user erasure request %d not found", id)
+	}
+
+	return requests[0], nil
+}
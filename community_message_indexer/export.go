@@ -0,0 +1,302 @@
+package communitymessageindexer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"encore.dev/rlog"
+	"github.com/bwmarrin/discordgo"
+)
+
+// exports are flushed to the client every exportFlushInterval rows, so memory use doesn't grow with the export
+const exportFlushInterval = 500
+
+const (
+	exportFormatJSONL = "jsonl"
+	exportFormatCSV   = "csv"
+)
+
+var exportCSVHeader = []string{
+	"id", "guild_id", "channel_id", "parent_channel_id", "thread_id", "author_id", "author_username",
+	"content", "referenced_message_id", "created_at", "edited_at",
+}
+
+type exportRequest struct {
+	Format           string
+	GuildID          string
+	ChannelIDs       []string
+	AuthorIDs        []string
+	Start            time.Time
+	End              time.Time
+	ResolveUsernames bool
+}
+
+type exportedMessage struct {
+	ID                  string     `json:"id"`
+	GuildID             string     `json:"guild_id"`
+	ChannelID           string     `json:"channel_id"`
+	ParentChannelID     string     `json:"parent_channel_id,omitempty"`
+	ThreadID            string     `json:"thread_id,omitempty"`
+	AuthorID            string     `json:"author_id"`
+	AuthorUsername      string     `json:"author_username,omitempty"`
+	Content             string     `json:"content"`
+	ReferencedMessageID string     `json:"referenced_message_id,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	EditedAt            *time.Time `json:"edited_at,omitempty"`
+}
+
+func (m *exportedMessage) csvRecord() []string {
+	editedAt := ""
+	if m.EditedAt != nil {
+		editedAt = m.EditedAt.UTC().Format(time.RFC3339)
+	}
+
+	return []string{
+		m.ID, m.GuildID, m.ChannelID, m.ParentChannelID, m.ThreadID, m.AuthorID, m.AuthorUsername,
+		m.Content, m.ReferencedMessageID, m.CreatedAt.UTC().Format(time.RFC3339), editedAt,
+	}
+}
+
+// ExportMessages streams the messages of a guild as JSON lines or CSV, oldest first.
+// Query parameters:
+//   - guild_id (required)
+//   - format: jsonl (default) or csv
+//   - channel_ids, author_ids: comma separated, channels include their threads
+//   - start, end: RFC 3339 timestamps, end defaults to now
+//   - resolve_usernames: true to add the Discord username of each author
+//
+//encore:api private raw method=GET path=/message-exports
+func ExportMessages(w http.ResponseWriter, req *http.Request) {
+	exportReq, err := parseExportRequest(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(req.Context(), `
+		SELECT
+			id, guild_id, channel_id, COALESCE(parent_channel_id, ''), COALESCE(thread_id, ''), author_id,
+			clean_content, COALESCE(referenced_message_id, ''), created_at, edited_at
+		FROM discord_messages
+		WHERE guild_id = $1
+		  AND (CARDINALITY($2::TEXT[]) = 0 OR channel_id = ANY($2) OR parent_channel_id = ANY($2))
+		  AND (CARDINALITY($3::TEXT[]) = 0 OR author_id = ANY($3))
+		  AND created_at BETWEEN $4 AND $5
+		ORDER BY created_at, id
+	`, exportReq.GuildID, exportReq.ChannelIDs, exportReq.AuthorIDs, exportReq.Start, exportReq.End)
+	if err != nil {
+		rlog.Error("Couldn't get messages to export", "error", err)
+		http.Error(w, "Error exporting messages", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var usernames *usernameResolver
+	if exportReq.ResolveUsernames {
+		usernames, err = newUsernameResolver()
+		if err != nil {
+			rlog.Error("Couldn't create username resolver", "error", err)
+			http.Error(w, "Error exporting messages", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("messages-%s.%s", exportReq.GuildID, exportReq.Format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writer := newExportWriter(w, exportReq.Format)
+
+	count := 0
+	for rows.Next() {
+		var message exportedMessage
+		err := rows.Scan(
+			&message.ID, &message.GuildID, &message.ChannelID, &message.ParentChannelID, &message.ThreadID,
+			&message.AuthorID, &message.Content, &message.ReferencedMessageID, &message.CreatedAt, &message.EditedAt)
+		if err != nil {
+			// headers are already sent, the truncated export is all we can do
+			rlog.Error("Couldn't scan exported message", "error", err, "exported", count)
+			return
+		}
+
+		if usernames != nil {
+			message.AuthorUsername = usernames.resolve(message.AuthorID)
+		}
+
+		if err := writer.write(&message); err != nil {
+			rlog.Warn("Couldn't write exported message, client probably disconnected", "error", err, "exported", count)
+			return
+		}
+
+		count++
+		if count%exportFlushInterval == 0 {
+			if err := writer.flush(); err != nil {
+				rlog.Warn("Couldn't flush export", "error", err, "exported", count)
+				return
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		rlog.Error("Couldn't read messages to export", "error", err, "exported", count)
+		return
+	}
+
+	if err := writer.flush(); err != nil {
+		rlog.Warn("Couldn't flush export", "error", err, "exported", count)
+		return
+	}
+
+	rlog.Info("Exported messages", "guildId", exportReq.GuildID, "format", exportReq.Format, "count", count)
+}
+
+func parseExportRequest(query url.Values) (*exportRequest, error) {
+	req := &exportRequest{
+		Format:           strings.ToLower(query.Get("format")),
+		GuildID:          query.Get("guild_id"),
+		ChannelIDs:       splitQueryList(query.Get("channel_ids")),
+		AuthorIDs:        splitQueryList(query.Get("author_ids")),
+		End:              time.Now(),
+		ResolveUsernames: query.Get("resolve_usernames") == "true",
+	}
+
+	if req.GuildID == "" {
+		return nil, errors.New("please provide a guild_id")
+	}
+
+	if req.Format == "" {
+		req.Format = exportFormatJSONL
+	} else if req.Format != exportFormatJSONL && req.Format != exportFormatCSV {
+		return nil, fmt.Errorf("unsupported format %q, use jsonl or csv", req.Format)
+	}
+
+	if start := query.Get("start"); start != "" {
+		parsed, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start: %w", err)
+		}
+		req.Start = parsed
+	}
+
+	if end := query.Get("end"); end != "" {
+		parsed, err := time.Parse(time.RFC3339, end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end: %w", err)
+		}
+		req.End = parsed
+	}
+
+	if req.End.Before(req.Start) {
+		return nil, errors.New("end must be after start")
+	}
+
+	return req, nil
+}
+
+func splitQueryList(value string) []string {
+	ids := []string{}
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// exportWriter writes exported messages in the requested format
+type exportWriter struct {
+	w       http.ResponseWriter
+	format  string
+	json    *json.Encoder
+	csv     *csv.Writer
+	started bool
+}
+
+func newExportWriter(w http.ResponseWriter, format string) *exportWriter {
+	writer := &exportWriter{w: w, format: format}
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer.csv = csv.NewWriter(w)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		writer.json = json.NewEncoder(w)
+	}
+
+	return writer
+}
+
+func (e *exportWriter) write(message *exportedMessage) error {
+	if e.format == exportFormatJSONL {
+		return e.json.Encode(message)
+	}
+
+	if !e.started {
+		e.started = true
+		if err := e.csv.Write(exportCSVHeader); err != nil {
+			return err
+		}
+	}
+
+	return e.csv.Write(message.csvRecord())
+}
+
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		// an empty export still gets its header
+		if !e.started {
+			e.started = true
+			if err := e.csv.Write(exportCSVHeader); err != nil {
+				return err
+			}
+		}
+
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := e.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// usernameResolver looks up Discord usernames, each author is only fetched once per export
+type usernameResolver struct {
+	discordClient *discordgo.Session
+	usernames     map[string]string
+}
+
+func newUsernameResolver() (*usernameResolver, error) {
+	discordClient, err := discordgo.New("Bot " + secrets.DiscordToken)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create discord client: %w", err)
+	}
+
+	return &usernameResolver{discordClient: discordClient, usernames: make(map[string]string)}, nil
+}
+
+func (r *usernameResolver) resolve(userID string) string {
+	if username, ok := r.usernames[userID]; ok {
+		return username
+	}
+
+	// users who left Discord can't be resolved, export them without a username rather than failing
+	username := ""
+	user, err := r.discordClient.User(userID)
+	if err != nil {
+		rlog.Warn("Couldn't resolve username", "userId", userID, "error", err)
+	} else {
+		username = user.Username
+	}
+
+	r.usernames[userID] = username
+	return username
+}
@@ -0,0 +1,77 @@
+package communitymessageindexer
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseExportRequest(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 5, 8, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		want    *exportRequest
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: "guild_id=1",
+			want:  &exportRequest{Format: exportFormatJSONL, GuildID: "1", ChannelIDs: []string{}, AuthorIDs: []string{}},
+		},
+		{
+			name: "every parameter",
+			query: "guild_id=1&format=CSV&channel_ids=2,%203,,&author_ids=4&resolve_usernames=true" +
+				"&start=2024-05-01T00:00:00Z&end=2024-05-08T00:00:00Z",
+			want: &exportRequest{
+				Format:           exportFormatCSV,
+				GuildID:          "1",
+				ChannelIDs:       []string{"2", "3"},
+				AuthorIDs:        []string{"4"},
+				Start:            start,
+				End:              end,
+				ResolveUsernames: true,
+			},
+		},
+		{name: "missing guild", query: "format=csv", wantErr: true},
+		{name: "unsupported format", query: "guild_id=1&format=xml", wantErr: true},
+		{name: "invalid start", query: "guild_id=1&start=2024-05-01", wantErr: true},
+		{name: "invalid end", query: "guild_id=1&end=yesterday", wantErr: true},
+		{
+			name:    "end before start",
+			query:   "guild_id=1&start=2024-05-08T00:00:00Z&end=2024-05-01T00:00:00Z",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseExportRequest(query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExportRequest() error = %v, wantErr %v", err, tt.wantErr)
+			} else if tt.wantErr {
+				return
+			}
+
+			// end defaults to now
+			if tt.want.End.IsZero() {
+				if time.Since(got.End) > time.Minute {
+					t.Errorf("parseExportRequest() end = %v, want now", got.End)
+				}
+				got.End = time.Time{}
+			}
+
+			if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", tt.want) {
+				t.Errorf("parseExportRequest() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
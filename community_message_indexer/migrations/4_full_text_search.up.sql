@@ -0,0 +1,7 @@
+ALTER TABLE discord_messages
+ADD COLUMN search_vector TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('english', COALESCE(clean_content, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_gin_search_vector ON discord_messages USING gin (search_vector);
+CREATE INDEX IF NOT EXISTS idx_discord_messages_channel_created_at ON discord_messages (channel_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_discord_messages_author_created_at ON discord_messages (author_id, created_at);
@@ -0,0 +1,20 @@
+ALTER TABLE discord_messages ADD COLUMN embedded_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_discord_messages_pending_embedding
+ON discord_messages (created_at) WHERE embedded_at IS NULL;
+
+-- single row holding the semantic index settings, embedding community messages is disabled by default
+CREATE TABLE semantic_index_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    daily_token_budget INT NOT NULL DEFAULT 200000,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+INSERT INTO semantic_index_settings DEFAULT VALUES;
+
+-- estimated embedding tokens spent per day, to cap the cost of the semantic index
+CREATE TABLE semantic_index_usage (
+    day DATE PRIMARY KEY,
+    tokens INT NOT NULL DEFAULT 0
+);
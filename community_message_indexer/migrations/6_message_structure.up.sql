@@ -0,0 +1,18 @@
+ALTER TABLE discord_messages
+    ADD COLUMN referenced_message_id VARCHAR(255),
+    ADD COLUMN thread_id VARCHAR(255),
+    ADD COLUMN parent_channel_id VARCHAR(255),
+    ADD COLUMN attachments JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN embeds JSONB NOT NULL DEFAULT '[]',
+    ADD COLUMN mentioned_user_ids TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN mentioned_role_ids TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN mentions_everyone BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN edited_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_discord_messages_referenced_message_id ON discord_messages (referenced_message_id);
+CREATE INDEX IF NOT EXISTS idx_discord_messages_thread_id ON discord_messages (thread_id);
+
+-- created_at used to be the insert time, recover the time the message was posted from its snowflake id
+UPDATE discord_messages
+SET created_at = to_timestamp(((id::BIGINT >> 22) + 1420070400000) / 1000.0) AT TIME ZONE 'UTC'
+WHERE id ~ '^[0-9]+$';
@@ -0,0 +1,39 @@
+-- how many days messages are kept, an empty channel id sets the default of the whole guild
+CREATE TABLE retention_policies (
+    guild_id VARCHAR(255) NOT NULL,
+    channel_id VARCHAR(255) NOT NULL DEFAULT '',
+    retention_days INT NOT NULL CHECK (retention_days > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (guild_id, channel_id)
+);
+
+-- gzip compressed JSON lines of the messages removed by a retention policy
+CREATE TABLE message_archives (
+    id BIGSERIAL PRIMARY KEY,
+    guild_id VARCHAR(255) NOT NULL,
+    channel_id VARCHAR(255) NOT NULL,
+    message_count INT NOT NULL,
+    author_ids TEXT[] NOT NULL,
+    oldest_message_at TIMESTAMP NOT NULL,
+    newest_message_at TIMESTAMP NOT NULL,
+    data BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_archives_author_ids_idx ON message_archives USING gin (author_ids);
+
+-- audit log of requests to erase all data of a user
+CREATE TABLE user_erasure_requests (
+    id BIGSERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    requested_by VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    status VARCHAR(255) NOT NULL DEFAULT 'PENDING',
+    erased_messages INT NOT NULL DEFAULT 0,
+    erased_vectors INT NOT NULL DEFAULT 0,
+    rewritten_archives INT NOT NULL DEFAULT 0,
+    insights_erased_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    completed_at TIMESTAMP
+);
@@ -0,0 +1,6 @@
+-- the services which confirmed erasing their data of the user, the request completes once all of them did
+ALTER TABLE user_erasure_requests ADD COLUMN confirmed_services TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE user_erasure_requests
+SET confirmed_services = ARRAY['community-insights']
+WHERE insights_erased_at IS NOT NULL;
@@ -0,0 +1,366 @@
+package communitymessageindexer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encore.app/models"
+	"encore.dev"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
+)
+
+// archiveBatchSize is the max amount of messages per archive.
+// Archives are kept in the database instead of object storage: the encore.dev version the app runs on has
+// no object storage, an archive of at most archiveBatchSize gzipped messages stays well within what Postgres
+// stores out of line, and erasing a user rewrites an archive together with its author ids in one transaction.
+const archiveBatchSize = 1000
+
+// maxArchivesPerPolicyRun bounds the work of a single retention run, the rest is archived the next day
+const maxArchivesPerPolicyRun = 20
+
+// pinecone deletes at most 1000 vectors per request
+const vectorDeleteBatchSize = 1000
+
+// Archive & delete messages older than their retention policy.
+var _ = cron.NewJob("archive-expired-messages", cron.JobConfig{
+	Title:    "Archive messages past their retention",
+	Endpoint: ArchiveExpiredMessages,
+	Every:    24 * cron.Hour,
+})
+
+// ArchiveExpiredMessages moves the messages past their retention policy into compressed archives.
+// Channel policies take precedence over the default policy of their guild & also cover the channel's threads.
+//
+//encore:api private method=POST path=/retention/archive-expired-messages
+func ArchiveExpiredMessages(ctx context.Context) error {
+	policies, err := ListRetentionPolicies(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies.Policies {
+		for i := 0; i < maxArchivesPerPolicyRun; i++ {
+			archived, err := archiveExpiredMessages(ctx, policy)
+			if err != nil {
+				return fmt.Errorf("couldn't archive messages of guild %s channel %q: %w",
+					policy.GuildID, policy.ChannelID, err)
+			}
+
+			if archived < archiveBatchSize {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func archiveExpiredMessages(ctx context.Context, policy *models.RetentionPolicy) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, author_id, created_at, embedded_at IS NOT NULL, (to_jsonb(dm) - 'search_vector')::TEXT
+		FROM discord_messages dm
+		WHERE guild_id = $1 AND created_at < now() - $2 * INTERVAL '1 day'
+		  AND (
+			($3 <> '' AND $3 IN (channel_id, parent_channel_id))
+			OR ($3 = '' AND NOT EXISTS (
+				SELECT 1 FROM retention_policies rp
+				WHERE rp.guild_id = dm.guild_id AND rp.channel_id IN (dm.channel_id, dm.parent_channel_id)))
+		  )
+		ORDER BY created_at
+		LIMIT $4
+		FOR UPDATE SKIP LOCKED
+	`, policy.GuildID, policy.RetentionDays, policy.ChannelID, archiveBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get expired messages: %w", err)
+	}
+
+	var ids, authorIDs, embeddedIDs []string
+	var lines [][]byte
+	var oldest, newest time.Time
+	for rows.Next() {
+		var id, authorID, line string
+		var createdAt time.Time
+		var embedded bool
+		if err := rows.Scan(&id, &authorID, &createdAt, &embedded, &line); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("couldn't scan expired message: %w", err)
+		}
+
+		if len(ids) == 0 {
+			oldest = createdAt
+		}
+		newest = createdAt
+
+		ids = append(ids, id)
+		authorIDs = append(authorIDs, authorID)
+		lines = append(lines, []byte(line))
+		if embedded {
+			embeddedIDs = append(embeddedIDs, id)
+		}
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	data, err := compressArchive(lines)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO message_archives (
+			guild_id, channel_id, message_count, author_ids, oldest_message_at, newest_message_at, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, policy.GuildID, policy.ChannelID, len(ids), lo.Uniq(authorIDs), oldest, newest, data)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't insert message archive: %w", err)
+	}
+
+	// vectors are deleted first, if that fails the messages are kept & the next run retries
+	if err := deleteMessageVectors(ctx, embeddedIDs); err != nil {
+		return 0, err
+	}
+
+	if err := deleteMessages(ctx, tx, ids); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	rlog.Info("Archived expired messages", "guildId", policy.GuildID, "channelId", policy.ChannelID, "count", len(ids))
+	return len(ids), nil
+}
+
+func deleteMessages(ctx context.Context, tx *sqldb.Tx, ids []string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM discord_messages_search WHERE id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("couldn't delete message search entries: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM discord_messages WHERE id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("couldn't delete messages: %w", err)
+	}
+
+	return nil
+}
+
+// deleteMessageVectors removes embedded messages from the semantic index
+func deleteMessageVectors(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	index, err := initSemanticIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range lo.Chunk(ids, vectorDeleteBatchSize) {
+		if err := index.indexConn.DeleteVectorsById(&ctx, batch); err != nil {
+			return fmt.Errorf("couldn't delete vectors: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// compressArchive gzips messages as JSON lines
+func compressArchive(lines [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		if _, err := writer.Write(append(line, '\n')); err != nil {
+			return nil, fmt.Errorf("couldn't compress archive: %w", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("couldn't compress archive: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompressArchive(data []byte) ([][]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress archive: %w", err)
+	}
+	defer reader.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(reader)
+	// messages can be up to a few KB of JSON, leave plenty of headroom
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read archive: %w", err)
+	}
+
+	return lines, nil
+}
+
+type SetRetentionPolicyRequest struct {
+	GuildID string `json:"guild_id"`
+	// ChannelID can be left empty to set the default policy of the guild
+	ChannelID     string `json:"channel_id"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// SetRetentionPolicy creates or updates the retention policy of a guild or channel.
+//
+//encore:api private method=PUT path=/retention-policies
+func SetRetentionPolicy(ctx context.Context, req *SetRetentionPolicyRequest) (*models.RetentionPolicy, error) {
+	if req.GuildID == "" {
+		return nil, errors.New("please provide a guild")
+	} else if req.RetentionDays <= 0 {
+		return nil, errors.New("messages have to be retained for at least one day")
+	}
+
+	rows, err := db.Query(ctx, `
+		INSERT INTO retention_policies (guild_id, channel_id, retention_days)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (guild_id, channel_id) DO UPDATE SET
+			retention_days = EXCLUDED.retention_days,
+			updated_at = now()
+		RETURNING guild_id, channel_id, retention_days, updated_at
+	`, req.GuildID, req.ChannelID, req.RetentionDays)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set retention policy: %w", err)
+	}
+	defer rows.Close()
+
+	policies, err := models.MapRetentionPoliciesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map retention policy: %w", err)
+	} else if len(policies) == 0 {
+		return nil, errors.New("retention policy not found")
+	}
+
+	return policies[0], nil
+}
+
+type ListRetentionPoliciesResponse struct {
+	Policies []*models.RetentionPolicy `json:"policies"`
+}
+
+// ListRetentionPolicies lists the retention policies of all guilds & channels.
+//
+//encore:api private method=GET path=/retention-policies
+func ListRetentionPolicies(ctx context.Context) (*ListRetentionPoliciesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT guild_id, channel_id, retention_days, updated_at
+		FROM retention_policies
+		ORDER BY guild_id, channel_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get retention policies: %w", err)
+	}
+	defer rows.Close()
+
+	policies, err := models.MapRetentionPoliciesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map retention policies: %w", err)
+	}
+
+	return &ListRetentionPoliciesResponse{Policies: policies}, nil
+}
+
+type DeleteRetentionPolicyRequest struct {
+	GuildID   string `query:"guild_id"`
+	ChannelID string `query:"channel_id"`
+}
+
+// DeleteRetentionPolicy removes a retention policy, so the messages it covered are kept indefinitely
+// or fall back to the default policy of their guild.
+//
+//encore:api private method=DELETE path=/retention-policies
+func DeleteRetentionPolicy(ctx context.Context, req *DeleteRetentionPolicyRequest) error {
+	result, err := db.Exec(ctx, `
+		DELETE FROM retention_policies WHERE guild_id = $1 AND channel_id = $2
+	`, req.GuildID, req.ChannelID)
+	if err != nil {
+		return fmt.Errorf("couldn't delete retention policy: %w", err)
+	} else if result.RowsAffected() == 0 {
+		return errors.New("retention policy not found")
+	}
+
+	return nil
+}
+
+type ListMessageArchivesResponse struct {
+	Archives []*models.MessageArchive `json:"archives"`
+}
+
+// ListMessageArchives lists the message archives, newest first.
+//
+//encore:api private method=GET path=/message-archives
+func ListMessageArchives(ctx context.Context) (*ListMessageArchivesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, guild_id, channel_id, message_count, oldest_message_at, newest_message_at, created_at, updated_at
+		FROM message_archives
+		ORDER BY id DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get message archives: %w", err)
+	}
+	defer rows.Close()
+
+	archives, err := models.MapMessageArchivesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map message archives: %w", err)
+	}
+
+	return &ListMessageArchivesResponse{Archives: archives}, nil
+}
+
+// DownloadMessageArchive downloads an archive as gzip compressed JSON lines.
+//
+//encore:api private raw method=GET path=/message-archives/:id/download
+func DownloadMessageArchive(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(encore.CurrentRequest().PathParams.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid archive id", http.StatusBadRequest)
+		return
+	}
+
+	var data []byte
+	err = db.QueryRow(req.Context(), "SELECT data FROM message_archives WHERE id = $1", id).Scan(&data)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		http.Error(w, "Archive not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rlog.Error("Couldn't get message archive", "id", id, "error", err)
+		http.Error(w, "Error getting archive", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"messages-%d.jsonl.gz\"", id))
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		rlog.Error("Couldn't write message archive", "id", id, "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package communitymessageindexer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// parseSearchQuery translates a search query into a Postgres tsquery.
+// Words are combined with AND, "quoted phrases" must appear in sequence,
+// a leading - excludes a word or phrase, OR between two terms matches either
+// & a trailing * matches words by prefix.
+// It returns an empty string if the query contains no searchable words.
+func parseSearchQuery(query string) string {
+	var terms []string
+	pendingOr := false
+	for _, token := range tokenizeSearchQuery(query) {
+		if token == "OR" {
+			pendingOr = len(terms) > 0
+			continue
+		}
+
+		negated := strings.HasPrefix(token, "-")
+		token = strings.TrimPrefix(token, "-")
+
+		var term string
+		if strings.HasPrefix(token, "\"") {
+			words := lexemes(strings.Trim(token, "\""))
+			if len(words) == 0 {
+				continue
+			}
+			term = strings.Join(words, " <-> ")
+			if len(words) > 1 {
+				term = "(" + term + ")"
+			}
+		} else {
+			words := lexemes(token)
+			if len(words) == 0 {
+				continue
+			}
+			// punctuation inside a word (ie "node.js") splits it into several lexemes which all have to match
+			if strings.HasSuffix(token, "*") {
+				words[len(words)-1] += ":*"
+			}
+			term = strings.Join(words, " & ")
+			if len(words) > 1 {
+				term = "(" + term + ")"
+			}
+		}
+
+		if negated {
+			term = "!" + term
+		}
+
+		if pendingOr {
+			terms[len(terms)-1] = "(" + terms[len(terms)-1] + " | " + term + ")"
+			pendingOr = false
+		} else {
+			terms = append(terms, term)
+		}
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// tokenizeSearchQuery splits a query on whitespace, keeping quoted phrases together
+func tokenizeSearchQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			current.WriteRune(r)
+			inQuotes = !inQuotes
+			if !inQuotes {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		case unicode.IsSpace(r) && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens
+}
+
+// lexemes lowercases a text & splits it into words, dropping everything tsquery would treat as an operator
+func lexemes(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,81 @@
+package communitymessageindexer
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "words are combined with AND", query: "deploy failed", want: "deploy & failed"},
+		{name: "words are lowercased", query: "Encore", want: "encore"},
+		{name: "quoted phrase", query: `"secret manager" error`, want: "(secret <-> manager) & error"},
+		{name: "excluded word", query: "deploy -staging", want: "deploy & !staging"},
+		{name: "excluded phrase", query: `deploy -"dry run"`, want: "deploy & !(dry <-> run)"},
+		{name: "or", query: "postgres OR mysql", want: "(postgres | mysql)"},
+		{name: "leading or is ignored", query: "OR postgres", want: "postgres"},
+		{name: "prefix", query: "migrat*", want: "migrat:*"},
+		{name: "punctuation splits a word", query: "node.js", want: "(node & js)"},
+		{name: "operators are dropped", query: "a&b | !c", want: "(a & b) & c"},
+		{name: "no searchable words", query: `"" - !`, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSearchQuery(tt.query); got != tt.want {
+				t.Errorf("parseSearchQuery(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  string
+		want    *searchCursor
+		wantErr bool
+	}{
+		{
+			name:   "round trip",
+			cursor: mustEncodeSearchCursor(t, &searchCursor{Rank: 0.25, ID: "1234"}),
+			want:   &searchCursor{Rank: 0.25, ID: "1234"},
+		},
+		{
+			name:   "zero rank",
+			cursor: mustEncodeSearchCursor(t, &searchCursor{ID: "1234"}),
+			want:   &searchCursor{ID: "1234"},
+		},
+		{name: "not base64", cursor: "not a cursor!", wantErr: true},
+		{name: "not json", cursor: base64.URLEncoding.EncodeToString([]byte("1234")), wantErr: true},
+		{name: "missing id", cursor: base64.URLEncoding.EncodeToString([]byte(`{"rank":0.5}`)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSearchCursor(tt.cursor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSearchCursor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.want != nil && *got != *tt.want {
+				t.Errorf("decodeSearchCursor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustEncodeSearchCursor(t *testing.T, cursor *searchCursor) string {
+	t.Helper()
+
+	encoded, err := encodeSearchCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
@@ -0,0 +1,370 @@
+package communitymessageindexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.app/packages/llmservice"
+	"encore.app/packages/utils"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"github.com/pinecone-io/go-pinecone/pinecone"
+	"github.com/samber/lo"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const communityMessagesIndexName = "community-messages-index"
+const embeddingBatchSize = 100
+
+// messages shorter than this (ie "thanks!") don't carry enough meaning to be worth embedding
+const minEmbeddedMessageLength = 20
+
+// charsPerToken estimates the tokens of a text, so the budget is enforced before calling the API
+const charsPerToken = 4
+
+const defaultSemanticSearchLimit = 5
+const maxSemanticSearchLimit = 20
+
+// messages posted this long before or after a search result are returned as its conversation
+const conversationContextWindow = 10 * time.Minute
+const maxConversationContext = 10
+
+type semanticIndex struct {
+	llmService *llmservice.Service
+	indexConn  *pinecone.IndexConnection
+}
+
+func initSemanticIndex(ctx context.Context) (*semanticIndex, error) {
+	llmService, err := llmservice.NewService()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create llm service: %w", err)
+	}
+
+	pineconeClient, err := pinecone.NewClient(pinecone.NewClientParams{
+		ApiKey: secrets.PineconeApiKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create pinecone client: %w", err)
+	}
+
+	indexConn, err := utils.ConnectToVectorDBIndex(ctx, pineconeClient, communityMessagesIndexName)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to pinecone index: %w", err)
+	}
+
+	return &semanticIndex{llmService: llmService, indexConn: indexConn}, nil
+}
+
+// Embed new community messages in batches while semantic indexing is enabled.
+var _ = cron.NewJob("embed-community-messages", cron.JobConfig{
+	Title:    "Embed community messages for semantic search",
+	Endpoint: EmbedCommunityMessages,
+	Every:    5 * cron.Minute,
+})
+
+// EmbedCommunityMessages embeds the oldest messages which aren't in the semantic index yet,
+// as long as today's token budget allows it.
+//
+//encore:api private method=POST path=/semantic-index/embed
+func EmbedCommunityMessages(ctx context.Context) error {
+	settings, err := GetSemanticIndexSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !settings.Enabled {
+		return nil
+	}
+
+	remainingTokens := settings.DailyTokenBudget - settings.TokensUsedToday
+	if remainingTokens <= 0 {
+		rlog.Info("Daily semantic index budget exhausted", "budget", settings.DailyTokenBudget)
+		return nil
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT
+			id, interaction_type, channel_id, guild_id,
+			author_id, content, clean_content, created_at
+		FROM discord_messages
+		WHERE embedded_at IS NULL AND LENGTH(clean_content) >= $1
+		ORDER BY created_at
+		LIMIT $2
+	`, minEmbeddedMessageLength, embeddingBatchSize)
+	if err != nil {
+		return fmt.Errorf("couldn't get messages to embed: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := models.MapDiscordRawMessagesFromSQLRows(rows)
+	if err != nil {
+		return fmt.Errorf("couldn't map messages: %w", err)
+	}
+
+	var batch []*models.DiscordRawMessage
+	tokens := 0
+	for _, message := range messages {
+		messageTokens := len(message.CleanContent)/charsPerToken + 1
+		if tokens+messageTokens > remainingTokens {
+			break
+		}
+
+		batch = append(batch, message)
+		tokens += messageTokens
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	index, err := initSemanticIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	embeddings, err := index.llmService.CreateEmbeddings(ctx, lo.Map(batch, func(message *models.DiscordRawMessage, _ int) string {
+		return message.CleanContent
+	}))
+	if err != nil {
+		return fmt.Errorf("couldn't create embeddings: %w", err)
+	}
+
+	// usage is recorded before upserting, as the embeddings are paid for even if the upsert fails
+	if err := addSemanticIndexUsage(ctx, tokens); err != nil {
+		return err
+	}
+
+	vectors := make([]*pinecone.Vector, len(batch))
+	for i, message := range batch {
+		createdAt, err := time.Parse(time.RFC3339, message.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("couldn't parse message creation time: %w", err)
+		}
+
+		vectors[i] = &pinecone.Vector{
+			Id:     message.ID,
+			Values: embeddings[i],
+			Metadata: &pinecone.Metadata{
+				Fields: map[string]*structpb.Value{
+					"channel_id": structpb.NewStringValue(message.ChannelID),
+					"author_id":  structpb.NewStringValue(message.AuthorID),
+					"created_at": structpb.NewNumberValue(float64(createdAt.Unix())),
+				},
+			},
+		}
+	}
+
+	if _, err := index.indexConn.UpsertVectors(&ctx, vectors); err != nil {
+		return fmt.Errorf("couldn't upsert vectors: %w", err)
+	}
+
+	_, err = db.Exec(ctx, "UPDATE discord_messages SET embedded_at = now() WHERE id = ANY($1)",
+		lo.Map(batch, func(message *models.DiscordRawMessage, _ int) string {
+			return message.ID
+		}))
+	if err != nil {
+		return fmt.Errorf("couldn't mark messages as embedded: %w", err)
+	}
+
+	rlog.Info("Embedded community messages", "count", len(batch), "estimatedTokens", tokens)
+	return nil
+}
+
+func addSemanticIndexUsage(ctx context.Context, tokens int) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO semantic_index_usage (day, tokens)
+		VALUES (CURRENT_DATE, $1)
+		ON CONFLICT (day) DO UPDATE SET tokens = semantic_index_usage.tokens + EXCLUDED.tokens
+	`, tokens)
+	if err != nil {
+		return fmt.Errorf("couldn't record semantic index usage: %w", err)
+	}
+
+	return nil
+}
+
+type SemanticIndexSettings struct {
+	Enabled          bool `json:"enabled"`
+	DailyTokenBudget int  `json:"dailyTokenBudget"`
+	TokensUsedToday  int  `json:"tokensUsedToday"`
+	// PendingMessages is the number of messages waiting to be embedded
+	PendingMessages int `json:"pendingMessages"`
+}
+
+// GetSemanticIndexSettings returns whether community messages are embedded & how much of the budget is used.
+//
+//encore:api private method=GET path=/semantic-index/settings
+func GetSemanticIndexSettings(ctx context.Context) (*SemanticIndexSettings, error) {
+	var settings SemanticIndexSettings
+	err := db.QueryRow(ctx, `
+		SELECT
+			s.enabled, s.daily_token_budget,
+			COALESCE((SELECT tokens FROM semantic_index_usage WHERE day = CURRENT_DATE), 0),
+			(SELECT COUNT(*) FROM discord_messages WHERE embedded_at IS NULL AND LENGTH(clean_content) >= $1)
+		FROM semantic_index_settings s
+	`, minEmbeddedMessageLength).Scan(
+		&settings.Enabled, &settings.DailyTokenBudget, &settings.TokensUsedToday, &settings.PendingMessages)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get semantic index settings: %w", err)
+	}
+
+	return &settings, nil
+}
+
+type UpdateSemanticIndexSettingsRequest struct {
+	Enabled          bool `json:"enabled"`
+	DailyTokenBudget int  `json:"daily_token_budget"`
+}
+
+// UpdateSemanticIndexSettings enables or disables embedding community messages & sets the daily token budget.
+//
+//encore:api private method=PUT path=/semantic-index/settings
+func UpdateSemanticIndexSettings(
+	ctx context.Context, req *UpdateSemanticIndexSettingsRequest,
+) (*SemanticIndexSettings, error) {
+	if req.DailyTokenBudget < 0 {
+		return nil, errors.New("the daily token budget can't be negative")
+	}
+
+	_, err := db.Exec(ctx, `
+		UPDATE semantic_index_settings
+		SET enabled = $1, daily_token_budget = $2, updated_at = now()
+	`, req.Enabled, req.DailyTokenBudget)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update semantic index settings: %w", err)
+	}
+
+	return GetSemanticIndexSettings(ctx)
+}
+
+type SemanticSearchRequest struct {
+	Query      string   `query:"q"`
+	ChannelIDs []string `query:"channel_ids"`
+	// Limit defaults to 5 conversations, at most 20
+	Limit    int     `query:"limit"`
+	MinScore float32 `query:"min_score"`
+}
+
+type SimilarConversation struct {
+	Score   float32                   `json:"score"`
+	Message *models.DiscordRawMessage `json:"message"`
+	// Context are the messages posted in the same channel around the matching message, oldest first
+	Context []*models.DiscordRawMessage `json:"context"`
+}
+
+type SemanticSearchResponse struct {
+	Conversations []*SimilarConversation `json:"conversations"`
+}
+
+// SemanticSearchMessages finds past conversations similar in meaning to the query,
+// even if they're worded differently. Only messages embedded into the semantic index are found.
+//
+//encore:api private method=GET path=/semantic-message-search
+func SemanticSearchMessages(ctx context.Context, req *SemanticSearchRequest) (*SemanticSearchResponse, error) {
+	if req.Query == "" {
+		return nil, errors.New("please provide a query")
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultSemanticSearchLimit
+	} else if limit > maxSemanticSearchLimit {
+		limit = maxSemanticSearchLimit
+	}
+
+	index, err := initSemanticIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings, err := index.llmService.CreateEmbeddings(ctx, []string{req.Query})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create embeddings: %w", err)
+	}
+
+	var filter *pinecone.Filter
+	if len(req.ChannelIDs) > 0 {
+		filter, err = structpb.NewStruct(map[string]any{
+			"channel_id": map[string]any{"$in": lo.ToAnySlice(req.ChannelIDs)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create filter: %w", err)
+		}
+	}
+
+	resp, err := index.indexConn.QueryByVectorValues(&ctx, &pinecone.QueryByVectorValuesRequest{
+		Vector: embeddings[0],
+		TopK:   uint32(limit),
+		Filter: filter,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't query vectors: %w", err)
+	}
+
+	conversations := []*SimilarConversation{}
+	for _, match := range resp.Matches {
+		if match.Score < req.MinScore {
+			continue
+		}
+
+		row := db.QueryRow(ctx, `
+			SELECT
+				id, interaction_type, channel_id, guild_id,
+				author_id, content, clean_content, created_at
+			FROM discord_messages
+			WHERE id = $1
+		`, match.Vector.Id)
+		message, err := models.MapDiscordRawMessageFromSQLRow(row)
+		if err != nil {
+			// the message may have been deleted since it was embedded
+			rlog.Warn("Couldn't get message of semantic search match", "id", match.Vector.Id, "error", err)
+			continue
+		}
+
+		conversationContext, err := getConversationContext(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+
+		conversations = append(conversations, &SimilarConversation{
+			Score:   match.Score,
+			Message: message,
+			Context: conversationContext,
+		})
+	}
+
+	return &SemanticSearchResponse{Conversations: conversations}, nil
+}
+
+func getConversationContext(
+	ctx context.Context, message *models.DiscordRawMessage,
+) ([]*models.DiscordRawMessage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT * FROM (
+			SELECT
+				id, interaction_type, channel_id, guild_id,
+				author_id, content, clean_content, created_at
+			FROM discord_messages
+			WHERE channel_id = $1
+			  AND created_at BETWEEN $2::TIMESTAMP - $3 * INTERVAL '1 second'
+			                     AND $2::TIMESTAMP + $3 * INTERVAL '1 second'
+			ORDER BY ABS(EXTRACT(EPOCH FROM created_at - $2::TIMESTAMP))
+			LIMIT $4
+		) context
+		ORDER BY created_at
+	`, message.ChannelID, message.CreatedAt, conversationContextWindow.Seconds(), maxConversationContext)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get conversation context: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := models.MapDiscordRawMessagesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map messages: %w", err)
+	}
+
+	return messages, nil
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"encore.app/models"
 	"encore.dev/rlog"
 	"github.com/bbalet/stopwords"
+	"github.com/samber/lo"
 )
 
 func persistDiscordMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
@@ -16,15 +18,35 @@ func persistDiscordMessage(ctx context.Context, message *models.DiscordCommunity
 	if err != nil {
 		return fmt.Errorf("couldn't begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec(ctx,
+	// prefer the time Discord says the message was posted, as the message may be indexed much later
+	createdAt := message.Timestamp.UTC()
+	if message.Timestamp.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+
+	result, err := tx.Exec(ctx,
 		`INSERT INTO discord_messages 
-		(id, interaction_type, channel_id, guild_id, author_id, content, clean_content) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		(id, interaction_type, channel_id, guild_id, author_id, content, clean_content, created_at,
+			referenced_message_id, thread_id, parent_channel_id, attachments, embeds,
+			mentioned_user_ids, mentioned_role_ids, mentions_everyone, edited_at) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''),
+			$12, $13, $14, $15, $16, $17)
+		ON CONFLICT (id) DO NOTHING
 	`, message.ID, message.InteractionType, message.ChannelID,
-		message.GuildID, message.AuthorID, message.Content, message.CleanContent)
+		message.GuildID, message.AuthorID, message.Content, message.CleanContent, createdAt,
+		message.ReferencedMessageID, message.ThreadID, message.ParentChannelID,
+		lo.Ternary(message.Attachments == nil, []*models.DiscordMessageAttachment{}, message.Attachments),
+		lo.Ternary(message.Embeds == nil, []*models.DiscordMessageEmbed{}, message.Embeds),
+		lo.Ternary(message.MentionedUserIDs == nil, []string{}, message.MentionedUserIDs),
+		lo.Ternary(message.MentionedRoleIDs == nil, []string{}, message.MentionedRoleIDs),
+		message.MentionsEveryone, message.EditedTimestamp)
 	if err != nil {
 		return fmt.Errorf("couldn't insert discord message: %w", err)
+	} else if result.RowsAffected() == 0 {
+		rlog.Info("Discord message already indexed", "messageID", message.ID)
+		return nil
 	}
 
 	_, err = tx.Exec(ctx,
@@ -4,7 +4,9 @@ import (
 	"context"
 
 	communitymessagemapper "encore.app/community_message_mapper"
+	deadletterqueue "encore.app/dead_letter_queue"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.dev/pubsub"
 	"encore.dev/storage/sqldb"
 )
@@ -13,11 +15,41 @@ var db = sqldb.NewDatabase("discord_messages", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
+const indexerSubscription = "community-message-indexer"
+
 var _ = pubsub.NewSubscription(
 	communitymessagemapper.DiscordCommunityMessageTopic,
 	"community-message-indexer",
 	pubsub.SubscriptionConfig[*models.DiscordCommunityMessageEvent]{
-		Handler: func(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
-			return persistDiscordMessage(ctx, message)
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-community-messages", indexerSubscription, 5, persistDiscordMessage),
+	})
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"community-message-indexer-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != indexerSubscription {
+				return nil
+			}
+
+			return deadletter.Replay(ctx, evt, persistDiscordMessage)
 		},
 	})
+
+// UserDataErasureTopic is a pubsub topic for erasure requests,
+// services storing data derived from community messages erase a user's data when they receive one
+var UserDataErasureTopic = pubsub.NewTopic[*models.UserDataErasureEvent]("user-data-erasures", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+var secrets struct {
+	DiscordToken   string
+	PineconeApiKey string
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"encore.app/models"
+	"encore.app/packages/outbox"
 	"encore.dev/rlog"
 	"github.com/bwmarrin/discordgo"
 	"github.com/google/uuid"
@@ -13,28 +14,19 @@ import (
 // #general
 const generalChannelID = "1086301297201909864"
 
-var secrets struct {
-	DiscordToken string
-}
-
-// Service for tagging forum posts based on their content
-type Service struct {
-	discordClient *discordgo.Session
-}
+// Service for mapping raw discord messages to community messages.
+// Everything it needs is sent along with the message, so it doesn't call Discord.
+type Service struct{}
 
 func initService() (*Service, error) {
-	discordClient, err := discordgo.New("Bot " + secrets.DiscordToken)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't create discord client: %w", err)
-	}
-
-	return &Service{discordClient: discordClient}, nil
+	return &Service{}, nil
 }
 
 func (s *Service) MapDiscordMessageToCommunityMessage(ctx context.Context, message *models.DiscordRawMessage) error {
 	rlog.Info("Handling discord raw message",
 		"channelId", message.ChannelID)
-	if message.ChannelID != generalChannelID {
+	structure := getMessageStructure(message)
+	if structure == nil {
 		rlog.Warn("Ignoring message for non-general channel")
 		return nil
 	}
@@ -44,6 +36,8 @@ func (s *Service) MapDiscordMessageToCommunityMessage(ctx context.Context, messa
 		return fmt.Errorf("couldn't begin transaction: %w", err)
 	}
 
+	defer tx.Rollback()
+
 	result, err := tx.Exec(ctx, `
 		INSERT INTO discord_community_messages (id, discord_message_id)
 		VALUES ($1, $2)
@@ -57,20 +51,21 @@ func (s *Service) MapDiscordMessageToCommunityMessage(ctx context.Context, messa
 		return nil
 	}
 
-	// Note: There is no atomicity between db insert and pubsub publish.
-	// To make it properly, we'll need to utilize the transactional outbox pattern,
-	// which is out of scope for this hackathon.
-	_, err = DiscordCommunityMessageTopic.Publish(ctx, &models.DiscordCommunityMessageEvent{
-		ID:              message.ID,
-		InteractionType: message.InteractionType,
-		ChannelID:       message.ChannelID,
-		GuildID:         message.GuildID,
-		AuthorID:        message.AuthorID,
-		Content:         message.Content,
-		CleanContent:    message.CleanContent,
-	})
+	// The event is stored in the outbox within the same transaction & published by the relay
+	_, err = outbox.Insert(ctx, tx, communityMessageOutboxTopic, "discord-community-message:"+message.ID,
+		&models.DiscordCommunityMessageEvent{
+			ID:              message.ID,
+			InteractionType: message.InteractionType,
+			ChannelID:       message.ChannelID,
+			GuildID:         message.GuildID,
+			AuthorID:        message.AuthorID,
+			Content:         message.Content,
+			CleanContent:    message.CleanContent,
+
+			DiscordMessageStructure: *structure,
+		})
 	if err != nil {
-		return fmt.Errorf("couldn't publish community message: %w", err)
+		return fmt.Errorf("couldn't add community message to outbox: %w", err)
 	}
 
 	err = tx.Commit()
@@ -78,6 +73,33 @@ func (s *Service) MapDiscordMessageToCommunityMessage(ctx context.Context, messa
 		return fmt.Errorf("couldn't commit transaction: %w", err)
 	}
 
+	// Publishing right away is best effort, the outbox relay cron will retry any pending events
+	if err := outboxRelay.PublishPending(ctx); err != nil {
+		rlog.Warn("Couldn't relay outbox events", "error", err)
+	}
+
 	rlog.Info("Successfully inserted & published community message")
 	return nil
 }
+
+// getMessageStructure returns the replies, thread, attachments & mentions the webhook proxy sent along
+// with the message. It returns nil for messages which weren't posted in #general or one of its threads.
+func getMessageStructure(message *models.DiscordRawMessage) *models.DiscordMessageStructure {
+	structure := &models.DiscordMessageStructure{}
+	if message.Structure != nil {
+		*structure = *message.Structure
+	}
+
+	if message.ChannelID != generalChannelID && structure.ParentChannelID != generalChannelID {
+		return nil
+	}
+
+	if structure.Timestamp.IsZero() {
+		// older proxies don't send the structure, the timestamp can still be recovered from the id
+		if timestamp, err := discordgo.SnowflakeTimestamp(message.ID); err == nil {
+			structure.Timestamp = timestamp
+		}
+	}
+
+	return structure
+}
@@ -2,10 +2,15 @@ package communitymessagemapper
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	deadletterqueue "encore.app/dead_letter_queue"
 	"encore.app/discord_handler"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.app/packages/outbox"
+	"encore.dev/cron"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
 	"encore.dev/storage/sqldb"
@@ -15,6 +20,36 @@ var db = sqldb.NewDatabase("community_message_mapper", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
+const communityMessageOutboxTopic = "discord-community-messages"
+
+var outboxRelay = outbox.NewRelay(db, map[string]outbox.Publisher{
+	communityMessageOutboxTopic: func(ctx context.Context, payload []byte) error {
+		var event models.DiscordCommunityMessageEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return fmt.Errorf("couldn't unmarshal community message: %w", err)
+		}
+
+		_, err := DiscordCommunityMessageTopic.Publish(ctx, &event)
+		return err
+	},
+})
+
+// Publish any outbox events which weren't relayed right after their transaction committed.
+var _ = cron.NewJob("relay-community-message-outbox", cron.JobConfig{
+	Title:    "Relay pending community message events",
+	Endpoint: RelayCommunityMessageOutbox,
+	Every:    1 * cron.Minute,
+})
+
+// RelayCommunityMessageOutbox publishes all pending community message events.
+//
+//encore:api private method=POST path=/community-message-outbox/relay
+func RelayCommunityMessageOutbox(ctx context.Context) error {
+	return outboxRelay.PublishPending(ctx)
+}
+
+const communityMessageMapperSubscription = "community-message-mapper"
+
 var _ = pubsub.NewSubscription(
 	discord_handler.DiscordRawMessageTopic,
 	"community-message-mapper",
@@ -22,14 +57,32 @@ var _ = pubsub.NewSubscription(
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
-		Handler: func(ctx context.Context, message *models.DiscordRawMessage) error {
-			rlog.Info("Received raw discord message", "discordMessage", message)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
+		Handler: deadletter.Handler("discord-messages", communityMessageMapperSubscription, 5, handleDiscordRawMessage),
+	})
+
+func handleDiscordRawMessage(ctx context.Context, message *models.DiscordRawMessage) error {
+	rlog.Info("Received raw discord message", "discordMessage", message)
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.MapDiscordMessageToCommunityMessage(ctx, message)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"community-message-mapper-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != communityMessageMapperSubscription {
+				return nil
 			}
 
-			return service.MapDiscordMessageToCommunityMessage(ctx, message)
+			return deadletter.Replay(ctx, evt, handleDiscordRawMessage)
 		},
 	})
 
@@ -2,15 +2,50 @@ package conversationalerter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"encore.app/models"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
 )
 
+const conversationAlertColumns = `
+	id, keywords, topics, channel_id, name, description,
+	created_by, paused, created_at, updated_at, watched_channel_ids,
+	destination_type, destination_user_ids, destination_role_ids, rule,
+	delivery_mode, cooldown_minutes, last_notified_at`
+
+const defaultCooldownMinutes = 10
+
 type CreateConversationAlertRequest struct {
-	Keywords  []string `json:"keywords"`
-	Topics    []string `json:"topics"`
-	ChannelID string   `json:"channel_id"`
+	Name              string           `json:"name"`
+	Description       string           `json:"description"`
+	Keywords          []string         `json:"keywords"`
+	Topics            []string         `json:"topics"`
+	WatchedChannelIDs []string         `json:"watched_channel_ids"`
+	Rule              models.AlertRule `json:"rule"`
+	AlertDestination
+	AlertDelivery
+	CreatedBy string `json:"created_by"`
+}
+
+// AlertDestination specifies where the notifications of a conversation alert are sent
+type AlertDestination struct {
+	// DestinationType defaults to sending the alert to a channel
+	DestinationType    models.AlertDestinationType `json:"destination_type"`
+	ChannelID          string                      `json:"channel_id"`
+	DestinationUserIDs []string                    `json:"destination_user_ids"`
+	DestinationRoleIDs []string                    `json:"destination_role_ids"`
+}
+
+// AlertDelivery specifies how the matches of a conversation alert are grouped & rate limited
+type AlertDelivery struct {
+	// DeliveryMode defaults to delivering matches immediately
+	DeliveryMode models.AlertDeliveryMode `json:"delivery_mode"`
+	// CooldownMinutes defaults to 10 minutes if omitted, 0 disables the cooldown
+	CooldownMinutes *int `json:"cooldown_minutes"`
 }
 
 // CreateConversationAlert creates a new conversation alert.
@@ -19,19 +54,37 @@ type CreateConversationAlertRequest struct {
 func CreateConversationAlert(
 	ctx context.Context, request *CreateConversationAlertRequest,
 ) (*models.ConversationAlert, error) {
-	var conversationAlert models.ConversationAlert
-	err := db.QueryRow(ctx, `
-		INSERT INTO conversation_alerts (keywords, topics, channel_id)
-		VALUES ($1, $2, $3)
-		RETURNING id, keywords, topics, channel_id
-	`, request.Keywords, request.Topics, request.ChannelID).
-		Scan(&conversationAlert.ID, &conversationAlert.Keywords,
-			&conversationAlert.Topics, &conversationAlert.ChannelID)
+	keywords, topics := normalizeAlertTerms(request.Keywords), normalizeAlertTerms(request.Topics)
+	if err := validateConversationAlert(request.Name, keywords, topics, &request.Rule); err != nil {
+		return nil, err
+	}
+
+	destination, err := normalizeAlertDestination(request.AlertDestination)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := normalizeAlertDelivery(request.AlertDelivery)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		INSERT INTO conversation_alerts (
+			name, description, keywords, topics, watched_channel_ids, destination_type,
+			channel_id, destination_user_ids, destination_role_ids, rule,
+			delivery_mode, cooldown_minutes, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+conversationAlertColumns,
+		strings.TrimSpace(request.Name), request.Description, keywords, topics,
+		normalizeAlertTerms(request.WatchedChannelIDs), destination.DestinationType, destination.ChannelID,
+		destination.DestinationUserIDs, destination.DestinationRoleIDs, request.Rule,
+		delivery.DeliveryMode, *delivery.CooldownMinutes, request.CreatedBy)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create conversation alert: %w", err)
 	}
 
-	return &conversationAlert, nil
+	return mapSingleConversationAlert(rows)
 }
 
 type ListConversationAlertsResponse struct {
@@ -43,12 +96,14 @@ type ListConversationAlertsResponse struct {
 //encore:api private method=GET path=/conversation-alerts
 func ListConversationAlerts(ctx context.Context) (*ListConversationAlertsResponse, error) {
 	rows, err := db.Query(ctx, `
-		SELECT id, keywords, topics, channel_id
+		SELECT `+conversationAlertColumns+`
 		FROM conversation_alerts
+		ORDER BY id
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get conversation alerts: %w", err)
 	}
+	defer rows.Close()
 
 	conversationAlerts, err := models.MapConversationAlertsFromSQLRows(rows)
 	if err != nil {
@@ -59,3 +114,187 @@ func ListConversationAlerts(ctx context.Context) (*ListConversationAlertsRespons
 		ConversationAlerts: conversationAlerts,
 	}, nil
 }
+
+// GetConversationAlert returns a single conversation alert.
+//
+//encore:api private method=GET path=/conversation-alerts/:id
+func GetConversationAlert(ctx context.Context, id int) (*models.ConversationAlert, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+conversationAlertColumns+`
+		FROM conversation_alerts
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get conversation alert: %w", err)
+	}
+
+	return mapSingleConversationAlert(rows)
+}
+
+type UpdateConversationAlertRequest struct {
+	Name              string           `json:"name"`
+	Description       string           `json:"description"`
+	Keywords          []string         `json:"keywords"`
+	Topics            []string         `json:"topics"`
+	WatchedChannelIDs []string         `json:"watched_channel_ids"`
+	Rule              models.AlertRule `json:"rule"`
+	AlertDestination
+	AlertDelivery
+}
+
+// UpdateConversationAlert replaces the definition of a conversation alert.
+//
+//encore:api private method=PUT path=/conversation-alerts/:id
+func UpdateConversationAlert(
+	ctx context.Context, id int, request *UpdateConversationAlertRequest,
+) (*models.ConversationAlert, error) {
+	keywords, topics := normalizeAlertTerms(request.Keywords), normalizeAlertTerms(request.Topics)
+	if err := validateConversationAlert(request.Name, keywords, topics, &request.Rule); err != nil {
+		return nil, err
+	}
+
+	destination, err := normalizeAlertDestination(request.AlertDestination)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := normalizeAlertDelivery(request.AlertDelivery)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+		UPDATE conversation_alerts
+		SET name = $2, description = $3, keywords = $4, topics = $5, watched_channel_ids = $6,
+			destination_type = $7, channel_id = $8, destination_user_ids = $9, destination_role_ids = $10,
+			rule = $11, delivery_mode = $12, cooldown_minutes = $13, updated_at = now()
+		WHERE id = $1
+		RETURNING `+conversationAlertColumns,
+		id, strings.TrimSpace(request.Name), request.Description, keywords, topics,
+		normalizeAlertTerms(request.WatchedChannelIDs), destination.DestinationType, destination.ChannelID,
+		destination.DestinationUserIDs, destination.DestinationRoleIDs, request.Rule,
+		delivery.DeliveryMode, *delivery.CooldownMinutes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update conversation alert: %w", err)
+	}
+
+	return mapSingleConversationAlert(rows)
+}
+
+// DeleteConversationAlert deletes a conversation alert.
+//
+//encore:api private method=DELETE path=/conversation-alerts/:id
+func DeleteConversationAlert(ctx context.Context, id int) error {
+	result, err := db.Exec(ctx, "DELETE FROM conversation_alerts WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("couldn't delete conversation alert: %w", err)
+	} else if result.RowsAffected() == 0 {
+		return fmt.Errorf("conversation alert %d not found", id)
+	}
+
+	return nil
+}
+
+// PauseConversationAlert stops a conversation alert from firing until it's resumed.
+//
+//encore:api private method=POST path=/conversation-alerts/:id/pause
+func PauseConversationAlert(ctx context.Context, id int) (*models.ConversationAlert, error) {
+	return setConversationAlertPaused(ctx, id, true)
+}
+
+// ResumeConversationAlert resumes a paused conversation alert.
+//
+//encore:api private method=POST path=/conversation-alerts/:id/resume
+func ResumeConversationAlert(ctx context.Context, id int) (*models.ConversationAlert, error) {
+	return setConversationAlertPaused(ctx, id, false)
+}
+
+func setConversationAlertPaused(ctx context.Context, id int, paused bool) (*models.ConversationAlert, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE conversation_alerts
+		SET paused = $2, updated_at = now()
+		WHERE id = $1
+		RETURNING `+conversationAlertColumns,
+		id, paused)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update conversation alert: %w", err)
+	}
+
+	return mapSingleConversationAlert(rows)
+}
+
+func mapSingleConversationAlert(rows *sqldb.Rows) (*models.ConversationAlert, error) {
+	defer rows.Close()
+	conversationAlerts, err := models.MapConversationAlertsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map conversation alert: %w", err)
+	} else if len(conversationAlerts) == 0 {
+		return nil, errors.New("conversation alert not found")
+	}
+
+	return conversationAlerts[0], nil
+}
+
+func validateConversationAlert(name string, keywords, topics []string, rule *models.AlertRule) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("please provide a name for the conversation alert")
+	} else if len(keywords) == 0 && len(topics) == 0 && rule.Match == nil {
+		return errors.New("please provide at least one keyword, topic or rule expression")
+	}
+
+	return validateAlertRule(rule)
+}
+
+func normalizeAlertDestination(destination AlertDestination) (*AlertDestination, error) {
+	normalized := &AlertDestination{
+		DestinationType:    destination.DestinationType,
+		ChannelID:          strings.TrimSpace(destination.ChannelID),
+		DestinationUserIDs: normalizeAlertTerms(destination.DestinationUserIDs),
+		DestinationRoleIDs: normalizeAlertTerms(destination.DestinationRoleIDs),
+	}
+
+	switch normalized.DestinationType {
+	case "", models.AlertDestinationChannel:
+		normalized.DestinationType = models.AlertDestinationChannel
+	case models.AlertDestinationDM:
+		if len(normalized.DestinationUserIDs) == 0 {
+			return nil, errors.New("please provide at least one user to send the alert to")
+		}
+	case models.AlertDestinationRole:
+		if len(normalized.DestinationRoleIDs) == 0 {
+			return nil, errors.New("please provide at least one role to mention in the alert")
+		}
+	default:
+		return nil, fmt.Errorf("invalid destination type %q", normalized.DestinationType)
+	}
+
+	return normalized, nil
+}
+
+func normalizeAlertDelivery(delivery AlertDelivery) (*AlertDelivery, error) {
+	normalized := &AlertDelivery{DeliveryMode: delivery.DeliveryMode, CooldownMinutes: delivery.CooldownMinutes}
+	switch normalized.DeliveryMode {
+	case "":
+		normalized.DeliveryMode = models.AlertDeliveryImmediate
+	case models.AlertDeliveryImmediate, models.AlertDeliveryHourlyDigest, models.AlertDeliveryDailyDigest:
+	default:
+		return nil, fmt.Errorf("invalid delivery mode %q", normalized.DeliveryMode)
+	}
+
+	if normalized.CooldownMinutes == nil {
+		normalized.CooldownMinutes = lo.ToPtr(defaultCooldownMinutes)
+	} else if *normalized.CooldownMinutes < 0 {
+		return nil, errors.New("the cooldown can't be negative")
+	}
+
+	return normalized, nil
+}
+
+// normalizeAlertTerms trims keywords/topics & drops empty or duplicate ones
+func normalizeAlertTerms(terms []string) []string {
+	trimmed := lo.Map(terms, func(term string, _ int) string {
+		return strings.TrimSpace(term)
+	})
+
+	return lo.Uniq(lo.Compact(trimmed))
+}
@@ -6,150 +6,152 @@ import (
 	"strings"
 	"time"
 
-	communitymessageindexer "encore.app/community_message_indexer"
 	"encore.app/models"
 	"encore.dev/cron"
 	"encore.dev/rlog"
 )
 
-const cronTimeDuration = 10 * time.Minute
-const conversationAlertsChannelID = "1234396668837892107"
+// topic alerts only look at messages received at least settleDelay ago,
+// so messages delivered slightly out of order still end up in the same batch
+const settleDelay = 30 * time.Second
+const maxBatchSize = 50
+
+// a topic alert is evaluated against at most maxBatchesPerRun batches per run,
+// a larger backlog is logged & picked up by the next runs
+const maxBatchesPerRun = 20
+
+// evaluated messages are kept in the queue for a day, messages not evaluated yet are kept until they are
+const messageQueueRetention = 24 * time.Hour
 
 var secrets struct {
 	DiscordToken string
 }
 
-// Check latest messages & alert if any topics/keywords match criteria.
-var _ = cron.NewJob("check-conversation-alerts", cron.JobConfig{
-	Title:    "Check all conversation alerts",
-	Endpoint: CheckConversationAlerts,
-	Every:    10 * cron.Minute,
+// Check queued messages against topic alerts in micro-batches.
+// Keyword alerts are evaluated as soon as a message arrives, see HandleCommunityMessage.
+var _ = cron.NewJob("evaluate-topic-alerts", cron.JobConfig{
+	Title:    "Evaluate topic alerts against new messages",
+	Endpoint: EvaluateTopicAlerts,
+	Every:    1 * cron.Minute,
 })
 
-// CheckConversationAlerts checks for any messages in the last time window
-// matching the defined conversation alerts.
+// EvaluateTopicAlerts checks the messages each topic alert hasn't seen yet
+// & advances the alert's high-water mark past them.
 //
-//encore:api private method=POST path=/check-conversation-alerts
-func CheckConversationAlerts(ctx context.Context) error {
+//encore:api private method=POST path=/evaluate-topic-alerts
+func EvaluateTopicAlerts(ctx context.Context) error {
 	service, err := NewService()
 	if err != nil {
 		return fmt.Errorf("couldn't create service: %w", err)
 	}
 
-	return service.checkConversationAlerts(ctx)
+	return service.evaluateTopicAlerts(ctx)
 }
 
-func (s *Service) checkConversationAlerts(ctx context.Context) error {
+func (s *Service) evaluateTopicAlerts(ctx context.Context) error {
 	now := time.Now()
-	rows, err := db.Query(ctx, "SELECT id, keywords, topics, channel_id FROM conversation_alerts")
-	if err != nil {
-		return fmt.Errorf("couldn't get conversation alerts: %w", err)
-	}
-
-	conversationAlerts, err := models.MapConversationAlertsFromSQLRows(rows)
+	conversationAlerts, err := listActiveConversationAlerts(ctx)
 	if err != nil {
-		return fmt.Errorf("couldn't map conversation alerts: %w", err)
+		return err
 	}
 
+	filter := s.newRuleFilter()
+	settledBefore := now.Add(-settleDelay)
 	for _, alert := range conversationAlerts {
-		matchingMessages, err := s.findMessagesMatchingTopic(ctx, alert, now)
-		if err != nil {
-			return fmt.Errorf("couldn't find messages matching topic: %w", err)
+		if len(alert.Topics) == 0 {
+			continue
 		}
 
-		if len(matchingMessages) == 0 {
-			rlog.Info("No messages found matching topics", "topics", alert.Topics)
-			continue
+		drained, err := s.evaluateTopicAlert(ctx, filter, alert, settledBefore)
+		if err != nil {
+			return err
 		}
 
-		discordMsgsStr := []string{}
-		for _, message := range matchingMessages {
-			discordMsg, err := s.discordClient.ChannelMessage(message.ChannelID, message.ID)
+		if !drained {
+			backlog, err := countQueueBacklog(ctx, alert, settledBefore)
 			if err != nil {
-				return fmt.Errorf("couldn't get discord message: %w", err)
+				return err
 			}
+			rlog.Warn("Topic alert is behind on queued messages", "alertId", alert.ID, "backlog", backlog)
+		}
+	}
 
-			discordChannel, err := s.discordClient.Channel(message.ChannelID)
-			if err != nil {
-				return fmt.Errorf("couldn't get discord channel: %w", err)
-			}
+	pruned, err := pruneMessageQueue(ctx, now.Add(-messageQueueRetention))
+	if err != nil {
+		return err
+	}
 
-			discordMsgsStr = append(discordMsgsStr,
-				fmt.Sprintf("[Link](https://discord.com/channels/%s/%s/%s)",
-					discordChannel.GuildID, discordMsg.ChannelID, discordMsg.ID))
-		}
+	if pruned > 0 {
+		rlog.Info("Pruned evaluated messages from the queue", "count", pruned)
+	}
 
-		alertMsg := fmt.Sprintf("🔔 New messages matching topic(s) [%s] found:\n%s",
-			strings.Join(alert.Topics, ", "), strings.Join(discordMsgsStr, "\n"))
-		_, err = s.discordClient.ChannelMessageSend(conversationAlertsChannelID, alertMsg)
+	return nil
+}
+
+// evaluateTopicAlert evaluates the alert against up to maxBatchesPerRun batches of queued messages,
+// advancing its high-water mark after every batch. It returns whether no settled messages were left.
+func (s *Service) evaluateTopicAlert(
+	ctx context.Context, filter *ruleFilter, alert *models.ConversationAlert, settledBefore time.Time,
+) (bool, error) {
+	for batch := 0; batch < maxBatchesPerRun; batch++ {
+		queuedMessages, err := listQueuedMessages(ctx, alert, settledBefore, maxBatchSize)
 		if err != nil {
-			return fmt.Errorf("couldn't send discord message: %w", err)
+			return false, err
 		}
-	}
 
-	for _, alert := range conversationAlerts {
-		for _, keyword := range alert.Keywords {
-			resp, err := communitymessageindexer.SearchMessages(ctx, &communitymessageindexer.SearchMessagesRequest{
-				Start:      now.Add(-cronTimeDuration).UTC(),
-				End:        now.UTC(),
-				SearchTerm: keyword,
-			})
-			if err != nil {
-				return fmt.Errorf("couldn't find messages matching topic: %w", err)
-			}
-
-			discordMsgsStr := []string{}
-			matchingMessages := resp.Messages
-			if len(matchingMessages) == 0 {
-				rlog.Info("No messages found matching keyword", "keyword", keyword)
-				continue
-			}
+		if len(queuedMessages) == 0 {
+			return true, nil
+		}
 
-			for _, message := range matchingMessages {
-				discordMsg, err := s.discordClient.ChannelMessage(message.ChannelID, message.ID)
-				if err != nil {
-					return fmt.Errorf("couldn't get discord message: %w", err)
-				}
+		messages := make([]*models.DiscordRawMessage, 0, len(queuedMessages))
+		for _, message := range queuedMessages {
+			messages = append(messages, message.DiscordRawMessage)
+		}
 
-				discordChannel, err := s.discordClient.Channel(message.ChannelID)
-				if err != nil {
-					return fmt.Errorf("couldn't get discord channel: %w", err)
-				}
+		matchingMessages, err := s.findMessagesMatchingTopic(ctx, filter, alert, messages)
+		if err != nil {
+			return false, err
+		}
 
-				discordMsgsStr = append(discordMsgsStr,
-					fmt.Sprintf("[Link](https://discord.com/channels/%s/%s/%s)",
-						discordChannel.GuildID, discordMsg.ChannelID, discordMsg.ID))
+		if len(matchingMessages) == 0 {
+			rlog.Info("No messages found matching topics", "topics", alert.Topics)
+		} else {
+			matchedBy := fmt.Sprintf("topic(s) [%s]", strings.Join(alert.Topics, ", "))
+			if err := s.recordAndDeliverMatches(ctx, alert, matchingMessages, matchedBy); err != nil {
+				return false, err
 			}
+		}
 
-			alertMsg := fmt.Sprintf("🔔 New messages matching keyword \"%s\" found:\n%s",
-				keyword, strings.Join(discordMsgsStr, "\n"))
-			_, err = s.discordClient.ChannelMessageSend(conversationAlertsChannelID, alertMsg)
-			if err != nil {
-				return fmt.Errorf("couldn't send discord message: %w", err)
-			}
+		// messages are ordered by their position in the queue, so the last one is the newest
+		if err := advanceHighWaterMark(ctx, alert.ID, queuedMessages[len(queuedMessages)-1].Seq); err != nil {
+			return false, err
+		}
+
+		if len(queuedMessages) < maxBatchSize {
+			return true, nil
 		}
 	}
 
-	return nil
+	return false, nil
 }
 
+// findMessagesMatchingTopic returns the messages matching the alert's topics which pass the alert's rule filters
 func (s *Service) findMessagesMatchingTopic(
-	ctx context.Context, alert *models.ConversationAlert, now time.Time,
+	ctx context.Context, filter *ruleFilter, alert *models.ConversationAlert, messages []*models.DiscordRawMessage,
 ) ([]*models.DiscordRawMessage, error) {
-	generalChannelID := "1086301297201909864"
-	resp, err := communitymessageindexer.ListMessages(ctx, &communitymessageindexer.ListMessagesRequest{
-		ChannelID: generalChannelID,
-		Start:     now.Add(-cronTimeDuration).UTC(),
-		End:       now.UTC(),
-	})
+	topicMessages, err := s.llmService.FindMessagesMatchingTopic(ctx, messages, alert.Topics)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get messages: %w", err)
+		return nil, fmt.Errorf("couldn't find messages matching topic: %w", err)
 	}
 
-	rlog.Info("Listed messages", "messages", resp.Messages, "alert", alert)
-	matchingMessages, err := s.llmService.FindMessagesMatchingTopic(ctx, resp.Messages, alert.Topics)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't find messages matching topic: %w", err)
+	matchingMessages := []*models.DiscordRawMessage{}
+	for _, message := range topicMessages {
+		passes, err := filter.passes(ctx, alert, message)
+		if err != nil {
+			return nil, err
+		} else if passes {
+			matchingMessages = append(matchingMessages, message)
+		}
 	}
 
 	return matchingMessages, nil
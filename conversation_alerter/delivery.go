@@ -0,0 +1,374 @@
+package conversationalerter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/models"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+)
+
+const conversationAlertsChannelID = "1234396668837892107"
+
+// maxEmbedFields keeps alert embeds well below Discord's 6000 character limit
+const maxEmbedFields = 10
+const maxExcerptLength = 200
+const alertEmbedColor = 0xf1c40f
+
+// unsentNotificationGracePeriod is how long a new notification is given to be sent before the cron retries it
+const unsentNotificationGracePeriod = 5 * time.Minute
+
+// notifications which couldn't be sent are retried after a delay doubling from minNotificationRetryDelay
+// up to maxNotificationRetryDelay, & marked as failed after maxNotificationAttempts
+const minNotificationRetryDelay = time.Minute
+const maxNotificationRetryDelay = time.Hour
+const maxNotificationAttempts = 8
+
+// Deliver digests & matches held back by cooldowns once they're due.
+var _ = cron.NewJob("deliver-alert-matches", cron.JobConfig{
+	Title:    "Deliver pending conversation alert matches",
+	Endpoint: DeliverAlertMatches,
+	Every:    1 * cron.Minute,
+})
+
+// DeliverAlertMatches delivers the pending matches of all alerts which are due, retries sending
+// the notifications which couldn't be sent before & reopens snoozed notifications.
+// An alert failing to deliver doesn't keep the other alerts from delivering.
+//
+//encore:api private method=POST path=/deliver-alert-matches
+func DeliverAlertMatches(ctx context.Context) error {
+	service, err := NewService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	conversationAlerts, err := listActiveConversationAlerts(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := service.resendUnsentNotifications(ctx, conversationAlerts); err != nil {
+		rlog.Error("Couldn't resend unsent alert notifications", "error", err)
+	}
+
+	for _, alert := range conversationAlerts {
+		if err := service.deliverMatches(ctx, alert); err != nil {
+			rlog.Error("Couldn't deliver alert matches", "alertId", alert.ID, "error", err)
+		}
+	}
+
+	return service.remindSnoozedNotifications(ctx)
+}
+
+func (s *Service) recordAndDeliverMatches(
+	ctx context.Context, alert *models.ConversationAlert, messages []*models.DiscordRawMessage, matchedBy string,
+) error {
+	recorded, err := recordMatches(ctx, alert.ID, messages, matchedBy)
+	if err != nil {
+		return err
+	}
+
+	// digests are delivered by the cron
+	if recorded == 0 || alert.DeliveryMode != models.AlertDeliveryImmediate {
+		return nil
+	}
+
+	return s.deliverMatches(ctx, alert)
+}
+
+// deliverMatches sends the pending matches of an alert as a single notification,
+// unless the alert notified more recently than its delivery interval.
+// A notification which couldn't be sent is only logged, it's retried by the delivery cron.
+func (s *Service) deliverMatches(ctx context.Context, alert *models.ConversationAlert) error {
+	notificationID, err := createNotification(ctx, alert)
+	if err != nil {
+		return err
+	}
+
+	if notificationID == 0 {
+		return nil
+	}
+
+	if err := s.sendNotification(ctx, alert, notificationID); err != nil {
+		rlog.Error("Couldn't send alert notification, it will be retried",
+			"alertId", alert.ID, "notificationId", notificationID, "error", err)
+	}
+
+	return nil
+}
+
+// createNotification moves the pending matches of an alert into a new notification, which is sent after
+// the transaction commits. It returns 0 if the alert has no pending matches or isn't due yet.
+// The alert is locked while creating the notification, so concurrent deliveries don't pick the same matches.
+func createNotification(ctx context.Context, alert *models.ConversationAlert) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var lastNotifiedAt *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT last_notified_at FROM conversation_alerts WHERE id = $1 FOR UPDATE
+	`, alert.ID).Scan(&lastNotifiedAt)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't lock conversation alert: %w", err)
+	}
+
+	// digests are collected from the creation of the alert, immediate alerts deliver the first match right away
+	since := lastNotifiedAt
+	if since == nil && alert.DeliveryMode != models.AlertDeliveryImmediate {
+		since = &alert.CreatedAt
+	}
+
+	if since != nil && time.Since(*since) < deliveryInterval(alert) {
+		return 0, nil
+	}
+
+	matches, err := listPendingMatches(ctx, tx, alert.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(matches) == 0 {
+		return 0, nil
+	}
+
+	notificationID, err := addNotification(ctx, tx, alert.ID, len(matches))
+	if err != nil {
+		return 0, err
+	}
+
+	messageIDs := lo.Map(matches, func(match *alertMatch, _ int) string {
+		return match.MessageID
+	})
+	if err := markMatchesDelivered(ctx, tx, alert.ID, notificationID, messageIDs); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return notificationID, nil
+}
+
+// sendNotification sends a stored notification with its matches to the alert's destination.
+// A failed send is recorded as an attempt, the notification is retried with a backoff until it runs out of attempts.
+func (s *Service) sendNotification(ctx context.Context, alert *models.ConversationAlert, notificationID int64) error {
+	matches, err := listNotificationMatches(ctx, notificationID)
+	if err != nil {
+		return err
+	}
+
+	notification := &models.AlertNotification{ID: notificationID, Status: models.AlertNotificationStatusOpen}
+	alertMsg, err := s.sendAlert(ctx, alert, notificationID, formatAlertEmbed(alert, matches), triageComponents(notification))
+	if err != nil {
+		attempts, recordErr := recordNotificationAttempt(ctx, notificationID, err)
+		if recordErr != nil {
+			return errors.Join(err, recordErr)
+		}
+
+		if attempts >= maxNotificationAttempts {
+			rlog.Error("Giving up on sending alert notification, marked as failed",
+				"alertId", alert.ID, "notificationId", notificationID, "attempts", attempts, "error", err)
+		}
+
+		return err
+	}
+
+	var channelID, messageID string
+	if alertMsg != nil {
+		channelID, messageID = alertMsg.ChannelID, alertMsg.ID
+	}
+
+	return markNotificationSent(ctx, notificationID, channelID, messageID)
+}
+
+// resendUnsentNotifications retries sending the notifications of active alerts which weren't sent & are due.
+// Notifications created in the last unsentNotificationGracePeriod may still be being sent & are skipped.
+func (s *Service) resendUnsentNotifications(ctx context.Context, alerts []*models.ConversationAlert) error {
+	notifications, err := listUnsentNotifications(ctx, time.Now().Add(-unsentNotificationGracePeriod))
+	if err != nil {
+		return err
+	}
+
+	alertsByID := lo.KeyBy(alerts, func(alert *models.ConversationAlert) string {
+		return alert.ID
+	})
+	for _, notification := range notifications {
+		alert, ok := alertsByID[notification.AlertID]
+		if !ok {
+			// paused, sent once the alert is resumed
+			continue
+		}
+
+		if err := s.sendNotification(ctx, alert, notification.ID); err != nil {
+			rlog.Error("Couldn't resend alert notification",
+				"alertId", alert.ID, "notificationId", notification.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// notificationRetryDelay is the time to wait before sending a notification again after its nth failed attempt
+func notificationRetryDelay(attempts int) time.Duration {
+	delay := minNotificationRetryDelay
+	for i := 1; i < attempts && delay < maxNotificationRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxNotificationRetryDelay)
+}
+
+// deliveryInterval is the minimum time between two notifications of an alert
+func deliveryInterval(alert *models.ConversationAlert) time.Duration {
+	interval := time.Duration(alert.CooldownMinutes) * time.Minute
+	switch {
+	case alert.DeliveryMode == models.AlertDeliveryHourlyDigest && interval < time.Hour:
+		interval = time.Hour
+	case alert.DeliveryMode == models.AlertDeliveryDailyDigest && interval < 24*time.Hour:
+		interval = 24 * time.Hour
+	}
+
+	return interval
+}
+
+func formatAlertEmbed(alert *models.ConversationAlert, matches []*alertMatch) *discordgo.MessageEmbed {
+	fields := lo.Map(lo.Slice(matches, 0, maxEmbedFields), func(match *alertMatch, _ int) *discordgo.MessageEmbedField {
+		postedAt := match.MatchedAt
+		if createdAt, err := discordgo.SnowflakeTimestamp(match.MessageID); err == nil {
+			postedAt = createdAt
+		}
+
+		return &discordgo.MessageEmbedField{
+			Name: "Matching " + match.MatchedBy,
+			Value: fmt.Sprintf("> %s\n<@%s> · <t:%d:f> · [Jump to message](https://discord.com/channels/%s/%s/%s)",
+				excerpt(match.Content), match.AuthorID, postedAt.Unix(), match.GuildID, match.ChannelID, match.MessageID),
+		}
+	})
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("🔔 %s: %d new matching message(s)", alert.Name, len(matches)),
+		Description: alert.Description,
+		Color:       alertEmbedColor,
+		Fields:      fields,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+
+	if len(matches) > maxEmbedFields {
+		embed.Footer = &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("…and %d more matching message(s)", len(matches)-maxEmbedFields),
+		}
+	}
+
+	return embed
+}
+
+func excerpt(content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	if runes := []rune(content); len(runes) > maxExcerptLength {
+		return string(runes[:maxExcerptLength]) + "…"
+	}
+
+	return content
+}
+
+// sendAlert delivers an alert notification to the destination configured for the alert.
+// It returns the sent message, or the first one when sending DMs to several users.
+func (s *Service) sendAlert(
+	ctx context.Context,
+	alert *models.ConversationAlert,
+	notificationID int64,
+	embed *discordgo.MessageEmbed,
+	components []discordgo.MessageComponent,
+) (*discordgo.Message, error) {
+	channelID := alert.ChannelID
+	if channelID == "" {
+		channelID = conversationAlertsChannelID
+	}
+
+	alertMsg := &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{embed},
+		Components: components,
+	}
+
+	switch alert.DestinationType {
+	case models.AlertDestinationDM:
+		return s.sendAlertDMs(ctx, alert, notificationID, alertMsg)
+	case models.AlertDestinationRole:
+		mentions := lo.Map(alert.DestinationRoleIDs, func(roleID string, _ int) string {
+			return fmt.Sprintf("<@&%s>", roleID)
+		})
+
+		alertMsg.Content = strings.Join(mentions, " ")
+		alertMsg.AllowedMentions = &discordgo.MessageAllowedMentions{Roles: alert.DestinationRoleIDs}
+	}
+
+	sentMsg, err := s.discordClient.ChannelMessageSendComplex(channelID, alertMsg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't send discord message: %w", err)
+	}
+
+	return sentMsg, nil
+}
+
+// sendAlertDMs sends a notification to each destination user, recording every DM sent so a retry
+// only sends it to the users who didn't get it yet. Users who can't be DM'd, ie because they block DMs
+// from server members, are skipped so they don't hold back the notification.
+func (s *Service) sendAlertDMs(
+	ctx context.Context, alert *models.ConversationAlert, notificationID int64, alertMsg *discordgo.MessageSend,
+) (*discordgo.Message, error) {
+	sentDMs, err := listNotificationRecipients(ctx, notificationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstMsg *discordgo.Message
+	for _, userID := range alert.DestinationUserIDs {
+		dmMsg, ok := sentDMs[userID]
+		if !ok {
+			dmMsg, err = s.sendAlertDM(userID, alertMsg)
+			var restErr *discordgo.RESTError
+			if errors.As(err, &restErr) && restErr.Message != nil &&
+				restErr.Message.Code == discordgo.ErrCodeCannotSendMessagesToThisUser {
+				rlog.Warn("Skipping alert recipient who can't be sent DMs",
+					"alertId", alert.ID, "notificationId", notificationID, "userId", userID)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if err := addNotificationRecipient(ctx, notificationID, userID, dmMsg); err != nil {
+				return nil, err
+			}
+		}
+
+		if firstMsg == nil {
+			firstMsg = dmMsg
+		}
+	}
+
+	return firstMsg, nil
+}
+
+func (s *Service) sendAlertDM(userID string, alertMsg *discordgo.MessageSend) (*discordgo.Message, error) {
+	dmChannel, err := s.discordClient.UserChannelCreate(userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open DM channel: %w", err)
+	}
+
+	dmMsg, err := s.discordClient.ChannelMessageSendComplex(dmChannel.ID, alertMsg)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't send discord DM: %w", err)
+	}
+
+	return dmMsg, nil
+}
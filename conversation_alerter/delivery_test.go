@@ -0,0 +1,26 @@
+package conversationalerter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotificationRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Minute},
+		{attempts: 2, want: 2 * time.Minute},
+		{attempts: 3, want: 4 * time.Minute},
+		{attempts: 6, want: 32 * time.Minute},
+		{attempts: 7, want: time.Hour},
+		{attempts: 100, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := notificationRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("notificationRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.app/models"
+	"github.com/samber/lo"
+)
+
+const defaultDryRunDays = 7
+const maxDryRunDays = 30
+
+// maxDryRunMessages bounds the LLM calls a dry run can make for topics & sentiment
+const maxDryRunMessages = 2000
+
+type DryRunConversationAlertRequest struct {
+	Keywords          []string         `json:"keywords"`
+	Topics            []string         `json:"topics"`
+	WatchedChannelIDs []string         `json:"watched_channel_ids"`
+	Rule              models.AlertRule `json:"rule"`
+	// Days is the number of past days the alert is evaluated against, 7 by default
+	Days int `json:"days"`
+}
+
+type DryRunMatch struct {
+	Message *models.DiscordRawMessage `json:"message"`
+	// MatchedBy describes the keyword, rule or topics the message matched
+	MatchedBy string `json:"matchedBy"`
+}
+
+type DryRunConversationAlertResponse struct {
+	EvaluatedMessages int            `json:"evaluatedMessages"`
+	Matches           []*DryRunMatch `json:"matches"`
+	// Truncated is set if only the oldest maxDryRunMessages messages of the period were evaluated
+	Truncated bool `json:"truncated"`
+}
+
+// DryRunConversationAlert evaluates an alert definition against the messages of the past days
+// & returns the messages it would have fired for, without notifying anyone.
+//
+//encore:api private method=POST path=/conversation-alert-dry-runs
+func DryRunConversationAlert(
+	ctx context.Context, request *DryRunConversationAlertRequest,
+) (*DryRunConversationAlertResponse, error) {
+	alert := &models.ConversationAlert{
+		Name:              "dry run",
+		Keywords:          normalizeAlertTerms(request.Keywords),
+		Topics:            normalizeAlertTerms(request.Topics),
+		WatchedChannelIDs: normalizeAlertTerms(request.WatchedChannelIDs),
+		Rule:              request.Rule,
+	}
+	if err := validateConversationAlert(alert.Name, alert.Keywords, alert.Topics, &alert.Rule); err != nil {
+		return nil, err
+	}
+
+	days := request.Days
+	if days <= 0 {
+		days = defaultDryRunDays
+	} else if days > maxDryRunDays {
+		return nil, fmt.Errorf("dry runs can cover at most %d days", maxDryRunDays)
+	}
+
+	service, err := NewService()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	now := time.Now()
+	resp, err := communitymessageindexer.ListMessages(ctx, &communitymessageindexer.ListMessagesRequest{
+		Start: now.AddDate(0, 0, -days).UTC(),
+		End:   now.UTC(),
+		// one more than evaluated, to tell whether the period had more messages
+		Limit: maxDryRunMessages + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get messages: %w", err)
+	}
+
+	messages := resp.Messages
+	truncated := len(messages) > maxDryRunMessages
+	if truncated {
+		messages = messages[:maxDryRunMessages]
+	}
+
+	return service.dryRun(ctx, alert, messages, truncated)
+}
+
+func (s *Service) dryRun(
+	ctx context.Context, alert *models.ConversationAlert, messages []*models.DiscordRawMessage, truncated bool,
+) (*DryRunConversationAlertResponse, error) {
+	filter := s.newRuleFilter()
+	matches := []*DryRunMatch{}
+	// messages matching several ways are matched once, like the live alert would, with all the reasons
+	matchesByID := make(map[string]*DryRunMatch)
+	addMatch := func(message *models.DiscordRawMessage, matchedBy string) {
+		if match, ok := matchesByID[message.ID]; ok {
+			match.MatchedBy += " & " + matchedBy
+			return
+		}
+
+		match := &DryRunMatch{Message: message, MatchedBy: matchedBy}
+		matchesByID[message.ID] = match
+		matches = append(matches, match)
+	}
+	for _, message := range messages {
+		matchedBy, ok := matchContent(alert, message.Content)
+		if !ok {
+			continue
+		}
+
+		passes, err := filter.passes(ctx, alert, message)
+		if err != nil {
+			return nil, err
+		} else if passes {
+			addMatch(message, matchedBy)
+		}
+	}
+
+	if len(alert.Topics) > 0 {
+		watchedMessages := lo.Filter(messages, func(message *models.DiscordRawMessage, _ int) bool {
+			return watchesChannel(alert, message.ChannelID)
+		})
+
+		matchedBy := fmt.Sprintf("topic(s) [%s]", strings.Join(alert.Topics, ", "))
+		for _, batch := range lo.Chunk(watchedMessages, maxBatchSize) {
+			topicMessages, err := s.findMessagesMatchingTopic(ctx, filter, alert, batch)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, message := range topicMessages {
+				addMatch(message, matchedBy)
+			}
+		}
+	}
+
+	return &DryRunConversationAlertResponse{
+		EvaluatedMessages: len(messages),
+		Matches:           matches,
+		Truncated:         truncated,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+const userErasureSubscription = "conversation-alerter-user-erasure"
+
+var _ = pubsub.NewSubscription(
+	communitymessageindexer.UserDataErasureTopic,
+	"conversation-alerter-user-erasure",
+	pubsub.SubscriptionConfig[*models.UserDataErasureEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("user-data-erasures", userErasureSubscription, 5, eraseUserAlertData),
+	})
+
+// eraseUserAlertData removes the queued & matched messages of a user.
+// Notifications already sent to Discord keep their match count.
+func eraseUserAlertData(ctx context.Context, evt *models.UserDataErasureEvent) error {
+	queued, err := db.Exec(ctx, "DELETE FROM alert_message_queue WHERE author_id = $1", evt.UserID)
+	if err != nil {
+		return fmt.Errorf("couldn't erase queued messages: %w", err)
+	}
+
+	matches, err := db.Exec(ctx, "DELETE FROM alert_matches WHERE author_id = $1", evt.UserID)
+	if err != nil {
+		return fmt.Errorf("couldn't erase alert matches: %w", err)
+	}
+
+	rlog.Info("Erased user from conversation alerts",
+		"requestId", evt.RequestID, "queued", queued.RowsAffected(), "matches", matches.RowsAffected())
+	return communitymessageindexer.ConfirmUserErasure(ctx, evt.RequestID, &communitymessageindexer.ConfirmUserErasureRequest{
+		Service: communitymessageindexer.ErasureServiceConversationAlerter,
+	})
+}
@@ -0,0 +1,5 @@
+-- failed sends are retried with a backoff until the notification is marked as FAILED
+ALTER TABLE alert_notifications
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN next_attempt_at TIMESTAMP,
+    ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
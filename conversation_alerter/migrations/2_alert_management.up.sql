@@ -0,0 +1,11 @@
+ALTER TABLE conversation_alerts
+    ADD COLUMN name VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN paused BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT now();
+
+UPDATE conversation_alerts SET keywords = '{}' WHERE keywords IS NULL;
+UPDATE conversation_alerts SET topics = '{}' WHERE topics IS NULL;
+UPDATE conversation_alerts SET name = 'Alert ' || id WHERE name = '';
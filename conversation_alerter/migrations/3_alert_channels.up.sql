@@ -0,0 +1,5 @@
+ALTER TABLE conversation_alerts
+    ADD COLUMN watched_channel_ids TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN destination_type VARCHAR(255) NOT NULL DEFAULT 'CHANNEL',
+    ADD COLUMN destination_user_ids TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN destination_role_ids TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,21 @@
+-- community messages waiting to be checked against topic alerts in the next micro-batches.
+-- seq orders the queue in the order messages arrived, which is what the high-water marks advance on.
+CREATE TABLE alert_message_queue (
+    seq BIGSERIAL UNIQUE,
+    message_id VARCHAR(255) PRIMARY KEY,
+    channel_id VARCHAR(255) NOT NULL,
+    guild_id VARCHAR(255) NOT NULL,
+    author_id VARCHAR(255) NOT NULL,
+    content TEXT NOT NULL,
+    clean_content TEXT NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX alert_message_queue_received_at_idx ON alert_message_queue (received_at);
+
+-- the last queued message each topic alert has been evaluated against
+CREATE TABLE alert_high_water_marks (
+    alert_id INT PRIMARY KEY REFERENCES conversation_alerts (id) ON DELETE CASCADE,
+    last_seq BIGINT NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1 @@
+ALTER TABLE conversation_alerts ADD COLUMN rule JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,21 @@
+ALTER TABLE conversation_alerts
+    ADD COLUMN delivery_mode VARCHAR(255) NOT NULL DEFAULT 'IMMEDIATE',
+    ADD COLUMN cooldown_minutes INT NOT NULL DEFAULT 10,
+    ADD COLUMN last_notified_at TIMESTAMP;
+
+-- messages matched by an alert, delivered in groups according to the alert's delivery mode & cooldown.
+-- The primary key makes sure an alert never notifies about the same message twice.
+CREATE TABLE alert_matches (
+    alert_id INT NOT NULL REFERENCES conversation_alerts (id) ON DELETE CASCADE,
+    message_id VARCHAR(255) NOT NULL,
+    channel_id VARCHAR(255) NOT NULL,
+    guild_id VARCHAR(255) NOT NULL,
+    author_id VARCHAR(255) NOT NULL,
+    content TEXT NOT NULL,
+    matched_by TEXT NOT NULL,
+    matched_at TIMESTAMP NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMP,
+    PRIMARY KEY (alert_id, message_id)
+);
+
+CREATE INDEX alert_matches_pending_idx ON alert_matches (alert_id) WHERE delivered_at IS NULL;
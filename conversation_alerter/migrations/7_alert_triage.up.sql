@@ -0,0 +1,20 @@
+-- a delivered alert message & the triage state moderators set through its buttons
+CREATE TABLE alert_notifications (
+    id BIGSERIAL PRIMARY KEY,
+    alert_id INT NOT NULL REFERENCES conversation_alerts (id) ON DELETE CASCADE,
+    discord_channel_id VARCHAR(255) NOT NULL DEFAULT '',
+    discord_message_id VARCHAR(255) NOT NULL DEFAULT '',
+    match_count INT NOT NULL,
+    status VARCHAR(255) NOT NULL DEFAULT 'OPEN',
+    assignee_id VARCHAR(255) NOT NULL DEFAULT '',
+    handled_by VARCHAR(255) NOT NULL DEFAULT '',
+    snoozed_until TIMESTAMP,
+    first_response_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX alert_notifications_alert_id_status_idx ON alert_notifications (alert_id, status);
+
+ALTER TABLE alert_matches
+    ADD COLUMN notification_id BIGINT REFERENCES alert_notifications (id) ON DELETE SET NULL;
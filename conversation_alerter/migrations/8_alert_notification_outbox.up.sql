@@ -0,0 +1,7 @@
+-- notifications are stored with their matches before they're sent to Discord & sent_at is set once they are,
+-- so the delivery cron can retry sending the ones which failed
+ALTER TABLE alert_notifications ADD COLUMN sent_at TIMESTAMP;
+
+UPDATE alert_notifications SET sent_at = created_at;
+
+CREATE INDEX alert_notifications_unsent_idx ON alert_notifications (created_at) WHERE sent_at IS NULL;
@@ -0,0 +1,9 @@
+-- the users a DM notification was sent to, so a retried notification doesn't DM them again
+CREATE TABLE alert_notification_recipients (
+    notification_id BIGINT NOT NULL REFERENCES alert_notifications (id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    discord_channel_id VARCHAR(255) NOT NULL,
+    discord_message_id VARCHAR(255) NOT NULL,
+    sent_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (notification_id, user_id)
+);
@@ -0,0 +1,243 @@
+package conversationalerter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"encore.app/models"
+	"encore.app/packages/llmservice"
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+)
+
+// sentimentSeverity orders sentiments from least to most severe
+var sentimentSeverity = map[models.MessageSentiment]int{
+	models.MessageSentimentPositive: 0,
+	models.MessageSentimentNeutral:  1,
+	models.MessageSentimentNegative: 2,
+}
+
+// compiledRegexes caches the regexes of alert expressions, as they're evaluated for every message
+var compiledRegexes sync.Map
+
+func validateAlertRule(rule *models.AlertRule) error {
+	if rule.Match != nil {
+		if err := validateAlertExpression(rule.Match); err != nil {
+			return err
+		}
+	}
+
+	if rule.MinSentimentSeverity != "" {
+		if _, ok := sentimentSeverity[rule.MinSentimentSeverity]; !ok {
+			return fmt.Errorf("invalid minimum sentiment severity %q", rule.MinSentimentSeverity)
+		}
+	}
+
+	return nil
+}
+
+func validateAlertExpression(expr *models.AlertExpression) error {
+	operands := lo.Count([]bool{
+		expr.Keyword != "", expr.Phrase != "", expr.Regex != "",
+		len(expr.And) > 0, len(expr.Or) > 0, expr.Not != nil,
+	}, true)
+	if operands != 1 {
+		return errors.New("every rule expression needs exactly one of keyword, phrase, regex, and, or & not")
+	}
+
+	if expr.Regex != "" {
+		if _, err := regexp.Compile(expr.Regex); err != nil {
+			return fmt.Errorf("invalid regex %q: %w", expr.Regex, err)
+		}
+	}
+
+	for _, child := range append(append(expr.And, expr.Or...), expr.Not) {
+		if child == nil {
+			continue
+		}
+
+		if err := validateAlertExpression(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchContent checks a message's content against the alert's keywords & rule expression,
+// returning a description of what matched
+func matchContent(alert *models.ConversationAlert, content string) (string, bool) {
+	for _, keyword := range alert.Keywords {
+		if matchesKeyword(content, keyword) {
+			return fmt.Sprintf("keyword \"%s\"", keyword), true
+		}
+	}
+
+	if alert.Rule.Match != nil && matchesExpression(alert.Rule.Match, content) {
+		return fmt.Sprintf("alert \"%s\"", alert.Name), true
+	}
+
+	return "", false
+}
+
+func matchesExpression(expr *models.AlertExpression, content string) bool {
+	switch {
+	case expr.Keyword != "":
+		return matchesKeyword(content, expr.Keyword)
+	case expr.Phrase != "":
+		return strings.Contains(strings.ToLower(content), strings.ToLower(expr.Phrase))
+	case expr.Regex != "":
+		regex, err := compileRegex(expr.Regex)
+		return err == nil && regex.MatchString(content)
+	case len(expr.And) > 0:
+		return lo.EveryBy(expr.And, func(child *models.AlertExpression) bool {
+			return matchesExpression(child, content)
+		})
+	case len(expr.Or) > 0:
+		return lo.SomeBy(expr.Or, func(child *models.AlertExpression) bool {
+			return matchesExpression(child, content)
+		})
+	case expr.Not != nil:
+		return !matchesExpression(expr.Not, content)
+	}
+
+	return false
+}
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if regex, ok := compiledRegexes.Load(pattern); ok {
+		return regex.(*regexp.Regexp), nil
+	}
+
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledRegexes.Store(pattern, regex)
+	return regex, nil
+}
+
+// matchesKeyword checks whether the words of the keyword appear in sequence in the content,
+// ignoring case & punctuation
+func matchesKeyword(content, keyword string) bool {
+	contentWords, keywordWords := splitWords(content), splitWords(keyword)
+	if len(keywordWords) == 0 {
+		return false
+	}
+
+	phrase := strings.Join(keywordWords, " ")
+	for i := 0; i+len(keywordWords) <= len(contentWords); i++ {
+		if strings.Join(contentWords[i:i+len(keywordWords)], " ") == phrase {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ruleFilter applies the channel, author, role & sentiment filters of alert rules,
+// caching the Discord & LLM lookups they need across alerts
+type ruleFilter struct {
+	discordClient *discordgo.Session
+	llmService    *llmservice.Service
+	memberRoles   map[string][]string
+	sentiments    map[string]models.MessageSentiment
+}
+
+func (s *Service) newRuleFilter() *ruleFilter {
+	return &ruleFilter{
+		discordClient: s.discordClient,
+		llmService:    s.llmService,
+		memberRoles:   map[string][]string{},
+		sentiments:    map[string]models.MessageSentiment{},
+	}
+}
+
+// passes checks the filters from cheapest to most expensive, so the LLM is only asked when needed
+func (f *ruleFilter) passes(
+	ctx context.Context, alert *models.ConversationAlert, message *models.DiscordRawMessage,
+) (bool, error) {
+	rule := alert.Rule
+	if !watchesChannel(alert, message.ChannelID) || lo.Contains(rule.ExcludeChannelIDs, message.ChannelID) {
+		return false, nil
+	}
+
+	if len(rule.IncludeAuthorIDs) > 0 && !lo.Contains(rule.IncludeAuthorIDs, message.AuthorID) {
+		return false, nil
+	} else if lo.Contains(rule.ExcludeAuthorIDs, message.AuthorID) {
+		return false, nil
+	}
+
+	if len(rule.IncludeRoleIDs) > 0 || len(rule.ExcludeRoleIDs) > 0 {
+		roles, err := f.getMemberRoles(message.GuildID, message.AuthorID)
+		if err != nil {
+			return false, err
+		}
+
+		if len(rule.IncludeRoleIDs) > 0 && len(lo.Intersect(rule.IncludeRoleIDs, roles)) == 0 {
+			return false, nil
+		} else if len(lo.Intersect(rule.ExcludeRoleIDs, roles)) > 0 {
+			return false, nil
+		}
+	}
+
+	if rule.MinSentimentSeverity != "" {
+		sentiment, err := f.getSentiment(ctx, message)
+		if err != nil {
+			return false, err
+		}
+
+		if sentimentSeverity[sentiment] < sentimentSeverity[rule.MinSentimentSeverity] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (f *ruleFilter) getMemberRoles(guildID, userID string) ([]string, error) {
+	key := guildID + ":" + userID
+	if roles, ok := f.memberRoles[key]; ok {
+		return roles, nil
+	}
+
+	member, err := f.discordClient.GuildMember(guildID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get guild member: %w", err)
+	}
+
+	f.memberRoles[key] = member.Roles
+	return member.Roles, nil
+}
+
+func (f *ruleFilter) getSentiment(
+	ctx context.Context, message *models.DiscordRawMessage,
+) (models.MessageSentiment, error) {
+	if sentiment, ok := f.sentiments[message.ID]; ok {
+		return sentiment, nil
+	}
+
+	sentiment, err := f.llmService.EvaluateMessageSentiment(ctx, message)
+	if err != nil {
+		return "", fmt.Errorf("couldn't evaluate message sentiment: %w", err)
+	}
+
+	f.sentiments[message.ID] = sentiment
+	return sentiment, nil
+}
+
+func watchesChannel(alert *models.ConversationAlert, channelID string) bool {
+	return len(alert.WatchedChannelIDs) == 0 || lo.Contains(alert.WatchedChannelIDs, channelID)
+}
@@ -0,0 +1,135 @@
+package conversationalerter
+
+import (
+	"testing"
+
+	"encore.app/models"
+)
+
+func TestValidateAlertRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    *models.AlertRule
+		wantErr bool
+	}{
+		{
+			name: "empty rule",
+			rule: &models.AlertRule{},
+		},
+		{
+			name: "nested expression",
+			rule: &models.AlertRule{Match: &models.AlertExpression{
+				And: []*models.AlertExpression{
+					{Keyword: "deploy"},
+					{Or: []*models.AlertExpression{{Phrase: "is down"}, {Regex: `error \d+`}}},
+					{Not: &models.AlertExpression{Keyword: "resolved"}},
+				},
+			}},
+		},
+		{
+			name:    "expression without operand",
+			rule:    &models.AlertRule{Match: &models.AlertExpression{}},
+			wantErr: true,
+		},
+		{
+			name:    "expression with several operands",
+			rule:    &models.AlertRule{Match: &models.AlertExpression{Keyword: "deploy", Phrase: "is down"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid regex",
+			rule:    &models.AlertRule{Match: &models.AlertExpression{Regex: "error ("}},
+			wantErr: true,
+		},
+		{
+			name: "invalid nested expression",
+			rule: &models.AlertRule{Match: &models.AlertExpression{
+				Or: []*models.AlertExpression{{Keyword: "deploy"}, {Not: &models.AlertExpression{}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "valid sentiment severity",
+			rule: &models.AlertRule{MinSentimentSeverity: models.MessageSentimentNegative},
+		},
+		{
+			name:    "invalid sentiment severity",
+			rule:    &models.AlertRule{MinSentimentSeverity: "ANGRY"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAlertRule(tt.rule); (err != nil) != tt.wantErr {
+				t.Errorf("validateAlertRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchesExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    *models.AlertExpression
+		content string
+		want    bool
+	}{
+		{
+			name:    "keyword ignores case & punctuation",
+			expr:    &models.AlertExpression{Keyword: "node js"},
+			content: "Is Node.js supported?",
+			want:    true,
+		},
+		{
+			name:    "keyword only matches whole words",
+			expr:    &models.AlertExpression{Keyword: "bug"},
+			content: "debugging the app",
+			want:    false,
+		},
+		{
+			name:    "phrase",
+			expr:    &models.AlertExpression{Phrase: "is down"},
+			content: "The API IS DOWN again",
+			want:    true,
+		},
+		{
+			name:    "regex",
+			expr:    &models.AlertExpression{Regex: `error \d+`},
+			content: "got error 502",
+			want:    true,
+		},
+		{
+			name: "and needs every child",
+			expr: &models.AlertExpression{
+				And: []*models.AlertExpression{{Keyword: "deploy"}, {Keyword: "failed"}},
+			},
+			content: "the deploy went fine",
+			want:    false,
+		},
+		{
+			name: "or needs one child",
+			expr: &models.AlertExpression{
+				Or: []*models.AlertExpression{{Keyword: "outage"}, {Keyword: "down"}},
+			},
+			content: "the site is down",
+			want:    true,
+		},
+		{
+			name: "not",
+			expr: &models.AlertExpression{
+				And: []*models.AlertExpression{{Keyword: "down"}, {Not: &models.AlertExpression{Keyword: "resolved"}}},
+			},
+			content: "the site was down, resolved now",
+			want:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesExpression(tt.expr, tt.content); got != tt.want {
+				t.Errorf("matchesExpression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
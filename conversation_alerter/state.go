@@ -0,0 +1,445 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.dev/storage/sqldb"
+	"github.com/bwmarrin/discordgo"
+)
+
+func listActiveConversationAlerts(ctx context.Context) ([]*models.ConversationAlert, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+conversationAlertColumns+`
+		FROM conversation_alerts
+		WHERE NOT paused
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get conversation alerts: %w", err)
+	}
+	defer rows.Close()
+
+	conversationAlerts, err := models.MapConversationAlertsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map conversation alerts: %w", err)
+	}
+
+	return conversationAlerts, nil
+}
+
+func queueMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO alert_message_queue (message_id, channel_id, guild_id, author_id, content, clean_content)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (message_id) DO NOTHING
+	`, message.ID, message.ChannelID, message.GuildID, message.AuthorID, message.Content, message.CleanContent)
+	if err != nil {
+		return fmt.Errorf("couldn't queue message: %w", err)
+	}
+
+	return nil
+}
+
+// queuedMessage is a message in the queue of topic alerts, seq is its position in the queue
+type queuedMessage struct {
+	*models.DiscordRawMessage
+	Seq int64
+}
+
+// listQueuedMessages lists the queued messages after the alert's high-water mark,
+// which were received after the alert was created & before settledBefore.
+// The mark advances on the queue's sequence rather than on message ids or timestamps,
+// so a message which arrives late is still after the mark.
+func listQueuedMessages(
+	ctx context.Context, alert *models.ConversationAlert, settledBefore time.Time, limit int,
+) ([]*queuedMessage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT q.seq, q.message_id, q.channel_id, q.guild_id, q.author_id, q.content, q.clean_content, q.received_at
+		FROM alert_message_queue q
+		LEFT JOIN alert_high_water_marks hwm ON hwm.alert_id = $1
+		WHERE q.seq > COALESCE(hwm.last_seq, 0)
+		  AND q.received_at >= $2 AND q.received_at < $3
+		  AND (CARDINALITY($4::TEXT[]) = 0 OR q.channel_id = ANY($4))
+		ORDER BY q.seq
+		LIMIT $5
+	`, alert.ID, alert.CreatedAt.UTC(), settledBefore.UTC(), alert.WatchedChannelIDs, limit)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get queued messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []*queuedMessage{}
+	for rows.Next() {
+		message := queuedMessage{DiscordRawMessage: &models.DiscordRawMessage{}}
+		var receivedAt time.Time
+		err := rows.Scan(&message.Seq, &message.ID, &message.ChannelID, &message.GuildID,
+			&message.AuthorID, &message.Content, &message.CleanContent, &receivedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan queued message: %w", err)
+		}
+
+		message.CreatedAt = receivedAt.Format(time.RFC3339)
+		messages = append(messages, &message)
+	}
+
+	return messages, rows.Err()
+}
+
+func advanceHighWaterMark(ctx context.Context, alertID string, seq int64) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO alert_high_water_marks (alert_id, last_seq)
+		VALUES ($1, $2)
+		ON CONFLICT (alert_id) DO UPDATE SET
+			last_seq = GREATEST(alert_high_water_marks.last_seq, EXCLUDED.last_seq),
+			updated_at = now()
+	`, alertID, seq)
+	if err != nil {
+		return fmt.Errorf("couldn't advance high-water mark: %w", err)
+	}
+
+	return nil
+}
+
+// pruneMessageQueue removes the messages received before the given time which every active topic alert
+// has been evaluated against. Messages an active alert hasn't seen yet are kept, however old they are.
+func pruneMessageQueue(ctx context.Context, before time.Time) (int64, error) {
+	result, err := db.Exec(ctx, `
+		DELETE FROM alert_message_queue q
+		WHERE q.received_at < $1
+		  AND NOT EXISTS (
+			SELECT 1
+			FROM conversation_alerts a
+			LEFT JOIN alert_high_water_marks hwm ON hwm.alert_id = a.id
+			WHERE NOT a.paused AND CARDINALITY(a.topics) > 0
+			  AND q.received_at >= a.created_at
+			  AND (CARDINALITY(a.watched_channel_ids) = 0 OR q.channel_id = ANY(a.watched_channel_ids))
+			  AND q.seq > COALESCE(hwm.last_seq, 0)
+		  )
+	`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("couldn't prune message queue: %w", err)
+	}
+
+	return result.RowsAffected(), nil
+}
+
+// countQueueBacklog counts the settled messages an alert still has to be evaluated against
+func countQueueBacklog(ctx context.Context, alert *models.ConversationAlert, settledBefore time.Time) (int, error) {
+	var count int
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM alert_message_queue q
+		LEFT JOIN alert_high_water_marks hwm ON hwm.alert_id = $1
+		WHERE q.seq > COALESCE(hwm.last_seq, 0)
+		  AND q.received_at >= $2 AND q.received_at < $3
+		  AND (CARDINALITY($4::TEXT[]) = 0 OR q.channel_id = ANY($4))
+	`, alert.ID, alert.CreatedAt.UTC(), settledBefore.UTC(), alert.WatchedChannelIDs).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't count queued messages: %w", err)
+	}
+
+	return count, nil
+}
+
+// alertMatch is a message matched by an alert, waiting to be or already delivered
+type alertMatch struct {
+	MessageID string
+	ChannelID string
+	GuildID   string
+	AuthorID  string
+	Content   string
+	MatchedBy string
+	MatchedAt time.Time
+}
+
+// recordMatches stores the messages matched by an alert for delivery.
+// Messages the alert matched before are ignored, so they're never delivered twice.
+func recordMatches(
+	ctx context.Context, alertID string, messages []*models.DiscordRawMessage, matchedBy string,
+) (int, error) {
+	recorded := 0
+	for _, message := range messages {
+		result, err := db.Exec(ctx, `
+			INSERT INTO alert_matches (alert_id, message_id, channel_id, guild_id, author_id, content, matched_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (alert_id, message_id) DO NOTHING
+		`, alertID, message.ID, message.ChannelID, message.GuildID, message.AuthorID, message.Content, matchedBy)
+		if err != nil {
+			return 0, fmt.Errorf("couldn't record alert match: %w", err)
+		}
+
+		recorded += int(result.RowsAffected())
+	}
+
+	return recorded, nil
+}
+
+func listPendingMatches(ctx context.Context, tx *sqldb.Tx, alertID string) ([]*alertMatch, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT message_id, channel_id, guild_id, author_id, content, matched_by, matched_at
+		FROM alert_matches
+		WHERE alert_id = $1 AND delivered_at IS NULL
+		ORDER BY matched_at
+	`, alertID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get pending alert matches: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAlertMatches(rows)
+}
+
+func scanAlertMatches(rows *sqldb.Rows) ([]*alertMatch, error) {
+	matches := []*alertMatch{}
+	for rows.Next() {
+		var match alertMatch
+		err := rows.Scan(&match.MessageID, &match.ChannelID, &match.GuildID, &match.AuthorID,
+			&match.Content, &match.MatchedBy, &match.MatchedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan alert match: %w", err)
+		}
+
+		matches = append(matches, &match)
+	}
+
+	return matches, rows.Err()
+}
+
+func markMatchesDelivered(
+	ctx context.Context, tx *sqldb.Tx, alertID string, notificationID int64, messageIDs []string,
+) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE alert_matches
+		SET delivered_at = now(), notification_id = $2
+		WHERE alert_id = $1 AND message_id = ANY($3)
+	`, alertID, notificationID, messageIDs)
+	if err != nil {
+		return fmt.Errorf("couldn't mark alert matches as delivered: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE conversation_alerts SET last_notified_at = now() WHERE id = $1", alertID)
+	if err != nil {
+		return fmt.Errorf("couldn't update last notification time: %w", err)
+	}
+
+	return nil
+}
+
+const alertNotificationColumns = `
+	id, alert_id, discord_channel_id, discord_message_id, match_count, status,
+	assignee_id, handled_by, snoozed_until, first_response_at, created_at, updated_at`
+
+func addNotification(ctx context.Context, tx *sqldb.Tx, alertID string, matchCount int) (int64, error) {
+	var id int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO alert_notifications (alert_id, match_count)
+		VALUES ($1, $2)
+		RETURNING id
+	`, alertID, matchCount).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't add alert notification: %w", err)
+	}
+
+	return id, nil
+}
+
+// markNotificationSent stores the Discord message a notification was sent as
+func markNotificationSent(ctx context.Context, id int64, channelID, messageID string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE alert_notifications
+		SET discord_channel_id = $2, discord_message_id = $3, sent_at = now()
+		WHERE id = $1
+	`, id, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("couldn't mark alert notification as sent: %w", err)
+	}
+
+	return nil
+}
+
+// listNotificationRecipients returns the DMs a notification was already sent as, by user
+func listNotificationRecipients(ctx context.Context, notificationID int64) (map[string]*discordgo.Message, error) {
+	rows, err := db.Query(ctx, `
+		SELECT user_id, discord_channel_id, discord_message_id
+		FROM alert_notification_recipients
+		WHERE notification_id = $1
+	`, notificationID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get alert notification recipients: %w", err)
+	}
+	defer rows.Close()
+
+	recipients := make(map[string]*discordgo.Message)
+	for rows.Next() {
+		var userID string
+		var message discordgo.Message
+		if err := rows.Scan(&userID, &message.ChannelID, &message.ID); err != nil {
+			return nil, fmt.Errorf("couldn't scan alert notification recipient: %w", err)
+		}
+
+		recipients[userID] = &message
+	}
+
+	return recipients, rows.Err()
+}
+
+func addNotificationRecipient(ctx context.Context, notificationID int64, userID string, message *discordgo.Message) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO alert_notification_recipients (notification_id, user_id, discord_channel_id, discord_message_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (notification_id, user_id) DO NOTHING
+	`, notificationID, userID, message.ChannelID, message.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't add alert notification recipient: %w", err)
+	}
+
+	return nil
+}
+
+// recordNotificationAttempt records a failed attempt to send a notification & schedules the next one,
+// or marks the notification as failed once it's out of attempts. It returns the attempts made so far.
+func recordNotificationAttempt(ctx context.Context, id int64, sendErr error) (int, error) {
+	var attempts int
+	err := db.QueryRow(ctx, `
+		UPDATE alert_notifications
+		SET attempts = attempts + 1, last_error = $2, updated_at = now()
+		WHERE id = $1
+		RETURNING attempts
+	`, id, sendErr.Error()).Scan(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't record alert notification attempt: %w", err)
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE alert_notifications
+		SET next_attempt_at = $2, status = CASE WHEN $3 THEN $4 ELSE status END
+		WHERE id = $1
+	`, id, time.Now().Add(notificationRetryDelay(attempts)).UTC(), attempts >= maxNotificationAttempts,
+		models.AlertNotificationStatusFailed)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't schedule alert notification attempt: %w", err)
+	}
+
+	return attempts, nil
+}
+
+// unsentNotification is a notification which was stored but not sent to Discord yet
+type unsentNotification struct {
+	ID      int64
+	AlertID string
+}
+
+// listUnsentNotifications lists the notifications created before the given time which weren't sent yet,
+// leaving out the failed ones & those waiting for their next attempt
+func listUnsentNotifications(ctx context.Context, createdBefore time.Time) ([]*unsentNotification, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, alert_id
+		FROM alert_notifications
+		WHERE sent_at IS NULL AND status <> $2 AND created_at < $1
+		  AND (next_attempt_at IS NULL OR next_attempt_at <= $3)
+		ORDER BY id
+	`, createdBefore.UTC(), models.AlertNotificationStatusFailed, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get unsent alert notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := []*unsentNotification{}
+	for rows.Next() {
+		var notification unsentNotification
+		if err := rows.Scan(&notification.ID, &notification.AlertID); err != nil {
+			return nil, fmt.Errorf("couldn't scan alert notification: %w", err)
+		}
+
+		notifications = append(notifications, &notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+func listNotificationMatches(ctx context.Context, notificationID int64) ([]*alertMatch, error) {
+	rows, err := db.Query(ctx, `
+		SELECT message_id, channel_id, guild_id, author_id, content, matched_by, matched_at
+		FROM alert_matches
+		WHERE notification_id = $1
+		ORDER BY matched_at
+	`, notificationID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get alert notification matches: %w", err)
+	}
+	defer rows.Close()
+
+	return scanAlertMatches(rows)
+}
+
+// updateNotification applies a triage action of a moderator to a notification
+func updateNotification(
+	ctx context.Context, id int64, action, userID string, snoozeDuration time.Duration,
+) (*models.AlertNotification, error) {
+	var query string
+	args := []any{id, userID}
+	switch action {
+	case triageActionAcknowledge:
+		query = `
+			UPDATE alert_notifications
+			SET status = 'ACKNOWLEDGED', handled_by = $2, snoozed_until = NULL,
+				first_response_at = COALESCE(first_response_at, now()), updated_at = now()
+			WHERE id = $1`
+	case triageActionAssign:
+		query = `
+			UPDATE alert_notifications
+			SET assignee_id = $2, first_response_at = COALESCE(first_response_at, now()), updated_at = now()
+			WHERE id = $1`
+	case triageActionSnooze:
+		query = `
+			UPDATE alert_notifications
+			SET status = 'SNOOZED', snoozed_until = now() + $2 * INTERVAL '1 second', updated_at = now()
+			WHERE id = $1`
+		args = []any{id, snoozeDuration.Seconds()}
+	case triageActionFalsePositive:
+		query = `
+			UPDATE alert_notifications
+			SET status = 'FALSE_POSITIVE', handled_by = $2, snoozed_until = NULL,
+				first_response_at = COALESCE(first_response_at, now()), updated_at = now()
+			WHERE id = $1`
+	default:
+		return nil, fmt.Errorf("unknown triage action %q", action)
+	}
+
+	rows, err := db.Query(ctx, query+" RETURNING "+alertNotificationColumns, args...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update alert notification: %w", err)
+	}
+	defer rows.Close()
+
+	notifications, err := models.MapAlertNotificationsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map alert notification: %w", err)
+	} else if len(notifications) == 0 {
+		return nil, sqldb.ErrNoRows
+	}
+
+	return notifications[0], nil
+}
+
+// reopenSnoozedNotifications reopens the notifications whose snooze ran out & returns them
+func reopenSnoozedNotifications(ctx context.Context) ([]*models.AlertNotification, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE alert_notifications
+		SET status = 'OPEN', snoozed_until = NULL, updated_at = now()
+		WHERE status = 'SNOOZED' AND snoozed_until <= now()
+		RETURNING `+alertNotificationColumns)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't reopen snoozed alert notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications, err := models.MapAlertNotificationsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map alert notifications: %w", err)
+	}
+
+	return notifications, nil
+}
@@ -0,0 +1,186 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"encore.app/models"
+	"github.com/samber/lo"
+)
+
+// These tests use the service's database, run them with `encore test`.
+
+func TestListQueuedMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		// queued are the ids of the messages queued before the mark is advanced
+		queued []string
+		// advanceTo are the messages the mark is advanced to, in order
+		advanceTo []string
+		// queuedLate are queued after the mark was advanced, with a receive time before the other messages
+		queuedLate []string
+		limit      int
+		want       []string
+	}{
+		{
+			name:   "without a mark every message is listed in queue order",
+			queued: []string{"a", "b", "c"},
+			limit:  10,
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:      "messages up to the mark are skipped",
+			queued:    []string{"a", "b", "c"},
+			advanceTo: []string{"a"},
+			limit:     10,
+			want:      []string{"b", "c"},
+		},
+		{
+			name:       "messages queued late are still after the mark",
+			queued:     []string{"a", "b"},
+			advanceTo:  []string{"b"},
+			queuedLate: []string{"c"},
+			limit:      10,
+			want:       []string{"c"},
+		},
+		{
+			name:      "the mark never moves back",
+			queued:    []string{"a", "b"},
+			advanceTo: []string{"b", "a"},
+			limit:     10,
+			want:      []string{},
+		},
+		{
+			name:   "the limit caps the batch",
+			queued: []string{"a", "b", "c"},
+			limit:  2,
+			want:   []string{"a", "b"},
+		},
+	}
+
+	ctx := context.Background()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each case watches its own channel, so it only sees its own messages
+			channelID := fmt.Sprintf("hwm-channel-%d", i)
+			alert := createTestTopicAlert(t, channelID)
+			messageID := func(id string) string {
+				return fmt.Sprintf("hwm-%d-%s", i, id)
+			}
+
+			for _, id := range tt.queued {
+				queueTestMessage(t, messageID(id), channelID, time.Now())
+			}
+
+			for _, id := range tt.advanceTo {
+				var seq int64
+				err := db.QueryRow(ctx, "SELECT seq FROM alert_message_queue WHERE message_id = $1", messageID(id)).Scan(&seq)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := advanceHighWaterMark(ctx, alert.ID, seq); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, id := range tt.queuedLate {
+				queueTestMessage(t, messageID(id), channelID, time.Now().Add(-10*time.Minute))
+			}
+
+			messages, err := listQueuedMessages(ctx, alert, time.Now().Add(time.Minute), tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := lo.Map(messages, func(message *queuedMessage, _ int) string {
+				return message.ID
+			})
+			want := lo.Map(tt.want, func(id string, _ int) string {
+				return messageID(id)
+			})
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("listQueuedMessages() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneMessageQueueKeepsUnevaluatedMessages(t *testing.T) {
+	ctx := context.Background()
+	channelID := "prune-channel"
+	alert := createTestTopicAlert(t, channelID)
+
+	old := time.Now().Add(-2 * messageQueueRetention)
+	for _, id := range []string{"prune-a", "prune-b"} {
+		queueTestMessage(t, id, channelID, old)
+	}
+
+	var seq int64
+	if err := db.QueryRow(ctx, "SELECT seq FROM alert_message_queue WHERE message_id = 'prune-a'").Scan(&seq); err != nil {
+		t.Fatal(err)
+	}
+	if err := advanceHighWaterMark(ctx, alert.ID, seq); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pruneMessageQueue(ctx, time.Now().Add(-messageQueueRetention)); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	rows, err := db.Query(ctx, "SELECT message_id FROM alert_message_queue WHERE channel_id = $1", channelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, id)
+	}
+
+	if fmt.Sprint(remaining) != "[prune-b]" {
+		t.Errorf("remaining queued messages = %v, want [prune-b]", remaining)
+	}
+}
+
+// createTestTopicAlert creates an active topic alert watching the channel, created before the test messages
+func createTestTopicAlert(t *testing.T, channelID string) *models.ConversationAlert {
+	t.Helper()
+
+	alert := &models.ConversationAlert{
+		WatchedChannelIDs: []string{channelID},
+		CreatedAt:         time.Now().Add(-3 * messageQueueRetention),
+	}
+	err := db.QueryRow(context.Background(), `
+		INSERT INTO conversation_alerts (name, topics, keywords, watched_channel_ids, created_at)
+		VALUES ('test', '{bugs}', '{}', $1, $2)
+		RETURNING id
+	`, alert.WatchedChannelIDs, alert.CreatedAt.UTC()).Scan(&alert.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return alert
+}
+
+func queueTestMessage(t *testing.T, id, channelID string, receivedAt time.Time) {
+	t.Helper()
+
+	ctx := context.Background()
+	err := queueMessage(ctx, &models.DiscordCommunityMessageEvent{ID: id, ChannelID: channelID, Content: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(ctx, "UPDATE alert_message_queue SET received_at = $2 WHERE message_id = $1", id, receivedAt.UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
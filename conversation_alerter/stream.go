@@ -0,0 +1,100 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+
+	communitymessagemapper "encore.app/community_message_mapper"
+	deadletterqueue "encore.app/dead_letter_queue"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+)
+
+const alerterSubscription = "conversation-alerter"
+
+var _ = pubsub.NewSubscription(
+	communitymessagemapper.DiscordCommunityMessageTopic,
+	"conversation-alerter",
+	pubsub.SubscriptionConfig[*models.DiscordCommunityMessageEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-community-messages", alerterSubscription, 5, handleCommunityMessage),
+	})
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"conversation-alerter-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			switch evt.Subscription {
+			case alerterSubscription:
+				return deadletter.Replay(ctx, evt, handleCommunityMessage)
+			case interactionsSubscription:
+				return deadletter.Replay(ctx, evt, handleInteraction)
+			case userErasureSubscription:
+				return deadletter.Replay(ctx, evt, eraseUserAlertData)
+			}
+
+			return nil
+		},
+	})
+
+func handleCommunityMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
+	service, err := NewService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleCommunityMessage(ctx, message)
+}
+
+// HandleCommunityMessage evaluates keyword & rule alerts against a new message right away
+// & queues it for the next micro-batch of topic alerts
+func (s *Service) HandleCommunityMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
+	// queue first, so a failing keyword alert doesn't keep the message from topic alerts on retries
+	if err := queueMessage(ctx, message); err != nil {
+		return err
+	}
+
+	conversationAlerts, err := listActiveConversationAlerts(ctx)
+	if err != nil {
+		return err
+	}
+
+	rawMessage := &models.DiscordRawMessage{
+		ID:              message.ID,
+		InteractionType: message.InteractionType,
+		ChannelID:       message.ChannelID,
+		GuildID:         message.GuildID,
+		AuthorID:        message.AuthorID,
+		Content:         message.Content,
+		CleanContent:    message.CleanContent,
+	}
+
+	filter := s.newRuleFilter()
+	for _, alert := range conversationAlerts {
+		matchedBy, ok := matchContent(alert, message.Content)
+		if !ok {
+			continue
+		}
+
+		passes, err := filter.passes(ctx, alert, rawMessage)
+		if err != nil {
+			return err
+		} else if !passes {
+			continue
+		}
+
+		err = s.recordAndDeliverMatches(ctx, alert, []*models.DiscordRawMessage{rawMessage}, matchedBy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package conversationalerter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/discord_handler"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+)
+
+const alertCustomIDPrefix = "conversation-alert"
+const snoozeDuration = time.Hour
+
+const (
+	triageActionAcknowledge   = "acknowledge"
+	triageActionAssign        = "assign"
+	triageActionSnooze        = "snooze"
+	triageActionFalsePositive = "false-positive"
+)
+
+const interactionsSubscription = "conversation-alerter-interactions"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordInteractionTopic,
+	"conversation-alerter-interactions",
+	pubsub.SubscriptionConfig[*models.DiscordInteractionEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-interactions", interactionsSubscription, 5, handleInteraction),
+	})
+
+func handleInteraction(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	service, err := NewService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleInteraction(ctx, interaction)
+}
+
+// HandleInteraction handles the triage buttons of alert notifications
+func (s *Service) HandleInteraction(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	if interaction.Type != discordgo.InteractionMessageComponent ||
+		!strings.HasPrefix(interaction.CustomID, alertCustomIDPrefix+":") {
+		return nil
+	}
+
+	// custom IDs have the format conversation-alert:<action>:<notification id>
+	parts := strings.SplitN(interaction.CustomID, ":", 3)
+	if len(parts) != 3 {
+		rlog.Warn("Ignoring malformed alert custom id", "customId", interaction.CustomID)
+		return nil
+	}
+
+	notificationID, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		rlog.Warn("Ignoring malformed alert notification id", "customId", interaction.CustomID)
+		return nil
+	}
+
+	notification, err := updateNotification(ctx, notificationID, parts[1], interaction.UserID, snoozeDuration)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		rlog.Warn("Ignoring triage action for unknown notification", "notificationId", notificationID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.discordClient.InteractionResponseEdit(interaction.Interaction(), &discordgo.WebhookEdit{
+		Content:    lo.ToPtr(formatTriageStatus(notification)),
+		Components: lo.ToPtr(triageComponents(notification)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't update alert notification message: %w", err)
+	}
+
+	return nil
+}
+
+// triageComponents returns the buttons of a notification, which are removed once it's handled
+func triageComponents(notification *models.AlertNotification) []discordgo.MessageComponent {
+	if notification.Status == models.AlertNotificationStatusAcknowledged ||
+		notification.Status == models.AlertNotificationStatusFalsePositive {
+		return []discordgo.MessageComponent{}
+	}
+
+	customID := func(action string) string {
+		return fmt.Sprintf("%s:%s:%d", alertCustomIDPrefix, action, notification.ID)
+	}
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Acknowledge",
+					Style:    discordgo.SuccessButton,
+					CustomID: customID(triageActionAcknowledge),
+				},
+				discordgo.Button{
+					Label:    "Assign to me",
+					Style:    discordgo.PrimaryButton,
+					CustomID: customID(triageActionAssign),
+				},
+				discordgo.Button{
+					Label:    "Snooze 1h",
+					Style:    discordgo.SecondaryButton,
+					CustomID: customID(triageActionSnooze),
+				},
+				discordgo.Button{
+					Label:    "Mark false positive",
+					Style:    discordgo.DangerButton,
+					CustomID: customID(triageActionFalsePositive),
+				},
+			},
+		},
+	}
+}
+
+func formatTriageStatus(notification *models.AlertNotification) string {
+	var status string
+	switch notification.Status {
+	case models.AlertNotificationStatusAcknowledged:
+		status = fmt.Sprintf("✅ Acknowledged by <@%s>", notification.HandledBy)
+	case models.AlertNotificationStatusFalsePositive:
+		status = fmt.Sprintf("🚫 Marked as false positive by <@%s>", notification.HandledBy)
+	case models.AlertNotificationStatusSnoozed:
+		status = fmt.Sprintf("💤 Snoozed until <t:%d:t>", notification.SnoozedUntil.Unix())
+	default:
+		status = "🔔 Open"
+	}
+
+	if notification.AssigneeID != "" {
+		status += fmt.Sprintf(" · assigned to <@%s>", notification.AssigneeID)
+	}
+
+	return status
+}
+
+// remindSnoozedNotifications reopens snoozed notifications which are due & replies to them as a reminder
+func (s *Service) remindSnoozedNotifications(ctx context.Context) error {
+	notifications, err := reopenSnoozedNotifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, notification := range notifications {
+		if notification.DiscordMessageID == "" {
+			continue
+		}
+
+		_, err := s.discordClient.ChannelMessageSendReply(notification.DiscordChannelID,
+			"⏰ This alert is open again, please take a look.", &discordgo.MessageReference{
+				MessageID: notification.DiscordMessageID,
+				ChannelID: notification.DiscordChannelID,
+			})
+		if err != nil {
+			rlog.Error("Couldn't send snooze reminder", "notificationId", notification.ID, "error", err)
+			continue
+		}
+
+		_, err = s.discordClient.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:         notification.DiscordMessageID,
+			Channel:    notification.DiscordChannelID,
+			Content:    lo.ToPtr(formatTriageStatus(notification)),
+			Components: lo.ToPtr(triageComponents(notification)),
+		})
+		if err != nil {
+			rlog.Error("Couldn't update snoozed notification", "notificationId", notification.ID, "error", err)
+		}
+	}
+
+	return nil
+}
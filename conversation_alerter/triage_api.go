@@ -0,0 +1,153 @@
+package conversationalerter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"encore.app/models"
+	"github.com/samber/lo"
+)
+
+type ListAlertNotificationsRequest struct {
+	Status  string `query:"status"`
+	AlertID int    `query:"alert_id"`
+}
+
+type ListAlertNotificationsResponse struct {
+	Notifications []*models.AlertNotification `json:"notifications"`
+	// AverageResponseSeconds & MedianResponseSeconds cover the listed notifications moderators responded to
+	AverageResponseSeconds *float64 `json:"averageResponseSeconds"`
+	MedianResponseSeconds  *float64 `json:"medianResponseSeconds"`
+}
+
+// ListAlertNotifications lists delivered alert notifications & their triage state, newest first,
+// optionally filtered by status & alert.
+//
+//encore:api private method=GET path=/conversation-alert-notifications
+func ListAlertNotifications(
+	ctx context.Context, req *ListAlertNotificationsRequest,
+) (*ListAlertNotificationsResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+alertNotificationColumns+`
+		FROM alert_notifications
+		WHERE sent_at IS NOT NULL AND ($1 = '' OR status = $1) AND ($2 = 0 OR alert_id = $2)
+		ORDER BY id DESC
+	`, req.Status, req.AlertID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get alert notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications, err := models.MapAlertNotificationsFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map alert notifications: %w", err)
+	}
+
+	resp := &ListAlertNotificationsResponse{Notifications: notifications}
+	responseSeconds := lo.FilterMap(notifications, func(notification *models.AlertNotification, _ int) (float64, bool) {
+		if notification.ResponseSeconds == nil {
+			return 0, false
+		}
+
+		return *notification.ResponseSeconds, true
+	})
+	if len(responseSeconds) > 0 {
+		sort.Float64s(responseSeconds)
+		average := lo.Sum(responseSeconds) / float64(len(responseSeconds))
+		median := responseSeconds[len(responseSeconds)/2]
+		resp.AverageResponseSeconds, resp.MedianResponseSeconds = &average, &median
+	}
+
+	return resp, nil
+}
+
+type AlertTuningStat struct {
+	// MatchedBy is the keyword, rule or topics which matched
+	MatchedBy         string  `json:"matchedBy"`
+	Matches           int     `json:"matches"`
+	FalsePositives    int     `json:"falsePositives"`
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+type FalsePositiveMatch struct {
+	MessageID string `json:"messageId"`
+	ChannelID string `json:"channelId"`
+	AuthorID  string `json:"authorId"`
+	Content   string `json:"content"`
+	MatchedBy string `json:"matchedBy"`
+}
+
+type GetConversationAlertTuningResponse struct {
+	Stats []*AlertTuningStat `json:"stats"`
+	// RecentFalsePositives are the latest messages moderators marked as false positives,
+	// which can be used to refine the rule & check it with a dry run
+	RecentFalsePositives []*FalsePositiveMatch `json:"recentFalsePositives"`
+}
+
+// GetConversationAlertTuning reports how often each keyword, rule or topic of an alert
+// produced false positives.
+//
+//encore:api private method=GET path=/conversation-alerts/:id/tuning
+func GetConversationAlertTuning(ctx context.Context, id int) (*GetConversationAlertTuningResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT m.matched_by, COUNT(*), COUNT(*) FILTER (WHERE n.status = $2)
+		FROM alert_matches m
+		LEFT JOIN alert_notifications n ON n.id = m.notification_id
+		WHERE m.alert_id = $1 AND m.delivered_at IS NOT NULL AND m.matched_by <> ''
+		GROUP BY m.matched_by
+		ORDER BY 3 DESC, 2 DESC
+	`, id, models.AlertNotificationStatusFalsePositive)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get alert tuning stats: %w", err)
+	}
+
+	resp := &GetConversationAlertTuningResponse{
+		Stats:                []*AlertTuningStat{},
+		RecentFalsePositives: []*FalsePositiveMatch{},
+	}
+	for rows.Next() {
+		var stat AlertTuningStat
+		if err := rows.Scan(&stat.MatchedBy, &stat.Matches, &stat.FalsePositives); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("couldn't scan alert tuning stat: %w", err)
+		}
+
+		stat.FalsePositiveRate = float64(stat.FalsePositives) / float64(stat.Matches)
+		resp.Stats = append(resp.Stats, &stat)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read alert tuning stats: %w", err)
+	}
+
+	rows, err = db.Query(ctx, `
+		SELECT m.message_id, m.channel_id, m.author_id, m.content, m.matched_by
+		FROM alert_matches m
+		JOIN alert_notifications n ON n.id = m.notification_id
+		WHERE m.alert_id = $1 AND n.status = $2
+		ORDER BY n.updated_at DESC
+		LIMIT 20
+	`, id, models.AlertNotificationStatusFalsePositive)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get false positive matches: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var match FalsePositiveMatch
+		err := rows.Scan(&match.MessageID, &match.ChannelID, &match.AuthorID, &match.Content, &match.MatchedBy)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan false positive match: %w", err)
+		}
+
+		resp.RecentFalsePositives = append(resp.RecentFalsePositives, &match)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read false positive matches: %w", err)
+	}
+
+	return resp, nil
+}
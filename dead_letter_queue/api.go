@@ -0,0 +1,165 @@
+package deadletterqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"encore.app/models"
+	"encore.dev/rlog"
+)
+
+const deadLetterColumns = `
+	id, topic, subscription, payload, error, attempts,
+	replay_count, status, created_at, updated_at`
+
+type RecordDeadLetterRequest struct {
+	Topic        string          `json:"topic"`
+	Subscription string          `json:"subscription"`
+	Payload      json.RawMessage `json:"payload"`
+	Error        string          `json:"error"`
+	Attempts     int             `json:"attempts"`
+}
+
+// RecordDeadLetter stores a message which a subscription failed to process.
+//
+//encore:api private method=POST path=/dead-letters
+func RecordDeadLetter(ctx context.Context, req *RecordDeadLetterRequest) (*models.DeadLetter, error) {
+	rows, err := db.Query(ctx, `
+		INSERT INTO dead_letters (topic, subscription, payload, error, attempts)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+deadLetterColumns,
+		req.Topic, req.Subscription, []byte(req.Payload), req.Error, req.Attempts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't insert dead letter: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters, err := models.MapDeadLettersFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map dead letter: %w", err)
+	} else if len(deadLetters) == 0 {
+		return nil, fmt.Errorf("dead letter wasn't inserted")
+	}
+
+	deadLettersRecorded.With(subscriptionLabels{Subscription: req.Subscription}).Increment()
+	rlog.Warn("Recorded dead letter",
+		"id", deadLetters[0].ID, "subscription", req.Subscription, "error", req.Error)
+	return deadLetters[0], nil
+}
+
+type ListDeadLettersRequest struct {
+	Status       string `query:"status"`
+	Subscription string `query:"subscription"`
+}
+
+type ListDeadLettersResponse struct {
+	DeadLetters []*models.DeadLetter `json:"deadLetters"`
+}
+
+// ListDeadLetters lists dead letters, optionally filtered by status & subscription.
+//
+//encore:api private method=GET path=/dead-letters
+func ListDeadLetters(ctx context.Context, req *ListDeadLettersRequest) (*ListDeadLettersResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+deadLetterColumns+`
+		FROM dead_letters
+		WHERE ($1 = '' OR status = $1) AND ($2 = '' OR subscription = $2)
+		ORDER BY id DESC
+	`, req.Status, req.Subscription)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters, err := models.MapDeadLettersFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map dead letters: %w", err)
+	}
+
+	return &ListDeadLettersResponse{DeadLetters: deadLetters}, nil
+}
+
+// GetDeadLetter returns a dead letter together with its payload.
+//
+//encore:api private method=GET path=/dead-letters/:id
+func GetDeadLetter(ctx context.Context, id int64) (*models.DeadLetter, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+deadLetterColumns+`
+		FROM dead_letters
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get dead letter: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters, err := models.MapDeadLettersFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map dead letter: %w", err)
+	} else if len(deadLetters) == 0 {
+		return nil, fmt.Errorf("dead letter %d not found", id)
+	}
+
+	return deadLetters[0], nil
+}
+
+// ReplayDeadLetter sends a dead letter back to the subscription handler which failed processing it.
+//
+//encore:api private method=POST path=/dead-letters/:id/replay
+func ReplayDeadLetter(ctx context.Context, id int64) (*models.DeadLetter, error) {
+	deadLetter, err := GetDeadLetter(ctx, id)
+	if err != nil {
+		return nil, err
+	} else if deadLetter.Status == models.DeadLetterStatusReplayed {
+		return nil, fmt.Errorf("dead letter %d was already replayed", id)
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE dead_letters
+		SET status = $2, replay_count = replay_count + 1, updated_at = now()
+		WHERE id = $1
+	`, id, models.DeadLetterStatusReplaying)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't update dead letter: %w", err)
+	}
+
+	_, err = DeadLetterReplayTopic.Publish(ctx, &models.DeadLetterReplayEvent{
+		DeadLetterID: deadLetter.ID,
+		Subscription: deadLetter.Subscription,
+		Payload:      deadLetter.Payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't publish dead letter replay: %w", err)
+	}
+
+	return GetDeadLetter(ctx, id)
+}
+
+type CompleteDeadLetterReplayRequest struct {
+	// Error is empty if the replayed message was processed successfully
+	Error string `json:"error"`
+}
+
+// CompleteDeadLetterReplay records the outcome of a dead letter replay.
+//
+//encore:api private method=POST path=/dead-letters/:id/complete-replay
+func CompleteDeadLetterReplay(ctx context.Context, id int64, req *CompleteDeadLetterReplayRequest) error {
+	status := models.DeadLetterStatusReplayed
+	errMsg := ""
+	if req.Error != "" {
+		status = models.DeadLetterStatusPending
+		errMsg = req.Error
+	}
+
+	_, err := db.Exec(ctx, `
+		UPDATE dead_letters
+		SET status = $2, error = COALESCE(NULLIF($3, ''), error), updated_at = now()
+		WHERE id = $1
+	`, id, status, errMsg)
+	if err != nil {
+		return fmt.Errorf("couldn't update dead letter: %w", err)
+	}
+
+	return nil
+}
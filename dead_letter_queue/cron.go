@@ -0,0 +1,103 @@
+package deadletterqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"encore.app/models"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"github.com/bwmarrin/discordgo"
+)
+
+var secrets struct {
+	DiscordToken string
+}
+
+var _ = cron.NewJob("check-dead-letter-backlog", cron.JobConfig{
+	Title:    "Check the dead letter backlog",
+	Endpoint: CheckDeadLetterBacklog,
+	Every:    10 * cron.Minute,
+})
+
+// CheckDeadLetterBacklog reports the dead letter backlog size & alerts moderators when it grows.
+//
+//encore:api private method=POST path=/check-dead-letter-backlog
+func CheckDeadLetterBacklog(ctx context.Context) error {
+	var pending, recent int64
+	err := db.QueryRow(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE status <> 'REPLAYED'),
+			COUNT(*) FILTER (WHERE status <> 'REPLAYED' AND created_at > now() - INTERVAL '10 minutes')
+		FROM dead_letters
+	`).Scan(&pending, &recent)
+	if err != nil {
+		return fmt.Errorf("couldn't count dead letters: %w", err)
+	}
+
+	deadLetterBacklog.Set(pending)
+	settings, err := GetDeadLetterSettings(ctx)
+	if err != nil {
+		return err
+	}
+
+	if settings.AlertChannelID == "" || pending < int64(settings.AlertThreshold) || recent == 0 {
+		rlog.Info("Dead letter backlog is fine", "pending", pending, "recent", recent)
+		return nil
+	}
+
+	discordClient, err := discordgo.New("Bot " + secrets.DiscordToken)
+	if err != nil {
+		return fmt.Errorf("couldn't create discord client: %w", err)
+	}
+
+	_, err = discordClient.ChannelMessageSend(settings.AlertChannelID, fmt.Sprintf(
+		"⚠️ The dead letter backlog grew to %d unprocessed events (%d new in the last 10 minutes).",
+		pending, recent))
+	if err != nil {
+		return fmt.Errorf("couldn't send discord message: %w", err)
+	}
+
+	return nil
+}
+
+// GetDeadLetterSettings returns where & when the dead letter backlog alert is sent.
+//
+//encore:api private method=GET path=/dead-letter-settings
+func GetDeadLetterSettings(ctx context.Context) (*models.DeadLetterSettings, error) {
+	settings := &models.DeadLetterSettings{}
+	err := db.QueryRow(ctx, `
+		SELECT alert_channel_id, alert_threshold, updated_at FROM dead_letter_settings
+	`).Scan(&settings.AlertChannelID, &settings.AlertThreshold, &settings.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get dead letter settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+type SetDeadLetterSettingsRequest struct {
+	// AlertChannelID disables the backlog alert if empty
+	AlertChannelID string `json:"alertChannelId"`
+	AlertThreshold int    `json:"alertThreshold"`
+}
+
+// SetDeadLetterSettings sets where & when the dead letter backlog alert is sent.
+//
+//encore:api private method=PUT path=/dead-letter-settings
+func SetDeadLetterSettings(ctx context.Context, req *SetDeadLetterSettingsRequest) (*models.DeadLetterSettings, error) {
+	if req.AlertThreshold <= 0 {
+		return nil, errors.New("please provide a positive alert threshold")
+	}
+
+	_, err := db.Exec(ctx, `
+		UPDATE dead_letter_settings
+		SET alert_channel_id = $1, alert_threshold = $2, updated_at = now()
+	`, req.AlertChannelID, req.AlertThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set dead letter settings: %w", err)
+	}
+
+	return GetDeadLetterSettings(ctx)
+}
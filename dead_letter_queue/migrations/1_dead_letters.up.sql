@@ -0,0 +1,14 @@
+CREATE TABLE dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    subscription VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    error TEXT NOT NULL,
+    attempts INT NOT NULL,
+    replay_count INT NOT NULL DEFAULT 0,
+    status VARCHAR(255) NOT NULL DEFAULT 'PENDING',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_dead_letters_status ON dead_letters (status);
@@ -0,0 +1,10 @@
+-- where & from which backlog size moderators get alerted, a single row
+CREATE TABLE dead_letter_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    alert_channel_id VARCHAR(255) NOT NULL DEFAULT '',
+    alert_threshold INT NOT NULL DEFAULT 10,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- #conversation-alerts
+INSERT INTO dead_letter_settings (alert_channel_id) VALUES ('1234396668837892107');
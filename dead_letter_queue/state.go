@@ -0,0 +1,27 @@
+package deadletterqueue
+
+import (
+	"encore.app/models"
+	"encore.dev/metrics"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+var db = sqldb.NewDatabase("dead_letter_queue", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+// DeadLetterReplayTopic is a pubsub topic for dead letters being replayed.
+// Every service owning a subscription listens to it & passes the payload
+// to the subscription handler which originally failed.
+var DeadLetterReplayTopic = pubsub.NewTopic[*models.DeadLetterReplayEvent]("dead-letter-replays", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+type subscriptionLabels struct {
+	Subscription string
+}
+
+var deadLettersRecorded = metrics.NewCounterGroup[subscriptionLabels, uint64]("dead_letters_recorded", metrics.CounterConfig{})
+
+var deadLetterBacklog = metrics.NewGauge[int64]("dead_letter_backlog", metrics.GaugeConfig{})
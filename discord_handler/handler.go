@@ -1,17 +1,21 @@
 package discord_handler
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"net/http"
 
 	"encore.app/models"
 	"encore.dev/rlog"
+	"github.com/bwmarrin/discordgo"
 )
 
 var secrets struct {
 	DiscordPublicKey          string
 	DiscordHandlerSecretToken string
+	DiscordToken              string
 }
 
 // Webhook receives incoming webhooks from Some Service That Sends Webhooks.
@@ -44,3 +48,130 @@ func DiscordWebhook(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// DiscordThreadUpdateWebhook receives thread updates, ie a forum post being renamed or re-tagged.
+//
+//encore:api public raw method=POST path=/discord-thread-update-webhook
+func DiscordThreadUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+secrets.DiscordHandlerSecretToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	var threadUpdateEvent models.DiscordThreadUpdateEvent
+	if err := json.Unmarshal(body, &threadUpdateEvent); err != nil {
+		http.Error(w, "Error unmarshalling request body", http.StatusInternalServerError)
+		return
+	}
+
+	rlog.Info("Received discord thread update", "threadUpdate", threadUpdateEvent)
+	_, err = DiscordThreadUpdateTopic.Publish(r.Context(), &threadUpdateEvent)
+	if err != nil {
+		http.Error(w, "Error publishing thread update", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DiscordInteractionWebhook receives slash command & message component interactions from Discord,
+// which signs them with the application's public key.
+// The interaction is acknowledged right away & handled asynchronously by the subscribed services,
+// which respond to it via follow-up messages.
+//
+//encore:api public raw method=POST path=/discord-interaction-webhook
+func DiscordInteractionWebhook(w http.ResponseWriter, r *http.Request) {
+	publicKey, err := hex.DecodeString(secrets.DiscordPublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		http.Error(w, "Invalid public key", http.StatusInternalServerError)
+		return
+	}
+
+	if !discordgo.VerifyInteraction(r, publicKey) {
+		http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	var interaction discordgo.Interaction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "Error unmarshalling request body", http.StatusInternalServerError)
+		return
+	}
+
+	evt := &models.DiscordInteractionEvent{
+		ID:        interaction.ID,
+		AppID:     interaction.AppID,
+		Token:     interaction.Token,
+		Type:      interaction.Type,
+		GuildID:   interaction.GuildID,
+		ChannelID: interaction.ChannelID,
+	}
+	if interaction.Member != nil && interaction.Member.User != nil {
+		evt.UserID = interaction.Member.User.ID
+	} else if interaction.User != nil {
+		evt.UserID = interaction.User.ID
+	}
+
+	ackType := discordgo.InteractionResponseDeferredChannelMessageWithSource
+	switch interaction.Type {
+	case discordgo.InteractionPing:
+		// Discord pings the endpoint when it's configured & expects a pong
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong}); err != nil {
+			rlog.Error("Couldn't respond to ping", "error", err)
+		}
+		return
+	case discordgo.InteractionApplicationCommand:
+		data := interaction.ApplicationCommandData()
+		evt.CommandName = data.Name
+		if len(data.Options) > 0 && data.Options[0].Type == discordgo.ApplicationCommandOptionSubCommand {
+			evt.SubCommandName = data.Options[0].Name
+		}
+	case discordgo.InteractionMessageComponent:
+		evt.CustomID = interaction.MessageComponentData().CustomID
+		if interaction.Message != nil {
+			evt.MessageID = interaction.Message.ID
+		}
+		ackType = discordgo.InteractionResponseDeferredMessageUpdate
+	default:
+		rlog.Info("Ignoring unsupported interaction type", "type", interaction.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	discordClient, err := discordgo.New("Bot " + secrets.DiscordToken)
+	if err != nil {
+		http.Error(w, "Error creating discord client", http.StatusInternalServerError)
+		return
+	}
+
+	err = discordClient.InteractionRespond(&interaction, &discordgo.InteractionResponse{
+		Type: ackType,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		http.Error(w, "Error acknowledging interaction", http.StatusInternalServerError)
+		return
+	}
+
+	rlog.Info("Received discord interaction", "interaction", evt.ID, "type", evt.Type)
+	_, err = DiscordInteractionTopic.Publish(r.Context(), evt)
+	if err != nil {
+		http.Error(w, "Error publishing interaction", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
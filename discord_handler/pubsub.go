@@ -9,3 +9,13 @@ import (
 var DiscordRawMessageTopic = pubsub.NewTopic[*models.DiscordRawMessage]("discord-messages", pubsub.TopicConfig{
 	DeliveryGuarantee: pubsub.AtLeastOnce,
 })
+
+// DiscordInteractionTopic is the pubsub topic for slash commands & message component clicks.
+var DiscordInteractionTopic = pubsub.NewTopic[*models.DiscordInteractionEvent]("discord-interactions", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// DiscordThreadUpdateTopic is the pubsub topic for renamed & re-tagged threads.
+var DiscordThreadUpdateTopic = pubsub.NewTopic[*models.DiscordThreadUpdateEvent]("discord-thread-updates", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"strings"
 
+	deadletterqueue "encore.app/dead_letter_queue"
 	forumpostclassifier "encore.app/forum_post_classifier"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
 	"github.com/bwmarrin/discordgo"
@@ -36,6 +38,8 @@ func initService() (*Service, error) {
 	}, nil
 }
 
+const dupForumPostHandlerSubscription = "dup-forum-post-handler"
+
 var _ = pubsub.NewSubscription(
 	forumpostclassifier.DuplicateDiscordForumPostTopic,
 	"dup-forum-post-handler",
@@ -43,14 +47,32 @@ var _ = pubsub.NewSubscription(
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
-		Handler: func(ctx context.Context, forumPost *models.DuplicateDiscordForumPostEvent) error {
-			rlog.Info("Received duplicate discord forum post event", "forumPost", forumPost)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
+		Handler: deadletter.Handler("dup-discord-forum-posts", dupForumPostHandlerSubscription, 5, handleDuplicateForumPost),
+	})
+
+func handleDuplicateForumPost(ctx context.Context, forumPost *models.DuplicateDiscordForumPostEvent) error {
+	rlog.Info("Received duplicate discord forum post event", "forumPost", forumPost)
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleDuplicateDiscordForumPost(ctx, forumPost)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"dup-forum-post-handler-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != dupForumPostHandlerSubscription {
+				return nil
 			}
 
-			return service.HandleDuplicateDiscordForumPost(ctx, forumPost)
+			return deadletter.Replay(ctx, evt, handleDuplicateForumPost)
 		},
 	})
 
@@ -7,9 +7,11 @@ import (
 	"strings"
 	"time"
 
+	deadletterqueue "encore.app/dead_letter_queue"
 	forumpostclassifier "encore.app/forum_post_classifier"
 	knowledgebase "encore.app/knowledge_base"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.app/packages/llmservice"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
@@ -50,50 +52,61 @@ func initService() (*Service, error) {
 	}, nil
 }
 
+const aiAssistantSubscription = "forum-post-ai-assistant"
+
 var _ = pubsub.NewSubscription(
 	forumpostclassifier.UniqueDiscordForumPostTopic,
 	"forum-post-ai-assistant",
-	pubsub.SubscriptionConfig[*models.DiscordForumPostEvent]{
+	pubsub.SubscriptionConfig[*models.TaggedDiscordForumPostEvent]{
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
 		AckDeadline: time.Minute * 5,
-		Handler: func(ctx context.Context, forumPost *models.DiscordForumPostEvent) error {
-			rlog.Info("Received discord forum post event", "forumPost", forumPost)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
-			}
-
-			return service.HandleDiscordForumPost(ctx, forumPost)
-		},
+		Handler:     deadletter.Handler("uniq-discord-forum-posts", aiAssistantSubscription, 5, handleUniqueForumPost),
 	})
 
-func (s *Service) HandleDiscordForumPost(ctx context.Context, forumPostEvt *models.DiscordForumPostEvent) error {
-	forumPostChannel, err := s.discordClient.Channel(forumPostEvt.ID)
+func handleUniqueForumPost(ctx context.Context, forumPost *models.TaggedDiscordForumPostEvent) error {
+	rlog.Info("Received discord forum post event", "forumPost", forumPost)
+	service, err := initService()
 	if err != nil {
-		return fmt.Errorf("couldn't get discord channel: %w", err)
+		return fmt.Errorf("couldn't create service: %w", err)
 	}
 
-	forumChannel, err := s.discordClient.Channel(forumPostChannel.ParentID)
-	if err != nil {
-		return fmt.Errorf("couldn't get discord channel: %w", err)
-	}
+	return service.HandleDiscordForumPost(ctx, forumPost)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"forum-post-ai-assistant-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != aiAssistantSubscription {
+				return nil
+			}
+
+			return deadletter.Replay(ctx, evt, handleUniqueForumPost)
+		},
+	})
 
+func (s *Service) HandleDiscordForumPost(ctx context.Context, forumPostEvt *models.TaggedDiscordForumPostEvent) error {
 	rlog.Info("Handling discord forum post",
-		"forumPostChannelId", forumPostChannel.ID,
+		"forumPostChannelId", forumPostEvt.ID,
+		"tags", forumPostEvt.TagNames,
 	)
 
-	otherTag := lo.Filter(forumChannel.AvailableTags, func(tag discordgo.ForumTag, _ int) bool {
-		return tag.Name == "Other"
-	})[0]
-	if len(forumPostChannel.AppliedTags) == 0 {
-		return errors.New("forum post has no tags yet, will attempt retry...")
-	} else if lo.Contains(forumPostChannel.AppliedTags, otherTag.ID) {
-		rlog.Warn("Skipping classification for forum post with 'Other' tag")
+	if lo.Contains(forumPostEvt.TagNames, "Other") {
+		rlog.Warn("Skipping AI assistant answer for forum post with 'Other' tag")
 		return nil
 	}
 
+	forumPostChannel, err := s.discordClient.Channel(forumPostEvt.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
 	messages, err := s.discordClient.ChannelMessages(forumPostChannel.ID, 100, "", "", "")
 	if err != nil {
 		return fmt.Errorf("couldn't get messages in forum post: %w", err)
@@ -7,8 +7,10 @@ import (
 
 	"google.golang.org/protobuf/types/known/structpb"
 
-	forumpostmapper "encore.app/forum_post_mapper"
+	deadletterqueue "encore.app/dead_letter_queue"
+	forumposttagger "encore.app/forum_post_tagger"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.app/packages/llmservice"
 	"encore.app/packages/utils"
 	"encore.dev/pubsub"
@@ -64,49 +66,60 @@ func initService() (*Service, error) {
 	}, nil
 }
 
+const classifierSubscription = "forum-post-classifier"
+
 var _ = pubsub.NewSubscription(
-	forumpostmapper.DiscordForumPostTopic,
+	forumposttagger.TaggedDiscordForumPostTopic,
 	"forum-post-classifier",
-	pubsub.SubscriptionConfig[*models.DiscordForumPostEvent]{
+	pubsub.SubscriptionConfig[*models.TaggedDiscordForumPostEvent]{
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
-		Handler: func(ctx context.Context, forumPost *models.DiscordForumPostEvent) error {
-			rlog.Info("Received discord forum post event", "forumPost", forumPost)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
-			}
-
-			return service.ClassifyDiscordForumPost(ctx, forumPost)
-		},
+		Handler: deadletter.Handler("tagged-discord-forum-posts", classifierSubscription, 5, handleTaggedForumPost),
 	})
 
-func (s *Service) ClassifyDiscordForumPost(ctx context.Context, forumPostEvt *models.DiscordForumPostEvent) error {
-	forumPostChannel, err := s.discordClient.Channel(forumPostEvt.ID)
+func handleTaggedForumPost(ctx context.Context, forumPost *models.TaggedDiscordForumPostEvent) error {
+	rlog.Info("Received tagged discord forum post event", "forumPost", forumPost)
+	service, err := initService()
 	if err != nil {
-		return fmt.Errorf("couldn't get discord channel: %w", err)
+		return fmt.Errorf("couldn't create service: %w", err)
 	}
 
-	forumChannel, err := s.discordClient.Channel(forumPostChannel.ParentID)
-	if err != nil {
-		return fmt.Errorf("couldn't get discord channel: %w", err)
-	}
+	return service.ClassifyDiscordForumPost(ctx, forumPost)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"forum-post-classifier-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != classifierSubscription {
+				return nil
+			}
 
+			return deadletter.Replay(ctx, evt, handleTaggedForumPost)
+		},
+	})
+
+func (s *Service) ClassifyDiscordForumPost(ctx context.Context, forumPostEvt *models.TaggedDiscordForumPostEvent) error {
 	rlog.Info("Handling discord forum post",
-		"forumPostChannelId", forumPostChannel.ID,
+		"forumPostChannelId", forumPostEvt.ID,
+		"tags", forumPostEvt.TagNames,
 	)
 
-	otherTag := lo.Filter(forumChannel.AvailableTags, func(tag discordgo.ForumTag, _ int) bool {
-		return tag.Name == "Other"
-	})[0]
-	if len(forumPostChannel.AppliedTags) == 0 {
-		return errors.New("forum post has no tags yet, will attempt retry...")
-	} else if lo.Contains(forumPostChannel.AppliedTags, otherTag.ID) {
+	if lo.Contains(forumPostEvt.TagNames, "Other") {
 		rlog.Warn("Skipping classification for forum post with 'Other' tag")
 		return nil
 	}
 
+	forumPostChannel, err := s.discordClient.Channel(forumPostEvt.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
 	messages, err := s.discordClient.ChannelMessages(forumPostChannel.ID, 100, "", "", "")
 	if err != nil {
 		return fmt.Errorf("couldn't get messages in forum post: %w", err)
@@ -141,10 +154,7 @@ func (s *Service) ClassifyDiscordForumPost(ctx context.Context, forumPostEvt *mo
 			return fmt.Errorf("couldn't upsert message as vector: %w", err)
 		}
 
-		_, err = UniqueDiscordForumPostTopic.Publish(ctx, &models.DiscordForumPostEvent{
-			ID:      forumPostChannel.ID,
-			GuildID: forumPostChannel.GuildID,
-		})
+		_, err = UniqueDiscordForumPostTopic.Publish(ctx, forumPostEvt)
 		if err != nil {
 			return fmt.Errorf("couldn't publish unique forum post: %w", err)
 		}
@@ -7,7 +7,7 @@ import (
 
 // UniqueDiscordForumPostTopic is a pubsub topic for forum posts
 // classified as unique, meaning they didn't match any of the existing posts in our database
-var UniqueDiscordForumPostTopic = pubsub.NewTopic[*models.DiscordForumPostEvent]("uniq-discord-forum-posts", pubsub.TopicConfig{
+var UniqueDiscordForumPostTopic = pubsub.NewTopic[*models.TaggedDiscordForumPostEvent]("uniq-discord-forum-posts", pubsub.TopicConfig{
 	DeliveryGuarantee: pubsub.AtLeastOnce,
 })
 
@@ -0,0 +1,11 @@
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    dedup_key VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    sent_at TIMESTAMP,
+    CONSTRAINT uniq_outbox_dedup_key UNIQUE(dedup_key)
+);
+
+CREATE INDEX idx_outbox_pending ON outbox (id) WHERE sent_at IS NULL;
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"encore.app/models"
+	"encore.app/packages/outbox"
 	"encore.dev/rlog"
 	"github.com/bwmarrin/discordgo"
 	"github.com/google/uuid"
@@ -54,6 +55,8 @@ func (s *Service) MapDiscordMessageToForumPost(ctx context.Context, message *mod
 		return fmt.Errorf("couldn't begin transaction: %w", err)
 	}
 
+	defer tx.Rollback()
+
 	result, err := tx.Exec(ctx, `
 		INSERT INTO discord_forum_posts (id, discord_id)
 		VALUES ($1, $2)
@@ -67,15 +70,15 @@ func (s *Service) MapDiscordMessageToForumPost(ctx context.Context, message *mod
 		return nil
 	}
 
-	// Note: There is no atomicity between db insert and pubsub publish.
-	// To make it properly, we'll need to utilize the transactional outbox pattern,
-	// which is out of scope for this hackathon.
-	_, err = DiscordForumPostTopic.Publish(ctx, &models.DiscordForumPostEvent{
-		ID:      forumPostChannel.ID,
-		GuildID: forumPostChannel.GuildID,
-	})
+	// The event is stored in the outbox within the same transaction & published by the relay
+	_, err = outbox.Insert(ctx, tx, forumPostOutboxTopic, "discord-forum-post:"+forumPostChannel.ID,
+		&models.DiscordForumPostEvent{
+			ID:      forumPostChannel.ID,
+			GuildID: forumPostChannel.GuildID,
+			Title:   forumPostChannel.Name,
+		})
 	if err != nil {
-		return fmt.Errorf("couldn't publish forum post: %w", err)
+		return fmt.Errorf("couldn't add forum post to outbox: %w", err)
 	}
 
 	err = tx.Commit()
@@ -83,6 +86,11 @@ func (s *Service) MapDiscordMessageToForumPost(ctx context.Context, message *mod
 		return fmt.Errorf("couldn't commit transaction: %w", err)
 	}
 
+	// Publishing right away is best effort, the outbox relay cron will retry any pending events
+	if err := outboxRelay.PublishPending(ctx); err != nil {
+		rlog.Warn("Couldn't relay outbox events", "error", err)
+	}
+
 	rlog.Info("Successfully inserted & published forum post", "discordId", forumPostChannel.ID)
 	return nil
 }
@@ -2,10 +2,15 @@ package forumpostmapper
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	deadletterqueue "encore.app/dead_letter_queue"
 	"encore.app/discord_handler"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.app/packages/outbox"
+	"encore.dev/cron"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
 	"encore.dev/storage/sqldb"
@@ -15,6 +20,36 @@ var db = sqldb.NewDatabase("forum_post_mapper", sqldb.DatabaseConfig{
 	Migrations: "./migrations",
 })
 
+const forumPostOutboxTopic = "discord-forum-posts"
+
+var outboxRelay = outbox.NewRelay(db, map[string]outbox.Publisher{
+	forumPostOutboxTopic: func(ctx context.Context, payload []byte) error {
+		var event models.DiscordForumPostEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return fmt.Errorf("couldn't unmarshal forum post: %w", err)
+		}
+
+		_, err := DiscordForumPostTopic.Publish(ctx, &event)
+		return err
+	},
+})
+
+// Publish any outbox events which weren't relayed right after their transaction committed.
+var _ = cron.NewJob("relay-forum-post-outbox", cron.JobConfig{
+	Title:    "Relay pending forum post events",
+	Endpoint: RelayForumPostOutbox,
+	Every:    1 * cron.Minute,
+})
+
+// RelayForumPostOutbox publishes all pending forum post events.
+//
+//encore:api private method=POST path=/forum-post-outbox/relay
+func RelayForumPostOutbox(ctx context.Context) error {
+	return outboxRelay.PublishPending(ctx)
+}
+
+const forumPostMapperSubscription = "forum-post-mapper"
+
 var _ = pubsub.NewSubscription(
 	discord_handler.DiscordRawMessageTopic,
 	"forum-post-mapper",
@@ -22,14 +57,32 @@ var _ = pubsub.NewSubscription(
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
-		Handler: func(ctx context.Context, message *models.DiscordRawMessage) error {
-			rlog.Info("Received raw discord message", "discordMessage", message)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
+		Handler: deadletter.Handler("discord-messages", forumPostMapperSubscription, 5, handleDiscordRawMessage),
+	})
+
+func handleDiscordRawMessage(ctx context.Context, message *models.DiscordRawMessage) error {
+	rlog.Info("Received raw discord message", "discordMessage", message)
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.MapDiscordMessageToForumPost(ctx, message)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"forum-post-mapper-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			if evt.Subscription != forumPostMapperSubscription {
+				return nil
 			}
 
-			return service.MapDiscordMessageToForumPost(ctx, message)
+			return deadletter.Replay(ctx, evt, handleDiscordRawMessage)
 		},
 	})
 
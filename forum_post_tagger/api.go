@@ -0,0 +1,76 @@
+package forumposttagger
+
+import (
+	"context"
+	"fmt"
+
+	"encore.app/models"
+)
+
+type ListForumPostTagChangesResponse struct {
+	TagChanges []*models.ForumPostTagChange `json:"tagChanges"`
+}
+
+// ListForumPostTagChanges lists the tag history of a forum post, oldest first.
+//
+//encore:api private method=GET path=/forum-posts/:forumPostID/tag-changes
+func ListForumPostTagChanges(ctx context.Context, forumPostID string) (*ListForumPostTagChangesResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, forum_post_id, tag_ids, tag_names, applied_by, action, reason, created_at
+		FROM forum_post_tag_changes
+		WHERE forum_post_id = $1
+		ORDER BY created_at
+	`, forumPostID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get forum post tag changes: %w", err)
+	}
+	defer rows.Close()
+
+	tagChanges, err := models.MapForumPostTagChangesFromSQLRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't map forum post tag changes: %w", err)
+	}
+
+	return &ListForumPostTagChangesResponse{TagChanges: tagChanges}, nil
+}
+
+type TaggingAccuracyResponse struct {
+	// TaggedForumPosts is the number of forum posts the bot applied tags to
+	TaggedForumPosts int `json:"taggedForumPosts"`
+	// OverriddenForumPosts is the number of bot-tagged forum posts a human later re-tagged
+	OverriddenForumPosts int `json:"overriddenForumPosts"`
+	// SuggestedForumPosts is the number of forum posts the bot suggested different tags for
+	SuggestedForumPosts int     `json:"suggestedForumPosts"`
+	Accuracy            float32 `json:"accuracy"`
+}
+
+// GetTaggingAccuracy measures how often bot-applied tags were kept by humans.
+//
+//encore:api private method=GET path=/tagging-accuracy
+func GetTaggingAccuracy(ctx context.Context) (*TaggingAccuracyResponse, error) {
+	var resp TaggingAccuracyResponse
+	err := db.QueryRow(ctx, `
+		SELECT
+			COUNT(DISTINCT c.forum_post_id) FILTER (WHERE c.applied_by = $1 AND c.action = $3),
+			COUNT(DISTINCT c.forum_post_id) FILTER (
+				WHERE c.applied_by = $2 AND c.action = $5 AND EXISTS (
+					SELECT 1 FROM forum_post_tag_changes b
+					WHERE b.forum_post_id = c.forum_post_id
+					  AND b.applied_by = $1 AND b.action = $3
+					  AND b.created_at < c.created_at)),
+			COUNT(DISTINCT c.forum_post_id) FILTER (WHERE c.applied_by = $1 AND c.action = $4)
+		FROM forum_post_tag_changes c
+	`, models.ForumPostTagChangeSourceBot, models.ForumPostTagChangeSourceHuman,
+		models.ForumPostTagChangeActionApplied, models.ForumPostTagChangeActionSuggested,
+		models.ForumPostTagChangeActionObserved).
+		Scan(&resp.TaggedForumPosts, &resp.OverriddenForumPosts, &resp.SuggestedForumPosts)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't calculate tagging accuracy: %w", err)
+	}
+
+	if resp.TaggedForumPosts > 0 {
+		resp.Accuracy = 1 - float32(resp.OverriddenForumPosts)/float32(resp.TaggedForumPosts)
+	}
+
+	return &resp, nil
+}
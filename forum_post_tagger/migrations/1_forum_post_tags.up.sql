@@ -0,0 +1,23 @@
+CREATE TABLE forum_post_tag_state (
+    forum_post_id VARCHAR(255) PRIMARY KEY,
+    title TEXT NOT NULL,
+    message_count INT NOT NULL DEFAULT 0,
+    evaluated_message_count INT NOT NULL DEFAULT 0,
+    current_tag_ids TEXT[] NOT NULL DEFAULT '{}',
+    suggested_tag_ids TEXT[] NOT NULL DEFAULT '{}',
+    human_override BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE forum_post_tag_changes (
+    id SERIAL PRIMARY KEY,
+    forum_post_id VARCHAR(255) NOT NULL,
+    tag_ids TEXT[] NOT NULL,
+    tag_names TEXT[] NOT NULL,
+    applied_by VARCHAR(255) NOT NULL,
+    action VARCHAR(255) NOT NULL,
+    reason VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idx_forum_post_tag_changes_forum_post_id ON forum_post_tag_changes (forum_post_id);
@@ -0,0 +1,14 @@
+-- bot_tag_ids are the tags the bot last applied, stored before applying them so that
+-- an attempt which fails afterwards doesn't mistake them for a human's tags on retry
+ALTER TABLE forum_post_tag_state
+    ADD COLUMN bot_tag_ids TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN tagged BOOLEAN NOT NULL DEFAULT TRUE;
+
+UPDATE forum_post_tag_state SET bot_tag_ids = current_tag_ids WHERE NOT human_override;
+
+-- messages counted towards the re-evaluation of a forum post, so redelivered messages are counted once
+CREATE TABLE forum_post_tag_messages (
+    message_id VARCHAR(255) PRIMARY KEY,
+    forum_post_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,157 @@
+package forumposttagger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.dev/pubsub"
+	"encore.dev/storage/sqldb"
+)
+
+var db = sqldb.NewDatabase("forum_post_tagger", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+// TaggedDiscordForumPostTopic is a pubsub topic for forum posts which received their initial tags,
+// either applied by the bot or already set by the forum post author
+var TaggedDiscordForumPostTopic = pubsub.NewTopic[*models.TaggedDiscordForumPostEvent]("tagged-discord-forum-posts", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+// ForumPostTagsChangedTopic is a pubsub topic for changes of the tags of tagged forum posts,
+// whether the bot or a human changed them
+var ForumPostTagsChangedTopic = pubsub.NewTopic[*models.ForumPostTagsChangedEvent]("forum-post-tag-changes", pubsub.TopicConfig{
+	DeliveryGuarantee: pubsub.AtLeastOnce,
+})
+
+const tagStateColumns = `
+	forum_post_id, title, message_count, evaluated_message_count,
+	current_tag_ids, suggested_tag_ids, bot_tag_ids, human_override, tagged`
+
+// tagState tracks the tagging status of a forum post between evaluations
+type tagState struct {
+	ForumPostID           string
+	Title                 string
+	MessageCount          int
+	EvaluatedMessageCount int
+	CurrentTagIDs         []string
+	SuggestedTagIDs       []string
+	// BotTagIDs are the tags the bot last applied, they may not be recorded as current yet
+	BotTagIDs     []string
+	HumanOverride bool
+	// Tagged is set once the initial tags were recorded
+	Tagged bool
+}
+
+// tagChange is an entry of the tag history of a forum post
+type tagChange struct {
+	TagIDs    []string
+	TagNames  []string
+	AppliedBy models.ForumPostTagChangeSource
+	Action    models.ForumPostTagChangeAction
+	Reason    string
+}
+
+func scanTagState(row *sqldb.Row) (*tagState, error) {
+	var state tagState
+	err := row.Scan(
+		&state.ForumPostID, &state.Title, &state.MessageCount, &state.EvaluatedMessageCount,
+		&state.CurrentTagIDs, &state.SuggestedTagIDs, &state.BotTagIDs, &state.HumanOverride, &state.Tagged)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func getTagState(ctx context.Context, forumPostID string) (*tagState, error) {
+	return scanTagState(db.QueryRow(ctx, `
+		SELECT `+tagStateColumns+`
+		FROM forum_post_tag_state
+		WHERE forum_post_id = $1
+	`, forumPostID))
+}
+
+// saveTagState stores the state together with the tag changes which led to it, so a retried
+// evaluation can't record the same change twice.
+// The new tags are published before committing, so a failed commit may publish them again but never loses them.
+func saveTagState(ctx context.Context, state *tagState, changes ...*tagChange) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO forum_post_tag_state (`+tagStateColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (forum_post_id) DO UPDATE SET
+			title = EXCLUDED.title,
+			evaluated_message_count = EXCLUDED.evaluated_message_count,
+			current_tag_ids = EXCLUDED.current_tag_ids,
+			suggested_tag_ids = EXCLUDED.suggested_tag_ids,
+			bot_tag_ids = EXCLUDED.bot_tag_ids,
+			human_override = EXCLUDED.human_override,
+			tagged = EXCLUDED.tagged,
+			updated_at = now()
+	`, state.ForumPostID, state.Title, state.MessageCount, state.EvaluatedMessageCount,
+		state.CurrentTagIDs, state.SuggestedTagIDs, state.BotTagIDs, state.HumanOverride, state.Tagged)
+	if err != nil {
+		return fmt.Errorf("couldn't upsert forum post tag state: %w", err)
+	}
+
+	var tagsChanged *tagChange
+	for _, change := range changes {
+		if change == nil {
+			continue
+		} else if change.Action != models.ForumPostTagChangeActionSuggested {
+			tagsChanged = change
+		}
+
+		_, err := tx.Exec(ctx, `
+			INSERT INTO forum_post_tag_changes (forum_post_id, tag_ids, tag_names, applied_by, action, reason)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, state.ForumPostID, change.TagIDs, change.TagNames, change.AppliedBy, change.Action, change.Reason)
+		if err != nil {
+			return fmt.Errorf("couldn't record forum post tag change: %w", err)
+		}
+	}
+
+	if tagsChanged != nil {
+		_, err := ForumPostTagsChangedTopic.Publish(ctx, &models.ForumPostTagsChangedEvent{
+			ID:        state.ForumPostID,
+			TagIDs:    tagsChanged.TagIDs,
+			TagNames:  tagsChanged.TagNames,
+			ChangedAt: time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't publish forum post tag change: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit forum post tag state: %w", err)
+	}
+
+	return nil
+}
+
+// countForumPostMessage bumps the message count of a tracked forum post, unless the message was already counted.
+// It returns sqldb.ErrNoRows if the forum post isn't tracked or the message was already counted.
+func countForumPostMessage(ctx context.Context, forumPostID, messageID string) (*tagState, error) {
+	return scanTagState(db.QueryRow(ctx, `
+		WITH counted AS (
+			INSERT INTO forum_post_tag_messages (message_id, forum_post_id)
+			SELECT $2, $1
+			WHERE EXISTS (SELECT 1 FROM forum_post_tag_state WHERE forum_post_id = $1)
+			ON CONFLICT (message_id) DO NOTHING
+			RETURNING forum_post_id
+		)
+		UPDATE forum_post_tag_state
+		SET message_count = message_count + 1, updated_at = now()
+		WHERE forum_post_id = (SELECT forum_post_id FROM counted)
+		RETURNING `+tagStateColumns,
+		forumPostID, messageID))
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
+	deadletterqueue "encore.app/dead_letter_queue"
+	"encore.app/discord_handler"
 	forumpostmapper "encore.app/forum_post_mapper"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.app/packages/llmservice"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
 	"github.com/bwmarrin/discordgo"
 	"github.com/samber/lo"
 )
@@ -21,6 +26,18 @@ var secrets struct {
 // #support
 const forumChannelID = "1233297799366311977"
 
+// reevaluateTagsAfterMessages is the amount of new messages in a forum post
+// after which its tags get re-evaluated
+const reevaluateTagsAfterMessages = 10
+const maxConversationLength = 8000
+
+const (
+	tagReasonInitial     = "initial"
+	tagReasonNewMessages = "new_messages"
+	tagReasonTitleEdit   = "title_edit"
+	tagReasonTagEdit     = "tag_edit"
+)
+
 // Service for tagging forum posts based on their content
 type Service struct {
 	llmService    *llmservice.Service
@@ -41,6 +58,8 @@ func initService() (*Service, error) {
 	return &Service{llmService: llmService, discordClient: discordClient}, nil
 }
 
+const taggerSubscription = "forum-post-tagger"
+
 var _ = pubsub.NewSubscription(
 	forumpostmapper.DiscordForumPostTopic,
 	"forum-post-tagger",
@@ -48,14 +67,83 @@ var _ = pubsub.NewSubscription(
 		RetryPolicy: &pubsub.RetryPolicy{
 			MaxRetries: 5,
 		},
-		Handler: func(ctx context.Context, forumPost *models.DiscordForumPostEvent) error {
-			rlog.Info("Received raw discord message", "discordMessage", forumPost)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
+		Handler: deadletter.Handler("discord-forum-posts", taggerSubscription, 5, handleForumPost),
+	})
+
+func handleForumPost(ctx context.Context, forumPost *models.DiscordForumPostEvent) error {
+	rlog.Info("Received raw discord message", "discordMessage", forumPost)
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.TriageDiscordForumPost(ctx, forumPost)
+}
+
+const tagReevaluatorSubscription = "forum-post-tag-reevaluator"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordRawMessageTopic,
+	"forum-post-tag-reevaluator",
+	pubsub.SubscriptionConfig[*models.DiscordRawMessage]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-messages", tagReevaluatorSubscription, 5, handleDiscordRawMessage),
+	})
+
+func handleDiscordRawMessage(ctx context.Context, message *models.DiscordRawMessage) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleForumPostActivity(ctx, message)
+}
+
+const threadUpdatesSubscription = "forum-post-tagger-thread-updates"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordThreadUpdateTopic,
+	"forum-post-tagger-thread-updates",
+	pubsub.SubscriptionConfig[*models.DiscordThreadUpdateEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-thread-updates", threadUpdatesSubscription, 5, handleThreadUpdate),
+	})
+
+func handleThreadUpdate(ctx context.Context, update *models.DiscordThreadUpdateEvent) error {
+	if update.ParentID != forumChannelID {
+		return nil
+	}
+
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleForumPostUpdate(ctx, update)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"forum-post-tagger-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			switch evt.Subscription {
+			case taggerSubscription:
+				return deadletter.Replay(ctx, evt, handleForumPost)
+			case tagReevaluatorSubscription:
+				return deadletter.Replay(ctx, evt, handleDiscordRawMessage)
+			case threadUpdatesSubscription:
+				return deadletter.Replay(ctx, evt, handleThreadUpdate)
 			}
 
-			return service.TriageDiscordForumPost(ctx, forumPost)
+			return nil
 		},
 	})
 
@@ -73,9 +161,25 @@ func (s *Service) TriageDiscordForumPost(ctx context.Context, forumPostEvt *mode
 	rlog.Info("Handling discord forum post",
 		"forumPostChannelId", forumPostChannel.ID,
 		"forumId", forumChannel.ID)
+	state, err := getTagState(ctx, forumPostChannel.ID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		state = &tagState{ForumPostID: forumPostChannel.ID, Title: forumPostChannel.Name}
+	} else if err != nil {
+		return fmt.Errorf("couldn't get forum post tag state: %w", err)
+	} else if state.Tagged {
+		rlog.Info("Forum post was already tagged, re-publishing tagged event")
+		return publishTaggedForumPost(ctx, forumPostChannel, forumChannel, state.CurrentTagIDs)
+	}
+
 	if len(forumPostChannel.AppliedTags) > 0 {
-		rlog.Info("Not setting tags for forum post which already has ones")
-		return nil
+		// either set by the author, or by the bot on an attempt which failed before recording them
+		change := observeTagChange(state, forumPostChannel.AppliedTags, forumChannel, tagReasonInitial)
+		state.Tagged = true
+		if err := saveTagState(ctx, state, change); err != nil {
+			return err
+		}
+
+		return publishTaggedForumPost(ctx, forumPostChannel, forumChannel, state.CurrentTagIDs)
 	}
 
 	messages, err := s.discordClient.ChannelMessages(forumPostChannel.ID, 100, "", "", "")
@@ -87,14 +191,211 @@ func (s *Service) TriageDiscordForumPost(ctx context.Context, forumPostEvt *mode
 	}
 
 	firstMessage := messages[len(messages)-1]
-	firstMsgCleanContent := firstMessage.ContentWithMentionsReplaced()
+	tagIdsToApply, err := s.determineTags(ctx, forumChannel, forumPostChannel.Name, firstMessage.ContentWithMentionsReplaced())
+	if err != nil {
+		return err
+	}
+
+	state.MessageCount = len(messages)
+	state.EvaluatedMessageCount = len(messages)
+	change, err := s.applyTags(ctx, state, forumPostChannel, forumChannel, tagIdsToApply, tagReasonInitial)
+	if err != nil {
+		return err
+	}
+
+	state.CurrentTagIDs = tagIdsToApply
+	state.Tagged = true
+	if err := saveTagState(ctx, state, change); err != nil {
+		return err
+	}
+
+	return publishTaggedForumPost(ctx, forumPostChannel, forumChannel, tagIdsToApply)
+}
+
+// publishTaggedForumPost notifies downstream services that the forum post has its initial tags
+func publishTaggedForumPost(
+	ctx context.Context, forumPostChannel, forumChannel *discordgo.Channel, tagIds []string,
+) error {
+	_, err := TaggedDiscordForumPostTopic.Publish(ctx, &models.TaggedDiscordForumPostEvent{
+		ID:       forumPostChannel.ID,
+		GuildID:  forumPostChannel.GuildID,
+		TagIDs:   tagIds,
+		TagNames: tagNames(forumChannel, tagIds),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't publish tagged forum post: %w", err)
+	}
+
+	rlog.Info("Published tagged forum post", "forumPostChannelId", forumPostChannel.ID)
+	return nil
+}
+
+// HandleForumPostActivity re-evaluates the tags of an already tagged forum post
+// once enough new messages were posted in it.
+func (s *Service) HandleForumPostActivity(ctx context.Context, message *models.DiscordRawMessage) error {
+	state, err := countForumPostMessage(ctx, message.ChannelID, message.ID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// not a forum post we've tagged, or a redelivered message
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't update forum post message count: %w", err)
+	} else if !state.Tagged || state.MessageCount-state.EvaluatedMessageCount < reevaluateTagsAfterMessages {
+		return nil
+	}
+
+	forumPostChannel, err := s.discordClient.Channel(state.ForumPostID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
+	forumChannel, err := s.discordClient.Channel(forumPostChannel.ParentID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
+	rlog.Info("Re-evaluating forum post tags",
+		"forumPostChannelId", forumPostChannel.ID,
+		"reason", tagReasonNewMessages)
+	return s.reevaluateTags(ctx, forumPostChannel, forumChannel, state, tagReasonNewMessages)
+}
+
+// HandleForumPostUpdate records tags changed by humans & re-evaluates the tags of a renamed forum post.
+func (s *Service) HandleForumPostUpdate(ctx context.Context, update *models.DiscordThreadUpdateEvent) error {
+	state, err := getTagState(ctx, update.ID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		// not a forum post we've tagged
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't get forum post tag state: %w", err)
+	} else if !state.Tagged {
+		return nil
+	}
+
+	if update.Name == state.Title && sameTags(update.AppliedTags, state.CurrentTagIDs) {
+		return nil
+	}
+
+	forumPostChannel, err := s.discordClient.Channel(update.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
+	forumChannel, err := s.discordClient.Channel(forumPostChannel.ParentID)
+	if err != nil {
+		return fmt.Errorf("couldn't get discord channel: %w", err)
+	}
+
+	if forumPostChannel.Name == state.Title {
+		change := observeTagChange(state, forumPostChannel.AppliedTags, forumChannel, tagReasonTagEdit)
+		return saveTagState(ctx, state, change)
+	}
+
+	rlog.Info("Re-evaluating forum post tags",
+		"forumPostChannelId", forumPostChannel.ID,
+		"reason", tagReasonTitleEdit)
+	return s.reevaluateTags(ctx, forumPostChannel, forumChannel, state, tagReasonTitleEdit)
+}
+
+func (s *Service) reevaluateTags(
+	ctx context.Context,
+	forumPostChannel, forumChannel *discordgo.Channel,
+	state *tagState,
+	reason string,
+) error {
+	observedChange := observeTagChange(state, forumPostChannel.AppliedTags, forumChannel, reason)
+	messages, err := s.discordClient.ChannelMessages(forumPostChannel.ID, 100, "", "", "")
+	if err != nil {
+		return fmt.Errorf("couldn't get messages in forum post: %w", err)
+	} else if len(messages) == 0 {
+		rlog.Warn("No messages found in forum post")
+		return saveTagState(ctx, state, observedChange)
+	}
+
+	tagIds, err := s.determineTags(ctx, forumChannel, forumPostChannel.Name, formatForumPostConversation(messages))
+	if err != nil {
+		return err
+	}
+
+	state.Title = forumPostChannel.Name
+	state.EvaluatedMessageCount = state.MessageCount
+	if sameTags(tagIds, state.CurrentTagIDs) {
+		rlog.Info("Forum post tags are still accurate")
+		return saveTagState(ctx, state, observedChange)
+	}
+
+	if !state.HumanOverride {
+		appliedChange, err := s.applyTags(ctx, state, forumPostChannel, forumChannel, tagIds, reason)
+		if err != nil {
+			return err
+		}
+
+		state.CurrentTagIDs = tagIds
+		return saveTagState(ctx, state, observedChange, appliedChange)
+	}
+
+	if sameTags(tagIds, state.SuggestedTagIDs) {
+		rlog.Info("Tags were already suggested for forum post")
+		return saveTagState(ctx, state, observedChange)
+	}
+
+	names := tagNames(forumChannel, tagIds)
+	_, err = s.discordClient.ChannelMessageSend(forumPostChannel.ID, fmt.Sprintf(
+		"🏷️ Based on the latest activity in this post, these tags might be a better fit: %s\n"+
+			"The current tags were set manually, so they were left unchanged.",
+		strings.Join(names, ", ")))
+	if err != nil {
+		return fmt.Errorf("couldn't send tag suggestion: %w", err)
+	}
+
+	state.SuggestedTagIDs = tagIds
+	return saveTagState(ctx, state, observedChange, &tagChange{
+		TagIDs:    tagIds,
+		TagNames:  names,
+		AppliedBy: models.ForumPostTagChangeSourceBot,
+		Action:    models.ForumPostTagChangeActionSuggested,
+		Reason:    reason,
+	})
+}
+
+// observeTagChange updates the state with the tags found on the forum post & returns the change,
+// tags which the bot didn't apply itself were set by a human & take precedence over the bot's
+func observeTagChange(state *tagState, appliedTags []string, forumChannel *discordgo.Channel, reason string) *tagChange {
+	if sameTags(appliedTags, state.CurrentTagIDs) {
+		return nil
+	}
+
+	state.CurrentTagIDs = appliedTags
+	if len(state.BotTagIDs) > 0 && sameTags(appliedTags, state.BotTagIDs) {
+		// the bot applied them on an attempt which failed before recording them
+		return &tagChange{
+			TagIDs:    appliedTags,
+			TagNames:  tagNames(forumChannel, appliedTags),
+			AppliedBy: models.ForumPostTagChangeSourceBot,
+			Action:    models.ForumPostTagChangeActionApplied,
+			Reason:    reason,
+		}
+	}
+
+	state.HumanOverride = true
+	return &tagChange{
+		TagIDs:    appliedTags,
+		TagNames:  tagNames(forumChannel, appliedTags),
+		AppliedBy: models.ForumPostTagChangeSourceHuman,
+		Action:    models.ForumPostTagChangeActionObserved,
+		Reason:    reason,
+	}
+}
+
+func (s *Service) determineTags(
+	ctx context.Context, forumChannel *discordgo.Channel, title, contents string,
+) ([]string, error) {
 	tagsStr := lo.Map(forumChannel.AvailableTags, func(tag discordgo.ForumTag, _ int) string {
 		return tag.Name
 	})
 
-	llmDerivedTags, err := s.llmService.DetermineForumPostTags(ctx, tagsStr, forumPostChannel.Name, firstMsgCleanContent)
+	llmDerivedTags, err := s.llmService.DetermineForumPostTags(ctx, tagsStr, title, contents)
 	if err != nil {
-		return fmt.Errorf("couldn't determine forum post tags: %w", err)
+		return nil, fmt.Errorf("couldn't determine forum post tags: %w", err)
 	}
 
 	// always apply the "Other" if nothing matches
@@ -117,16 +418,61 @@ func (s *Service) TriageDiscordForumPost(ctx context.Context, forumPostEvt *mode
 		return tag.ID
 	})
 
-	tagIdsToApply := lo.Filter(tagIds, func(tag string, i int) bool {
+	return lo.Filter(tagIds, func(tag string, i int) bool {
 		return i < 5
-	})
+	}), nil
+}
 
-	_, err = s.discordClient.ChannelEdit(forumPostChannel.ID, &discordgo.ChannelEdit{
-		AppliedTags: lo.ToPtr(tagIdsToApply),
+// applyTags sets the tags on the forum post & returns the change to record.
+// The tags are stored as the bot's beforehand, so they aren't mistaken for a human's if recording them fails.
+func (s *Service) applyTags(
+	ctx context.Context,
+	state *tagState,
+	forumPostChannel, forumChannel *discordgo.Channel,
+	tagIds []string,
+	reason string,
+) (*tagChange, error) {
+	state.BotTagIDs = tagIds
+	if err := saveTagState(ctx, state); err != nil {
+		return nil, err
+	}
+
+	_, err := s.discordClient.ChannelEdit(forumPostChannel.ID, &discordgo.ChannelEdit{
+		AppliedTags: lo.ToPtr(tagIds),
 	})
 	if err != nil {
-		return fmt.Errorf("couldn't set tags for forum post: %w", err)
+		return nil, fmt.Errorf("couldn't set tags for forum post: %w", err)
 	}
 
-	return nil
+	return &tagChange{
+		TagIDs:    tagIds,
+		TagNames:  tagNames(forumChannel, tagIds),
+		AppliedBy: models.ForumPostTagChangeSourceBot,
+		Action:    models.ForumPostTagChangeActionApplied,
+		Reason:    reason,
+	}, nil
+}
+
+func tagNames(forumChannel *discordgo.Channel, tagIds []string) []string {
+	return lo.FilterMap(forumChannel.AvailableTags, func(tag discordgo.ForumTag, _ int) (string, bool) {
+		return tag.Name, lo.Contains(tagIds, tag.ID)
+	})
+}
+
+func sameTags(a, b []string) bool {
+	return len(a) == len(b) && lo.Every(a, b)
+}
+
+// formatForumPostConversation joins the forum post messages from oldest to newest
+func formatForumPostConversation(messages []*discordgo.Message) string {
+	contents := lo.Map(lo.Reverse(messages), func(message *discordgo.Message, _ int) string {
+		return message.ContentWithMentionsReplaced()
+	})
+
+	conversation := strings.Join(contents, "\n---\n")
+	if len(conversation) > maxConversationLength {
+		conversation = conversation[:maxConversationLength]
+	}
+
+	return conversation
 }
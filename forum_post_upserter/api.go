@@ -0,0 +1,101 @@
+package forumpostupserter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"encore.dev/storage/sqldb"
+	"github.com/bwmarrin/discordgo"
+)
+
+// GetForumPostForMessage returns the forum post which was auto-created for a community message.
+//
+//encore:api private method=GET path=/auto-created-forum-posts/by-message/:messageID
+func GetForumPostForMessage(ctx context.Context, messageID string) (*AutoCreatedForumPost, error) {
+	return findAutoCreatedForumPost(ctx, "source_message_id", messageID)
+}
+
+// GetMessageForForumPost returns the community message an auto-created forum post originates from.
+//
+//encore:api private method=GET path=/auto-created-forum-posts/by-forum-post/:forumPostID
+func GetMessageForForumPost(ctx context.Context, forumPostID string) (*AutoCreatedForumPost, error) {
+	return findAutoCreatedForumPost(ctx, "forum_post_id", forumPostID)
+}
+
+func findAutoCreatedForumPost(ctx context.Context, column, id string) (*AutoCreatedForumPost, error) {
+	post, err := getAutoCreatedForumPost(ctx, column, id)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, fmt.Errorf("no auto-created forum post found for %s", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't get auto-created forum post: %w", err)
+	}
+
+	return post, nil
+}
+
+type SetUserForumPostPreferenceRequest struct {
+	OptOut bool `json:"optOut"`
+}
+
+// SetUserForumPostPreference opts a user in or out of automated forum post creation.
+//
+//encore:api private method=PUT path=/users/:userID/forum-post-preference
+func SetUserForumPostPreference(ctx context.Context, userID string, req *SetUserForumPostPreferenceRequest) error {
+	return setUserOptedOut(ctx, userID, req.OptOut)
+}
+
+type SetChannelForumPostModeRequest struct {
+	Mode ForumPostMode `json:"mode"`
+}
+
+// SetChannelForumPostMode configures whether forum posts are created, suggested or
+// never created for questions asked in a channel.
+//
+//encore:api private method=PUT path=/channels/:channelID/forum-post-mode
+func SetChannelForumPostMode(ctx context.Context, channelID string, req *SetChannelForumPostModeRequest) error {
+	switch req.Mode {
+	case ForumPostModeCreate, ForumPostModeSuggest, ForumPostModeDisabled:
+	default:
+		return fmt.Errorf("invalid forum post mode %q", req.Mode)
+	}
+
+	return setChannelForumPostMode(ctx, channelID, req.Mode)
+}
+
+type RegisterForumPostCommandsRequest struct {
+	ApplicationID string `json:"applicationId"`
+	GuildID       string `json:"guildId"`
+}
+
+// RegisterForumPostCommands registers the /forum-posts slash command in a guild.
+//
+//encore:api private method=POST path=/forum-post-commands/register
+func RegisterForumPostCommands(ctx context.Context, req *RegisterForumPostCommandsRequest) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	_, err = service.discordClient.ApplicationCommandCreate(req.ApplicationID, req.GuildID, &discordgo.ApplicationCommand{
+		Name:        forumPostsCommandName,
+		Description: "Control whether the bot creates forum posts from your messages",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "opt-out",
+				Description: "Stop creating forum posts from your messages",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "opt-in",
+				Description: "Create forum posts from your questions again",
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't register slash command: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package forumpostupserter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"encore.app/discord_handler"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/bwmarrin/discordgo"
+	"github.com/samber/lo"
+)
+
+const forumPostsCommandName = "forum-posts"
+const suggestionCustomIDPrefix = "forum-post-suggestion"
+
+const (
+	suggestionActionConfirm = "confirm"
+	suggestionActionCancel  = "cancel"
+	suggestionActionOptOut  = "opt-out"
+)
+
+const interactionsSubscription = "forum-post-upserter-interactions"
+
+var _ = pubsub.NewSubscription(
+	discord_handler.DiscordInteractionTopic,
+	"forum-post-upserter-interactions",
+	pubsub.SubscriptionConfig[*models.DiscordInteractionEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-interactions", interactionsSubscription, 5, handleInteraction),
+	})
+
+func handleInteraction(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.HandleInteraction(ctx, interaction)
+}
+
+// HandleInteraction handles the forum post opt-out slash command & the buttons of forum post suggestions
+func (s *Service) HandleInteraction(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	switch {
+	case interaction.Type == discordgo.InteractionApplicationCommand && interaction.CommandName == forumPostsCommandName:
+		return s.handleForumPostsCommand(ctx, interaction)
+	case interaction.Type == discordgo.InteractionMessageComponent &&
+		strings.HasPrefix(interaction.CustomID, suggestionCustomIDPrefix+":"):
+		return s.handleSuggestionAnswer(ctx, interaction)
+	}
+
+	return nil
+}
+
+func (s *Service) handleForumPostsCommand(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	var reply string
+	switch interaction.SubCommandName {
+	case "opt-out":
+		if err := setUserOptedOut(ctx, interaction.UserID, true); err != nil {
+			return err
+		}
+		reply = "Got it, I won't create forum posts from your messages anymore."
+	case "opt-in":
+		if err := setUserOptedOut(ctx, interaction.UserID, false); err != nil {
+			return err
+		}
+		reply = "Got it, I'll create forum posts for your questions again."
+	default:
+		reply = "Unknown command, use `/forum-posts opt-out` or `/forum-posts opt-in`."
+	}
+
+	_, err := s.discordClient.FollowupMessageCreate(interaction.Interaction(), false, &discordgo.WebhookParams{
+		Content: reply,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't respond to interaction: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Service) handleSuggestionAnswer(ctx context.Context, interaction *models.DiscordInteractionEvent) error {
+	// custom IDs have the format forum-post-suggestion:<action>:<source message id>
+	parts := strings.SplitN(interaction.CustomID, ":", 3)
+	if len(parts) != 3 {
+		rlog.Warn("Ignoring malformed suggestion custom id", "customId", interaction.CustomID)
+		return nil
+	}
+
+	action, sourceMessageID := parts[1], parts[2]
+	suggestion, err := getForumPostSuggestion(ctx, sourceMessageID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		rlog.Warn("Ignoring answer for unknown suggestion", "sourceMessageId", sourceMessageID)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't get forum post suggestion: %w", err)
+	}
+
+	if suggestion.AuthorID != interaction.UserID {
+		_, err := s.discordClient.FollowupMessageCreate(interaction.Interaction(), false, &discordgo.WebhookParams{
+			Content: "Only the author of the question can answer this.",
+			Flags:   discordgo.MessageFlagsEphemeral,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't respond to interaction: %w", err)
+		}
+
+		return nil
+	}
+
+	var reply string
+	switch action {
+	case suggestionActionConfirm:
+		err := s.createForumPost(ctx, &pendingMessage{
+			MessageID: suggestion.SourceMessageID,
+			ChannelID: suggestion.SourceChannelID,
+			AuthorID:  suggestion.AuthorID,
+		}, suggestion.Title, suggestion.Content)
+		if errors.Is(err, errAuthorOptedOut) {
+			if err := setForumPostSuggestionStatus(ctx, sourceMessageID, suggestionStatusCancelled); err != nil {
+				return err
+			}
+			reply = "You opted out of forum posts, so I didn't create one. Use `/forum-posts opt-in` to undo this."
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := setForumPostSuggestionStatus(ctx, sourceMessageID, suggestionStatusConfirmed); err != nil {
+			return err
+		}
+		reply = "Thanks, I've created a forum post for your question."
+	case suggestionActionCancel:
+		if err := setForumPostSuggestionStatus(ctx, sourceMessageID, suggestionStatusCancelled); err != nil {
+			return err
+		}
+		reply = "Okay, I won't create a forum post for this question."
+	case suggestionActionOptOut:
+		if err := setUserOptedOut(ctx, suggestion.AuthorID, true); err != nil {
+			return err
+		}
+
+		if err := setForumPostSuggestionStatus(ctx, sourceMessageID, suggestionStatusCancelled); err != nil {
+			return err
+		}
+		reply = "Got it, I won't suggest forum posts for your messages anymore. Use `/forum-posts opt-in` to undo this."
+	default:
+		rlog.Warn("Ignoring unknown suggestion action", "action", action)
+		return nil
+	}
+
+	// remove the buttons from the suggestion, so it can't be answered twice
+	_, err = s.discordClient.InteractionResponseEdit(interaction.Interaction(), &discordgo.WebhookEdit{
+		Content:    lo.ToPtr(reply),
+		Components: &[]discordgo.MessageComponent{},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't update suggestion message: %w", err)
+	}
+
+	return nil
+}
+
+// suggestForumPost asks the author of a question whether a forum post should be created for it
+func (s *Service) suggestForumPost(ctx context.Context, pendingMsg *pendingMessage, title, content string) error {
+	customID := func(action string) string {
+		return fmt.Sprintf("%s:%s:%s", suggestionCustomIDPrefix, action, pendingMsg.MessageID)
+	}
+
+	suggestionMsg, err := s.discordClient.ChannelMessageSendComplex(pendingMsg.ChannelID, &discordgo.MessageSend{
+		Content: "This looks like a question for our support team. " +
+			"Should I create a forum post for it, so it doesn't get lost?",
+		Reference: &discordgo.MessageReference{
+			MessageID: pendingMsg.MessageID,
+			ChannelID: pendingMsg.ChannelID,
+		},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Create forum post",
+						Style:    discordgo.PrimaryButton,
+						CustomID: customID(suggestionActionConfirm),
+					},
+					discordgo.Button{
+						Label:    "No thanks",
+						Style:    discordgo.SecondaryButton,
+						CustomID: customID(suggestionActionCancel),
+					},
+					discordgo.Button{
+						Label:    "Never for my messages",
+						Style:    discordgo.DangerButton,
+						CustomID: customID(suggestionActionOptOut),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't send forum post suggestion: %w", err)
+	}
+
+	return addForumPostSuggestion(ctx, &forumPostSuggestion{
+		SourceMessageID: pendingMsg.MessageID,
+		SourceChannelID: pendingMsg.ChannelID,
+		AuthorID:        pendingMsg.AuthorID,
+		Title:           title,
+		Content:         content,
+	}, suggestionMsg.ID)
+}
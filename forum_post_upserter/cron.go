@@ -0,0 +1,224 @@
+package forumpostupserter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.app/models"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+	"github.com/samber/lo"
+)
+
+// settleWindow is how long to wait for follow-up messages & replies before triaging a message
+const settleWindow = 3 * time.Minute
+
+// groupingGap is the max time between consecutive messages of a user
+// for them to be treated as a single multi-message question
+const groupingGap = 2 * time.Minute
+
+// indexingTimeout is how long to wait for a message to show up in the message index before giving up on it
+const indexingTimeout = 30 * time.Minute
+
+const maxReplies = 10
+
+// maxTriageAttempts is how often triaging a message may fail before it's given up on,
+// so a message which always fails doesn't hold up the queue & keep billing the LLM
+const maxTriageAttempts = 5
+
+var _ = cron.NewJob("triage-pending-messages", cron.JobConfig{
+	Title:    "Triage community messages whose conversation settled",
+	Endpoint: TriagePendingMessages,
+	Every:    1 * cron.Minute,
+})
+
+// TriagePendingMessages triages all pending community messages which are older than the settle window.
+//
+//encore:api private method=POST path=/triage-pending-messages
+func TriagePendingMessages(ctx context.Context) error {
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.triagePendingMessages(ctx)
+}
+
+func (s *Service) triagePendingMessages(ctx context.Context) error {
+	pendingMessages, err := listPendingMessages(ctx, time.Now().Add(-settleWindow))
+	if err != nil {
+		return err
+	}
+
+	triaged := map[string]bool{}
+	for _, pendingMsg := range pendingMessages {
+		if triaged[pendingMsg.MessageID] {
+			continue
+		}
+
+		messageIDs, err := s.triageConversation(ctx, pendingMsg)
+		if err != nil {
+			rlog.Error("Couldn't triage message", "messageId", pendingMsg.MessageID, "error", err)
+			if err := recordTriageFailure(ctx, pendingMsg.MessageID, err); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, id := range messageIDs {
+			triaged[id] = true
+		}
+	}
+
+	return nil
+}
+
+// triageConversation triages the question starting at the given message together with
+// its follow-up messages by the same author. It returns the IDs of all triaged messages.
+func (s *Service) triageConversation(ctx context.Context, pendingMsg *pendingMessage) ([]string, error) {
+	resp, err := communitymessageindexer.ListMessages(ctx, &communitymessageindexer.ListMessagesRequest{
+		ChannelID: pendingMsg.ChannelID,
+		Start:     pendingMsg.CreatedAt.Add(-time.Minute).UTC(),
+		End:       time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list messages: %w", err)
+	}
+
+	question, replies := groupConversation(resp.Messages, pendingMsg.MessageID)
+	if len(question) == 0 {
+		if time.Since(pendingMsg.CreatedAt) < indexingTimeout {
+			rlog.Info("Message isn't indexed yet, will retry later", "messageId", pendingMsg.MessageID)
+			return nil, nil
+		}
+
+		rlog.Warn("Message was never indexed, ignoring it", "messageId", pendingMsg.MessageID)
+		return []string{pendingMsg.MessageID}, markMessagesTriaged(ctx, []string{pendingMsg.MessageID}, triageStatusIgnored)
+	}
+
+	messageIDs := lo.Map(question, func(message *models.DiscordRawMessage, _ int) string {
+		return message.ID
+	})
+
+	existingPost, err := getAutoCreatedForumPost(ctx, "source_message_id", pendingMsg.MessageID)
+	if err == nil && existingPost.ForumPostID != nil {
+		rlog.Info("Forum post was already created for message", "forumPostId", *existingPost.ForumPostID)
+		if err := s.linkForumPostToSourceMessage(ctx, existingPost); err != nil {
+			return nil, err
+		}
+
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusForumPostCreated)
+	} else if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, fmt.Errorf("couldn't get auto-created forum post: %w", err)
+	}
+
+	mode, err := getChannelForumPostMode(ctx, pendingMsg.ChannelID)
+	if err != nil {
+		return nil, err
+	} else if mode == ForumPostModeDisabled {
+		rlog.Info("Forum post creation is disabled for channel", "channelId", pendingMsg.ChannelID)
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusIgnored)
+	}
+
+	optedOut, err := isUserOptedOut(ctx, pendingMsg.AuthorID)
+	if err != nil {
+		return nil, err
+	} else if optedOut {
+		rlog.Info("Author opted out of forum post creation", "authorId", pendingMsg.AuthorID)
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusOptedOut)
+	}
+
+	questionContents := lo.Map(question, func(message *models.DiscordRawMessage, _ int) string {
+		return message.CleanContent
+	})
+	replyContents := lo.Map(replies, func(message *models.DiscordRawMessage, _ int) string {
+		return message.CleanContent
+	})
+
+	rlog.Info("Triaging conversation", "messageIds", messageIDs, "replies", len(replies))
+	result, err := s.llmService.TriageConversation(ctx, questionContents, replyContents)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't triage conversation: %w", err)
+	}
+
+	rlog.Info("Triage conversation result", "result", result)
+	if result.Topic == "other" {
+		rlog.Info("Ignoring conversation for topic 'other'")
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusIgnored)
+	} else if result.Answered {
+		rlog.Info("Ignoring question which was already answered in the channel")
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusAnsweredInChannel)
+	}
+
+	questionContent := strings.Join(questionContents, "\n")
+	forumPostTitle, err := s.llmService.SuggestTitleForMessage(ctx, questionContent)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't suggest title for message: %w", err)
+	}
+
+	if mode == ForumPostModeSuggest {
+		if err := s.suggestForumPost(ctx, pendingMsg, forumPostTitle, questionContent); err != nil {
+			return nil, err
+		}
+
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusSuggested)
+	}
+
+	if err := s.createForumPost(ctx, pendingMsg, forumPostTitle, questionContent); errors.Is(err, errAuthorOptedOut) {
+		return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusOptedOut)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return messageIDs, markMessagesTriaged(ctx, messageIDs, triageStatusForumPostCreated)
+}
+
+// groupConversation splits the messages following (and including) the given message into
+// the author's question, which may span several consecutive messages, and the replies to it.
+func groupConversation(
+	messages []*models.DiscordRawMessage, messageID string,
+) (question, replies []*models.DiscordRawMessage) {
+	start := lo.IndexOf(lo.Map(messages, func(message *models.DiscordRawMessage, _ int) string {
+		return message.ID
+	}), messageID)
+	if start < 0 {
+		return nil, nil
+	}
+
+	first := messages[start]
+	question = []*models.DiscordRawMessage{first}
+	lastQuestionTime := parseMessageTime(first)
+	for _, message := range messages[start+1:] {
+		if message.AuthorID != first.AuthorID {
+			if len(replies) < maxReplies {
+				replies = append(replies, message)
+			}
+
+			continue
+		}
+
+		// follow-ups by the author after someone replied are part of the conversation, not the question
+		messageTime := parseMessageTime(message)
+		if len(replies) == 0 && messageTime.Sub(lastQuestionTime) <= groupingGap {
+			question = append(question, message)
+			lastQuestionTime = messageTime
+		}
+	}
+
+	return question, replies
+}
+
+func parseMessageTime(message *models.DiscordRawMessage) time.Time {
+	t, err := time.Parse(time.RFC3339, message.CreatedAt)
+	if err != nil {
+		rlog.Warn("Couldn't parse message time", "messageId", message.ID, "createdAt", message.CreatedAt)
+	}
+
+	return t
+}
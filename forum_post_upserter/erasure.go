@@ -0,0 +1,53 @@
+package forumpostupserter
+
+import (
+	"context"
+	"fmt"
+
+	communitymessageindexer "encore.app/community_message_indexer"
+	"encore.app/models"
+	"encore.app/packages/deadletter"
+	"encore.dev/pubsub"
+	"encore.dev/rlog"
+)
+
+const userErasureSubscription = "forum-post-upserter-user-erasure"
+
+var _ = pubsub.NewSubscription(
+	communitymessageindexer.UserDataErasureTopic,
+	"forum-post-upserter-user-erasure",
+	pubsub.SubscriptionConfig[*models.UserDataErasureEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("user-data-erasures", userErasureSubscription, 5, eraseUserForumPostData),
+	})
+
+// eraseUserForumPostData removes the triage state, suggestions & forum post mappings of a user's messages.
+// The forum post opt-out is kept, dropping it would opt the user back in.
+func eraseUserForumPostData(ctx context.Context, evt *models.UserDataErasureEvent) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var erased int64
+	for _, table := range []string{"message_triage", "forum_post_suggestions", "auto_created_forum_posts"} {
+		result, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE author_id = $1", evt.UserID)
+		if err != nil {
+			return fmt.Errorf("couldn't erase user from %s: %w", table, err)
+		}
+
+		erased += result.RowsAffected()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	rlog.Info("Erased user from forum post triage", "requestId", evt.RequestID, "rows", erased)
+	return communitymessageindexer.ConfirmUserErasure(ctx, evt.RequestID, &communitymessageindexer.ConfirmUserErasureRequest{
+		Service: communitymessageindexer.ErasureServiceForumPostUpserter,
+	})
+}
@@ -0,0 +1,10 @@
+CREATE TABLE message_triage (
+    message_id VARCHAR(255) PRIMARY KEY,
+    channel_id VARCHAR(255) NOT NULL,
+    author_id VARCHAR(255) NOT NULL,
+    status VARCHAR(255) NOT NULL DEFAULT 'PENDING',
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    triaged_at TIMESTAMP
+);
+
+CREATE INDEX idx_message_triage_pending ON message_triage (created_at) WHERE status = 'PENDING';
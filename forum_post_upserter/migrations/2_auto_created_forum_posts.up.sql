@@ -0,0 +1,10 @@
+CREATE TABLE auto_created_forum_posts (
+    source_message_id VARCHAR(255) PRIMARY KEY,
+    source_channel_id VARCHAR(255) NOT NULL,
+    author_id VARCHAR(255) NOT NULL,
+    forum_post_id VARCHAR(255),
+    reply_message_id VARCHAR(255),
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX idx_auto_created_forum_posts_forum_post_id ON auto_created_forum_posts (forum_post_id);
@@ -0,0 +1,22 @@
+CREATE TABLE user_preferences (
+    user_id VARCHAR(255) PRIMARY KEY,
+    forum_post_opt_out BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE channel_settings (
+    channel_id VARCHAR(255) PRIMARY KEY,
+    forum_post_mode VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE forum_post_suggestions (
+    source_message_id VARCHAR(255) PRIMARY KEY,
+    source_channel_id VARCHAR(255) NOT NULL,
+    author_id VARCHAR(255) NOT NULL,
+    title TEXT NOT NULL,
+    content TEXT NOT NULL,
+    suggestion_message_id VARCHAR(255),
+    status VARCHAR(255) NOT NULL DEFAULT 'PENDING',
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,3 @@
+ALTER TABLE message_triage
+    ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN error TEXT;
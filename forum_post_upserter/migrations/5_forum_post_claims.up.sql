@@ -0,0 +1,7 @@
+-- the forum post of a message is created by whoever claims its mapping first,
+-- claims of attempts which crashed while creating the post expire
+ALTER TABLE auto_created_forum_posts
+    ADD COLUMN status VARCHAR(255) NOT NULL DEFAULT 'PENDING',
+    ADD COLUMN claimed_at TIMESTAMP;
+
+UPDATE auto_created_forum_posts SET status = 'CREATED' WHERE forum_post_id IS NOT NULL;
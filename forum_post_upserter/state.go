@@ -0,0 +1,337 @@
+package forumpostupserter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/models"
+	"encore.dev/storage/sqldb"
+)
+
+var db = sqldb.NewDatabase("forum_post_upserter", sqldb.DatabaseConfig{
+	Migrations: "./migrations",
+})
+
+type triageStatus string
+
+const (
+	triageStatusPending           triageStatus = "PENDING"
+	triageStatusForumPostCreated  triageStatus = "FORUM_POST_CREATED"
+	triageStatusAnsweredInChannel triageStatus = "ANSWERED_IN_CHANNEL"
+	triageStatusIgnored           triageStatus = "IGNORED"
+	triageStatusOptedOut          triageStatus = "OPTED_OUT"
+	triageStatusSuggested         triageStatus = "SUGGESTED"
+	// triageStatusFailed messages couldn't be triaged within maxTriageAttempts
+	triageStatusFailed triageStatus = "FAILED"
+)
+
+type ForumPostMode string
+
+const (
+	// ForumPostModeCreate creates forum posts for questions right away
+	ForumPostModeCreate ForumPostMode = "CREATE"
+	// ForumPostModeSuggest asks the author to confirm before creating a forum post
+	ForumPostModeSuggest ForumPostMode = "SUGGEST"
+	// ForumPostModeDisabled never creates forum posts for the channel
+	ForumPostModeDisabled ForumPostMode = "DISABLED"
+)
+
+// defaultForumPostMode applies to channels which weren't configured explicitly
+const defaultForumPostMode = ForumPostModeCreate
+
+type suggestionStatus string
+
+const (
+	suggestionStatusPending   suggestionStatus = "PENDING"
+	suggestionStatusConfirmed suggestionStatus = "CONFIRMED"
+	suggestionStatusCancelled suggestionStatus = "CANCELLED"
+)
+
+// pendingMessage is a community message waiting for the conversation around it to settle before triage
+type pendingMessage struct {
+	MessageID string
+	ChannelID string
+	AuthorID  string
+	CreatedAt time.Time
+}
+
+func addPendingMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO message_triage (message_id, channel_id, author_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (message_id) DO NOTHING
+	`, message.ID, message.ChannelID, message.AuthorID)
+	if err != nil {
+		return fmt.Errorf("couldn't add pending message: %w", err)
+	}
+
+	return nil
+}
+
+func listPendingMessages(ctx context.Context, createdBefore time.Time) ([]*pendingMessage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT message_id, channel_id, author_id, created_at
+		FROM message_triage
+		WHERE status = $1 AND created_at < $2
+		ORDER BY created_at
+	`, triageStatusPending, createdBefore)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list pending messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*pendingMessage
+	for rows.Next() {
+		var message pendingMessage
+		if err := rows.Scan(&message.MessageID, &message.ChannelID, &message.AuthorID, &message.CreatedAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan pending message: %w", err)
+		}
+
+		messages = append(messages, &message)
+	}
+
+	return messages, rows.Err()
+}
+
+func markMessagesTriaged(ctx context.Context, messageIDs []string, status triageStatus) error {
+	_, err := db.Exec(ctx, `
+		UPDATE message_triage
+		SET status = $2, triaged_at = now()
+		WHERE message_id = ANY($1) AND status = $3
+	`, messageIDs, status, triageStatusPending)
+	if err != nil {
+		return fmt.Errorf("couldn't mark messages as triaged: %w", err)
+	}
+
+	return nil
+}
+
+// recordTriageFailure counts a failed triage attempt, the message is marked as failed after maxTriageAttempts
+func recordTriageFailure(ctx context.Context, messageID string, triageErr error) error {
+	_, err := db.Exec(ctx, `
+		UPDATE message_triage
+		SET attempts = attempts + 1,
+			error = $2,
+			status = CASE WHEN attempts + 1 >= $3 THEN $4 ELSE status END,
+			triaged_at = CASE WHEN attempts + 1 >= $3 THEN now() ELSE triaged_at END
+		WHERE message_id = $1 AND status = $5
+	`, messageID, triageErr.Error(), maxTriageAttempts, triageStatusFailed, triageStatusPending)
+	if err != nil {
+		return fmt.Errorf("couldn't record triage failure: %w", err)
+	}
+
+	return nil
+}
+
+type forumPostCreationStatus string
+
+const (
+	forumPostCreationStatusPending  forumPostCreationStatus = "PENDING"
+	forumPostCreationStatusCreating forumPostCreationStatus = "CREATING"
+	forumPostCreationStatusCreated  forumPostCreationStatus = "CREATED"
+)
+
+// forumPostClaimTimeout is after how long a claim to create a forum post is considered abandoned
+const forumPostClaimTimeout = 10 * time.Minute
+
+// AutoCreatedForumPost maps a community message to the forum post created for it
+type AutoCreatedForumPost struct {
+	SourceMessageID string  `json:"sourceMessageId"`
+	SourceChannelID string  `json:"sourceChannelId"`
+	AuthorID        string  `json:"authorId"`
+	ForumPostID     *string `json:"forumPostId"`
+	ReplyMessageID  *string `json:"replyMessageId"`
+}
+
+// getOrAddAutoCreatedForumPost returns the forum post mapping for the given message,
+// creating an empty one if it doesn't exist yet.
+func getOrAddAutoCreatedForumPost(
+	ctx context.Context, sourceMessageID, sourceChannelID, authorID string,
+) (*AutoCreatedForumPost, error) {
+	_, err := db.Exec(ctx, `
+		INSERT INTO auto_created_forum_posts (source_message_id, source_channel_id, author_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (source_message_id) DO NOTHING
+	`, sourceMessageID, sourceChannelID, authorID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't add auto-created forum post: %w", err)
+	}
+
+	return getAutoCreatedForumPost(ctx, "source_message_id", sourceMessageID)
+}
+
+func getAutoCreatedForumPost(ctx context.Context, column, id string) (*AutoCreatedForumPost, error) {
+	var post AutoCreatedForumPost
+	err := db.QueryRow(ctx, `
+		SELECT source_message_id, source_channel_id, author_id, forum_post_id, reply_message_id
+		FROM auto_created_forum_posts
+		WHERE `+column+` = $1
+	`, id).Scan(&post.SourceMessageID, &post.SourceChannelID, &post.AuthorID, &post.ForumPostID, &post.ReplyMessageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &post, nil
+}
+
+// claimAutoCreatedForumPost reserves the creation of the message's forum post, so concurrent or
+// re-delivered triages can't create a second one. It returns false if the post exists or is being created.
+func claimAutoCreatedForumPost(ctx context.Context, sourceMessageID string) (bool, error) {
+	result, err := db.Exec(ctx, `
+		UPDATE auto_created_forum_posts
+		SET status = $2, claimed_at = now()
+		WHERE source_message_id = $1 AND forum_post_id IS NULL
+		  AND (status = $3 OR (status = $2 AND claimed_at < $4))
+	`, sourceMessageID, forumPostCreationStatusCreating, forumPostCreationStatusPending,
+		time.Now().Add(-forumPostClaimTimeout).UTC())
+	if err != nil {
+		return false, fmt.Errorf("couldn't claim auto-created forum post: %w", err)
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// releaseAutoCreatedForumPost gives up a claim after failing to create the forum post
+func releaseAutoCreatedForumPost(ctx context.Context, sourceMessageID string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE auto_created_forum_posts SET status = $2 WHERE source_message_id = $1 AND status = $3
+	`, sourceMessageID, forumPostCreationStatusPending, forumPostCreationStatusCreating)
+	if err != nil {
+		return fmt.Errorf("couldn't release auto-created forum post: %w", err)
+	}
+
+	return nil
+}
+
+func setAutoCreatedForumPostID(ctx context.Context, sourceMessageID, forumPostID string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE auto_created_forum_posts SET forum_post_id = $2, status = $3 WHERE source_message_id = $1
+	`, sourceMessageID, forumPostID, forumPostCreationStatusCreated)
+	if err != nil {
+		return fmt.Errorf("couldn't set forum post of auto-created forum post: %w", err)
+	}
+
+	return nil
+}
+
+func setAutoCreatedForumPostReply(ctx context.Context, sourceMessageID, replyMessageID string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE auto_created_forum_posts SET reply_message_id = $2 WHERE source_message_id = $1
+	`, sourceMessageID, replyMessageID)
+	if err != nil {
+		return fmt.Errorf("couldn't set reply of auto-created forum post: %w", err)
+	}
+
+	return nil
+}
+
+func isUserOptedOut(ctx context.Context, userID string) (bool, error) {
+	var optedOut bool
+	err := db.QueryRow(ctx, `
+		SELECT forum_post_opt_out FROM user_preferences WHERE user_id = $1
+	`, userID).Scan(&optedOut)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("couldn't get user preferences: %w", err)
+	}
+
+	return optedOut, nil
+}
+
+func setUserOptedOut(ctx context.Context, userID string, optedOut bool) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO user_preferences (user_id, forum_post_opt_out)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET
+			forum_post_opt_out = EXCLUDED.forum_post_opt_out,
+			updated_at = now()
+	`, userID, optedOut)
+	if err != nil {
+		return fmt.Errorf("couldn't set user preferences: %w", err)
+	}
+
+	return nil
+}
+
+func getChannelForumPostMode(ctx context.Context, channelID string) (ForumPostMode, error) {
+	var mode ForumPostMode
+	err := db.QueryRow(ctx, `
+		SELECT forum_post_mode FROM channel_settings WHERE channel_id = $1
+	`, channelID).Scan(&mode)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return defaultForumPostMode, nil
+	} else if err != nil {
+		return "", fmt.Errorf("couldn't get channel settings: %w", err)
+	}
+
+	return mode, nil
+}
+
+func setChannelForumPostMode(ctx context.Context, channelID string, mode ForumPostMode) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO channel_settings (channel_id, forum_post_mode)
+		VALUES ($1, $2)
+		ON CONFLICT (channel_id) DO UPDATE SET
+			forum_post_mode = EXCLUDED.forum_post_mode,
+			updated_at = now()
+	`, channelID, mode)
+	if err != nil {
+		return fmt.Errorf("couldn't set channel settings: %w", err)
+	}
+
+	return nil
+}
+
+// forumPostSuggestion is a forum post awaiting confirmation by the author of the question
+type forumPostSuggestion struct {
+	SourceMessageID string
+	SourceChannelID string
+	AuthorID        string
+	Title           string
+	Content         string
+	Status          suggestionStatus
+}
+
+func addForumPostSuggestion(ctx context.Context, suggestion *forumPostSuggestion, suggestionMessageID string) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO forum_post_suggestions (
+			source_message_id, source_channel_id, author_id, title, content, suggestion_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source_message_id) DO NOTHING
+	`, suggestion.SourceMessageID, suggestion.SourceChannelID, suggestion.AuthorID,
+		suggestion.Title, suggestion.Content, suggestionMessageID)
+	if err != nil {
+		return fmt.Errorf("couldn't add forum post suggestion: %w", err)
+	}
+
+	return nil
+}
+
+func getForumPostSuggestion(ctx context.Context, sourceMessageID string) (*forumPostSuggestion, error) {
+	var suggestion forumPostSuggestion
+	err := db.QueryRow(ctx, `
+		SELECT source_message_id, source_channel_id, author_id, title, content, status
+		FROM forum_post_suggestions
+		WHERE source_message_id = $1
+	`, sourceMessageID).Scan(&suggestion.SourceMessageID, &suggestion.SourceChannelID,
+		&suggestion.AuthorID, &suggestion.Title, &suggestion.Content, &suggestion.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &suggestion, nil
+}
+
+func setForumPostSuggestionStatus(ctx context.Context, sourceMessageID string, status suggestionStatus) error {
+	_, err := db.Exec(ctx, `
+		UPDATE forum_post_suggestions SET status = $2 WHERE source_message_id = $1
+	`, sourceMessageID, status)
+	if err != nil {
+		return fmt.Errorf("couldn't update forum post suggestion: %w", err)
+	}
+
+	return nil
+}
@@ -2,10 +2,13 @@ package forumpostupserter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	communitymessagemapper "encore.app/community_message_mapper"
+	deadletterqueue "encore.app/dead_letter_queue"
 	"encore.app/models"
+	"encore.app/packages/deadletter"
 	"encore.app/packages/llmservice"
 	"encore.dev/pubsub"
 	"encore.dev/rlog"
@@ -40,60 +43,145 @@ func initService() (*Service, error) {
 	return &Service{llmService: llmService, discordClient: discordClient}, nil
 }
 
+const upserterSubscription = "forum-post-upserter"
+
 var _ = pubsub.NewSubscription(
 	communitymessagemapper.DiscordCommunityMessageTopic,
 	"forum-post-upserter",
 	pubsub.SubscriptionConfig[*models.DiscordCommunityMessageEvent]{
-		Handler: func(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
-			rlog.Info("Received new community message", "discordMessage", message)
-			service, err := initService()
-			if err != nil {
-				return fmt.Errorf("couldn't create service: %w", err)
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: deadletter.Handler("discord-community-messages", upserterSubscription, 5, handleCommunityMessage),
+	})
+
+func handleCommunityMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
+	rlog.Info("Received new community message", "discordMessage", message)
+	service, err := initService()
+	if err != nil {
+		return fmt.Errorf("couldn't create service: %w", err)
+	}
+
+	return service.TriageDiscordMessage(ctx, message)
+}
+
+var _ = pubsub.NewSubscription(
+	deadletterqueue.DeadLetterReplayTopic,
+	"forum-post-upserter-dead-letter-replay",
+	pubsub.SubscriptionConfig[*models.DeadLetterReplayEvent]{
+		RetryPolicy: &pubsub.RetryPolicy{
+			MaxRetries: 5,
+		},
+		Handler: func(ctx context.Context, evt *models.DeadLetterReplayEvent) error {
+			switch evt.Subscription {
+			case upserterSubscription:
+				return deadletter.Replay(ctx, evt, handleCommunityMessage)
+			case interactionsSubscription:
+				return deadletter.Replay(ctx, evt, handleInteraction)
+			case userErasureSubscription:
+				return deadletter.Replay(ctx, evt, eraseUserForumPostData)
 			}
 
-			return service.TriageDiscordMessage(ctx, message)
+			return nil
 		},
 	})
 
+// TriageDiscordMessage queues a community message for triage.
+// Messages are triaged once the conversation around them settles, see triagePendingMessages.
 func (s *Service) TriageDiscordMessage(ctx context.Context, message *models.DiscordCommunityMessageEvent) error {
 	if message.Content == "" {
 		rlog.Info("Ignoring empty message")
 		return nil
+	} else if message.ThreadID != "" {
+		// questions in threads already have a place to be answered
+		rlog.Info("Ignoring message posted in a thread")
+		return nil
+	} else if message.ReferencedMessageID != "" {
+		// replies are part of someone else's conversation, which is triaged from its first message
+		rlog.Info("Ignoring reply to another message")
+		return nil
 	}
 
-	discordChannel, err := s.discordClient.Channel(message.ChannelID)
+	return addPendingMessage(ctx, message)
+}
+
+// errAuthorOptedOut is returned when no forum post was created because its author opted out
+var errAuthorOptedOut = errors.New("author opted out of forum post creation")
+
+// createForumPost creates a forum post for a question asked in a community channel
+// & links it back to the original message. The message to forum post mapping is claimed
+// before creating the post, so that concurrent or re-delivered triages don't produce a second post.
+func (s *Service) createForumPost(ctx context.Context, pendingMsg *pendingMessage, title, content string) error {
+	post, err := getOrAddAutoCreatedForumPost(ctx, pendingMsg.MessageID, pendingMsg.ChannelID, pendingMsg.AuthorID)
 	if err != nil {
-		return fmt.Errorf("couldn't get discord channel: %w", err)
+		return err
 	}
 
-	rlog.Info("Handling message", "messageId", message.ID, "channelName", discordChannel.Name)
-	topic, err := s.llmService.TriageMessageTopic(ctx, message.CleanContent)
+	// consent is checked right before posting, as the author may have opted out after the question was triaged
+	optedOut, err := isUserOptedOut(ctx, pendingMsg.AuthorID)
 	if err != nil {
-		return fmt.Errorf("couldn't triage message topic: %w", err)
+		return err
+	} else if optedOut && post.ForumPostID == nil {
+		rlog.Info("Not creating forum post for author who opted out", "authorId", pendingMsg.AuthorID)
+		return errAuthorOptedOut
+	}
+
+	if post.ForumPostID == nil {
+		claimed, err := claimAutoCreatedForumPost(ctx, pendingMsg.MessageID)
+		if err != nil {
+			return err
+		} else if !claimed {
+			rlog.Info("Forum post is already being created for message", "messageId", pendingMsg.MessageID)
+			return nil
+		}
+
+		forumPost, err := s.discordClient.ForumThreadStart(
+			forumChannelID, title, 0, formatAutoGeneratedForumPostMessage(pendingMsg.AuthorID, pendingMsg.ChannelID, content))
+		if err != nil {
+			if err := releaseAutoCreatedForumPost(ctx, pendingMsg.MessageID); err != nil {
+				rlog.Error("Couldn't release auto-created forum post", "messageId", pendingMsg.MessageID, "error", err)
+			}
+
+			return fmt.Errorf("couldn't send message to forum channel: %w", err)
+		}
+
+		if err := setAutoCreatedForumPostID(ctx, pendingMsg.MessageID, forumPost.ID); err != nil {
+			return err
+		}
+
+		post.ForumPostID = &forumPost.ID
 	}
 
-	rlog.Info("Triage topic result", "result", topic)
-	if topic == "other" {
-		rlog.Info("Ignoring message for topic 'other'")
+	return s.linkForumPostToSourceMessage(ctx, post)
+}
+
+// linkForumPostToSourceMessage adds the author to the forum post &
+// replies to their original message with a link to it
+func (s *Service) linkForumPostToSourceMessage(ctx context.Context, post *AutoCreatedForumPost) error {
+	if post.ReplyMessageID != nil {
 		return nil
 	}
 
-	forumPostTitle, err := s.llmService.SuggestTitleForMessage(ctx, message.CleanContent)
-	if err != nil {
-		return fmt.Errorf("couldn't suggest title for message: %w", err)
+	if err := s.discordClient.ThreadMemberAdd(*post.ForumPostID, post.AuthorID); err != nil {
+		rlog.Warn("Couldn't add author to forum post", "forumPostId", *post.ForumPostID, "error", err)
 	}
 
-	_, err = s.discordClient.ForumThreadStart(
-		forumChannelID, forumPostTitle, 0, formatAutoGeneratedForumPostMessage(message))
+	reply, err := s.discordClient.ChannelMessageSendReply(post.SourceChannelID,
+		fmt.Sprintf("I've created a forum post for your question so it doesn't get lost, let's continue there: <#%s>",
+			*post.ForumPostID),
+		&discordgo.MessageReference{
+			MessageID: post.SourceMessageID,
+			ChannelID: post.SourceChannelID,
+		})
 	if err != nil {
-		return fmt.Errorf("couldn't send message to forum channel: %w", err)
+		return fmt.Errorf("couldn't reply to source message: %w", err)
 	}
 
-	return nil
+	return setAutoCreatedForumPostReply(ctx, post.SourceMessageID, reply.ID)
 }
 
-func formatAutoGeneratedForumPostMessage(message *models.DiscordCommunityMessageEvent) string {
+func formatAutoGeneratedForumPostMessage(authorID, channelID, content string) string {
 	return fmt.Sprintf(
 		"New support request by <@%s> in <#%s>:\n---\n%s\n---\n\nPlease provide any other relevant info in this post...",
-		message.AuthorID, message.ChannelID, message.CleanContent)
+		authorID, channelID, content)
 }
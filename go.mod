@@ -6,16 +6,17 @@ toolchain go1.21.6
 
 require (
 	encore.dev v1.34.3
+	github.com/Kunde21/markdownfmt/v3 v3.1.0
 	github.com/bbalet/stopwords v1.0.0
 	github.com/bwmarrin/discordgo v0.28.1
 	github.com/google/uuid v1.6.0
 	github.com/pinecone-io/go-pinecone v0.4.1
 	github.com/samber/lo v1.39.0
 	github.com/tyloafer/langchaingo v0.0.0-20240120140825-7b6d5691234d
+	google.golang.org/protobuf v1.32.0
 )
 
 require (
-	github.com/Kunde21/markdownfmt/v3 v3.1.0 // indirect
 	github.com/PuerkitoBio/goquery v1.8.1 // indirect
 	github.com/andybalholm/cascadia v1.3.1 // indirect
 	github.com/antchfx/htmlquery v1.3.0 // indirect
@@ -51,5 +52,4 @@ require (
 	google.golang.org/genproto/googleapis/api v0.0.0-20240221002015-b0ce06bbee7c // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240221002015-b0ce06bbee7c // indirect
 	google.golang.org/grpc v1.62.0 // indirect
-	google.golang.org/protobuf v1.32.0 // indirect
 )
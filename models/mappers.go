@@ -2,19 +2,23 @@ package models
 
 import (
 	"fmt"
+	"time"
 
 	"encore.dev/storage/sqldb"
 )
 
 func MapDiscordRawMessageFromSQLRow(row *sqldb.Row) (*DiscordRawMessage, error) {
 	var message DiscordRawMessage
+	var createdAt time.Time
 	err := row.Scan(
 		&message.ID, &message.InteractionType, &message.ChannelID,
-		&message.GuildID, &message.AuthorID, &message.Content, &message.CleanContent)
+		&message.GuildID, &message.AuthorID, &message.Content, &message.CleanContent, &createdAt)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't scan message: %w", err)
 	}
 
+	message.CreatedAt = createdAt.Format(time.RFC3339)
+
 	return &message, nil
 }
 
@@ -22,13 +26,16 @@ func MapDiscordRawMessagesFromSQLRows(rows *sqldb.Rows) ([]*DiscordRawMessage, e
 	var messages []*DiscordRawMessage
 	for rows.Next() {
 		var message DiscordRawMessage
+		var createdAt time.Time
 		err := rows.Scan(
 			&message.ID, &message.InteractionType, &message.ChannelID,
-			&message.GuildID, &message.AuthorID, &message.Content, &message.CleanContent)
+			&message.GuildID, &message.AuthorID, &message.Content, &message.CleanContent, &createdAt)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't scan message: %w", err)
 		}
 
+		message.CreatedAt = createdAt.Format(time.RFC3339)
+
 		messages = append(messages, &message)
 	}
 
@@ -40,7 +47,10 @@ func MapConversationAlertsFromSQLRows(rows *sqldb.Rows) ([]*ConversationAlert, e
 	for rows.Next() {
 		var cv ConversationAlert
 		err := rows.Scan(
-			&cv.ID, &cv.Keywords, &cv.Topics, &cv.ChannelID)
+			&cv.ID, &cv.Keywords, &cv.Topics, &cv.ChannelID, &cv.Name, &cv.Description,
+			&cv.CreatedBy, &cv.Paused, &cv.CreatedAt, &cv.UpdatedAt, &cv.WatchedChannelIDs,
+			&cv.DestinationType, &cv.DestinationUserIDs, &cv.DestinationRoleIDs, &cv.Rule,
+			&cv.DeliveryMode, &cv.CooldownMinutes, &cv.LastNotifiedAt)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't scan message: %w", err)
 		}
@@ -51,6 +61,41 @@ func MapConversationAlertsFromSQLRows(rows *sqldb.Rows) ([]*ConversationAlert, e
 	return cvs, nil
 }
 
+func MapForumPostTagChangesFromSQLRows(rows *sqldb.Rows) ([]*ForumPostTagChange, error) {
+	var changes []*ForumPostTagChange
+	for rows.Next() {
+		var change ForumPostTagChange
+		err := rows.Scan(
+			&change.ID, &change.ForumPostID, &change.TagIDs, &change.TagNames,
+			&change.AppliedBy, &change.Action, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan forum post tag change: %w", err)
+		}
+
+		changes = append(changes, &change)
+	}
+
+	return changes, nil
+}
+
+func MapDeadLettersFromSQLRows(rows *sqldb.Rows) ([]*DeadLetter, error) {
+	var deadLetters []*DeadLetter
+	for rows.Next() {
+		var deadLetter DeadLetter
+		err := rows.Scan(
+			&deadLetter.ID, &deadLetter.Topic, &deadLetter.Subscription, &deadLetter.Payload,
+			&deadLetter.Error, &deadLetter.Attempts, &deadLetter.ReplayCount, &deadLetter.Status,
+			&deadLetter.CreatedAt, &deadLetter.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan dead letter: %w", err)
+		}
+
+		deadLetters = append(deadLetters, &deadLetter)
+	}
+
+	return deadLetters, nil
+}
+
 func MapWebScrapeJobsFromSQLRows(rows *sqldb.Rows) ([]*WebScrapeJob, error) {
 	var wsjs []*WebScrapeJob
 	for rows.Next() {
@@ -65,3 +110,111 @@ func MapWebScrapeJobsFromSQLRows(rows *sqldb.Rows) ([]*WebScrapeJob, error) {
 
 	return wsjs, nil
 }
+
+func MapAlertNotificationsFromSQLRows(rows *sqldb.Rows) ([]*AlertNotification, error) {
+	var notifications []*AlertNotification
+	for rows.Next() {
+		var notification AlertNotification
+		err := rows.Scan(
+			&notification.ID, &notification.AlertID, &notification.DiscordChannelID, &notification.DiscordMessageID,
+			&notification.MatchCount, &notification.Status, &notification.AssigneeID, &notification.HandledBy,
+			&notification.SnoozedUntil, &notification.FirstResponseAt, &notification.CreatedAt, &notification.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan alert notification: %w", err)
+		}
+
+		if notification.FirstResponseAt != nil {
+			responseSeconds := notification.FirstResponseAt.Sub(notification.CreatedAt).Seconds()
+			notification.ResponseSeconds = &responseSeconds
+		}
+
+		notifications = append(notifications, &notification)
+	}
+
+	return notifications, nil
+}
+
+func MapInsightBucketsFromSQLRows(rows *sqldb.Rows) ([]*InsightBucket, error) {
+	var buckets []*InsightBucket
+	for rows.Next() {
+		var bucket InsightBucket
+		err := rows.Scan(
+			&bucket.BucketStart, &bucket.Status, &bucket.Attempts, &bucket.Error,
+			&bucket.AnalyzedMessages, &bucket.SkippedMessages, &bucket.EstimatedTokens,
+			&bucket.ProcessedAt, &bucket.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan insight bucket: %w", err)
+		}
+
+		buckets = append(buckets, &bucket)
+	}
+
+	return buckets, nil
+}
+
+func MapMessageRepliesFromSQLRows(rows *sqldb.Rows) ([]*MessageReply, error) {
+	var replies []*MessageReply
+	for rows.Next() {
+		var reply MessageReply
+		err := rows.Scan(
+			&reply.MessageID, &reply.AuthorID, &reply.ChannelID, &reply.CreatedAt,
+			&reply.ReferencedMessageID, &reply.ReferencedAuthorID)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan message reply: %w", err)
+		}
+
+		replies = append(replies, &reply)
+	}
+
+	return replies, nil
+}
+
+func MapRetentionPoliciesFromSQLRows(rows *sqldb.Rows) ([]*RetentionPolicy, error) {
+	var policies []*RetentionPolicy
+	for rows.Next() {
+		var policy RetentionPolicy
+		err := rows.Scan(&policy.GuildID, &policy.ChannelID, &policy.RetentionDays, &policy.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan retention policy: %w", err)
+		}
+
+		policies = append(policies, &policy)
+	}
+
+	return policies, nil
+}
+
+func MapMessageArchivesFromSQLRows(rows *sqldb.Rows) ([]*MessageArchive, error) {
+	var archives []*MessageArchive
+	for rows.Next() {
+		var archive MessageArchive
+		err := rows.Scan(
+			&archive.ID, &archive.GuildID, &archive.ChannelID, &archive.MessageCount,
+			&archive.OldestMessageAt, &archive.NewestMessageAt, &archive.CreatedAt, &archive.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan message archive: %w", err)
+		}
+
+		archives = append(archives, &archive)
+	}
+
+	return archives, nil
+}
+
+func MapUserErasureRequestsFromSQLRows(rows *sqldb.Rows) ([]*UserErasureRequest, error) {
+	var requests []*UserErasureRequest
+	for rows.Next() {
+		var request UserErasureRequest
+		err := rows.Scan(
+			&request.ID, &request.UserID, &request.RequestedBy, &request.Reason, &request.Status,
+			&request.ErasedMessages, &request.ErasedVectors, &request.RewrittenArchives,
+			&request.InsightsErasedAt, &request.ConfirmedServices, &request.CreatedAt, &request.CompletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't scan user erasure request: %w", err)
+		}
+
+		requests = append(requests, &request)
+	}
+
+	return requests, nil
+}
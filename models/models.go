@@ -1,6 +1,9 @@
 package models
 
 import (
+	"encoding/json"
+	"time"
+
 	"encore.app/packages/apify"
 	"github.com/bwmarrin/discordgo"
 )
@@ -14,11 +17,62 @@ type DiscordRawMessage struct {
 	Content         string                    `json:"content"`
 	CleanContent    string                    `json:"cleanContent"`
 	CreatedAt       string                    `json:"created_at"`
+	// Structure is sent along by the webhook proxy from the gateway event,
+	// it's only set on messages published to DiscordRawMessageTopic
+	Structure *DiscordMessageStructure `json:"structure,omitempty"`
+}
+
+// DiscordInteractionEvent is a slash command invocation or a message component (ie button) click
+type DiscordInteractionEvent struct {
+	ID        string                    `json:"id"`
+	AppID     string                    `json:"appId"`
+	Token     string                    `json:"token"`
+	Type      discordgo.InteractionType `json:"type"`
+	GuildID   string                    `json:"guildId"`
+	ChannelID string                    `json:"channelId"`
+	UserID    string                    `json:"userId"`
+	// MessageID is the message a clicked component is attached to
+	MessageID string `json:"messageId"`
+	// CommandName is set for slash commands, together with the name of the invoked sub-command if any
+	CommandName    string `json:"commandName"`
+	SubCommandName string `json:"subCommandName"`
+	// CustomID is set for message components
+	CustomID string `json:"customId"`
+}
+
+// Interaction returns the interaction in the shape the discord client expects for responding to it
+func (e *DiscordInteractionEvent) Interaction() *discordgo.Interaction {
+	return &discordgo.Interaction{ID: e.ID, AppID: e.AppID, Token: e.Token, Type: e.Type}
+}
+
+// DiscordThreadUpdateEvent is a change of a thread's name or tags, forwarded from the gateway
+type DiscordThreadUpdateEvent struct {
+	ID          string   `json:"id"`
+	GuildID     string   `json:"guildId"`
+	ParentID    string   `json:"parentId"`
+	Name        string   `json:"name"`
+	AppliedTags []string `json:"appliedTags"`
 }
 
 type DiscordForumPostEvent struct {
 	ID      string `json:"id"`
 	GuildID string `json:"guildId"`
+	Title   string `json:"title"`
+}
+
+type TaggedDiscordForumPostEvent struct {
+	ID       string   `json:"id"`
+	GuildID  string   `json:"guildId"`
+	TagIDs   []string `json:"tagIds"`
+	TagNames []string `json:"tagNames"`
+}
+
+// ForumPostTagsChangedEvent is published whenever the tags of a forum post change, by the bot or a human
+type ForumPostTagsChangedEvent struct {
+	ID        string    `json:"id"`
+	TagIDs    []string  `json:"tagIds"`
+	TagNames  []string  `json:"tagNames"`
+	ChangedAt time.Time `json:"changedAt"`
 }
 
 type DuplicateDiscordForumPostEvent struct {
@@ -35,13 +89,209 @@ type DiscordCommunityMessageEvent struct {
 	AuthorID        string                    `json:"authorId"`
 	Content         string                    `json:"content"`
 	CleanContent    string                    `json:"cleanContent"`
+	DiscordMessageStructure
 }
 
+// DiscordMessageStructure describes how a message relates to other messages & what it contains besides text
+type DiscordMessageStructure struct {
+	// ReferencedMessageID is the message this message replies to
+	ReferencedMessageID string `json:"referencedMessageId,omitempty"`
+	// ThreadID is set for messages posted in a thread, in which case it equals the channel id
+	ThreadID string `json:"threadId,omitempty"`
+	// ParentChannelID is the channel the thread of the message belongs to
+	ParentChannelID  string                      `json:"parentChannelId,omitempty"`
+	Attachments      []*DiscordMessageAttachment `json:"attachments,omitempty"`
+	Embeds           []*DiscordMessageEmbed      `json:"embeds,omitempty"`
+	MentionedUserIDs []string                    `json:"mentionedUserIds,omitempty"`
+	MentionedRoleIDs []string                    `json:"mentionedRoleIds,omitempty"`
+	MentionsEveryone bool                        `json:"mentionsEveryone,omitempty"`
+	// AuthorBot is set for messages posted by a bot, ours or another one
+	AuthorBot bool `json:"authorBot,omitempty"`
+	// Timestamp is when the message was posted according to Discord
+	Timestamp       time.Time  `json:"timestamp"`
+	EditedTimestamp *time.Time `json:"editedTimestamp,omitempty"`
+}
+
+type DiscordMessageAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	URL         string `json:"url"`
+	Size        int    `json:"size"`
+}
+
+type DiscordMessageEmbed struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+type AlertDestinationType string
+
+const (
+	// AlertDestinationChannel sends alerts to the alert's channel
+	AlertDestinationChannel AlertDestinationType = "CHANNEL"
+	// AlertDestinationDM sends alerts as direct messages to the alert's users
+	AlertDestinationDM AlertDestinationType = "DM"
+	// AlertDestinationRole sends alerts to the alert's channel, mentioning the alert's roles
+	AlertDestinationRole AlertDestinationType = "ROLE"
+)
+
+type AlertDeliveryMode string
+
+const (
+	// AlertDeliveryImmediate delivers matches right away, at most once per cooldown
+	AlertDeliveryImmediate AlertDeliveryMode = "IMMEDIATE"
+	// AlertDeliveryHourlyDigest delivers the matches of the past hour at once
+	AlertDeliveryHourlyDigest AlertDeliveryMode = "HOURLY_DIGEST"
+	// AlertDeliveryDailyDigest delivers the matches of the past day at once
+	AlertDeliveryDailyDigest AlertDeliveryMode = "DAILY_DIGEST"
+)
+
 type ConversationAlert struct {
-	ID        string   `json:"id"`
-	Keywords  []string `json:"keywords"`
-	Topics    []string `json:"topics"`
-	ChannelID string   `json:"channel"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+	Topics      []string `json:"topics"`
+	// WatchedChannelIDs are the channels scanned for matching messages, all channels if empty
+	WatchedChannelIDs  []string             `json:"watchedChannelIds"`
+	DestinationType    AlertDestinationType `json:"destinationType"`
+	ChannelID          string               `json:"channel"`
+	DestinationUserIDs []string             `json:"destinationUserIds"`
+	DestinationRoleIDs []string             `json:"destinationRoleIds"`
+	Rule               AlertRule            `json:"rule"`
+	DeliveryMode       AlertDeliveryMode    `json:"deliveryMode"`
+	// CooldownMinutes is the minimum time between two notifications of the alert
+	CooldownMinutes int        `json:"cooldownMinutes"`
+	LastNotifiedAt  *time.Time `json:"lastNotifiedAt"`
+	Paused          bool       `json:"paused"`
+	CreatedBy       string     `json:"createdBy"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+type AlertNotificationStatus string
+
+const (
+	AlertNotificationStatusOpen         AlertNotificationStatus = "OPEN"
+	AlertNotificationStatusSnoozed      AlertNotificationStatus = "SNOOZED"
+	AlertNotificationStatusAcknowledged AlertNotificationStatus = "ACKNOWLEDGED"
+	// AlertNotificationStatusFalsePositive marks notifications whose matches shouldn't have fired
+	AlertNotificationStatusFalsePositive AlertNotificationStatus = "FALSE_POSITIVE"
+	// AlertNotificationStatusFailed marks notifications which couldn't be sent after all their attempts
+	AlertNotificationStatusFailed AlertNotificationStatus = "FAILED"
+)
+
+// AlertNotification is a delivered conversation alert message & its triage state
+type AlertNotification struct {
+	ID               int64                   `json:"id"`
+	AlertID          string                  `json:"alertId"`
+	DiscordChannelID string                  `json:"discordChannelId"`
+	DiscordMessageID string                  `json:"discordMessageId"`
+	MatchCount       int                     `json:"matchCount"`
+	Status           AlertNotificationStatus `json:"status"`
+	AssigneeID       string                  `json:"assigneeId"`
+	HandledBy        string                  `json:"handledBy"`
+	SnoozedUntil     *time.Time              `json:"snoozedUntil"`
+	FirstResponseAt  *time.Time              `json:"firstResponseAt"`
+	// ResponseSeconds is the time until a moderator first acknowledged, assigned or dismissed the notification
+	ResponseSeconds *float64  `json:"responseSeconds"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// AlertExpression is a boolean expression over the content of a message.
+// Exactly one of its fields is set.
+type AlertExpression struct {
+	// Keyword matches the words of the keyword in sequence, ignoring case & punctuation
+	Keyword string `json:"keyword,omitempty"`
+	// Phrase matches the exact phrase, ignoring case
+	Phrase string             `json:"phrase,omitempty"`
+	Regex  string             `json:"regex,omitempty"`
+	And    []*AlertExpression `json:"and,omitempty"`
+	Or     []*AlertExpression `json:"or,omitempty"`
+	Not    *AlertExpression   `json:"not,omitempty"`
+}
+
+// AlertRule refines which messages a conversation alert fires for.
+// Messages match if they match the alert's keywords or the Match expression, and pass all filters.
+// The filters also apply to messages matching the alert's topics.
+type AlertRule struct {
+	Match             *AlertExpression `json:"match,omitempty"`
+	IncludeAuthorIDs  []string         `json:"includeAuthorIds,omitempty"`
+	ExcludeAuthorIDs  []string         `json:"excludeAuthorIds,omitempty"`
+	IncludeRoleIDs    []string         `json:"includeRoleIds,omitempty"`
+	ExcludeRoleIDs    []string         `json:"excludeRoleIds,omitempty"`
+	ExcludeChannelIDs []string         `json:"excludeChannelIds,omitempty"`
+	// MinSentimentSeverity only lets through messages at least this negative, ie NEUTRAL or NEGATIVE
+	MinSentimentSeverity MessageSentiment `json:"minSentimentSeverity,omitempty"`
+}
+
+type ForumPostTagChangeSource string
+
+const (
+	ForumPostTagChangeSourceBot   ForumPostTagChangeSource = "BOT"
+	ForumPostTagChangeSourceHuman ForumPostTagChangeSource = "HUMAN"
+)
+
+type ForumPostTagChangeAction string
+
+const (
+	// ForumPostTagChangeActionApplied means the tags were set on the forum post by the bot
+	ForumPostTagChangeActionApplied ForumPostTagChangeAction = "APPLIED"
+	// ForumPostTagChangeActionSuggested means the bot suggested the tags without changing the forum post
+	ForumPostTagChangeActionSuggested ForumPostTagChangeAction = "SUGGESTED"
+	// ForumPostTagChangeActionObserved means the tags were found on the forum post, set by someone else
+	ForumPostTagChangeActionObserved ForumPostTagChangeAction = "OBSERVED"
+)
+
+type ForumPostTagChange struct {
+	ID          int                      `json:"id"`
+	ForumPostID string                   `json:"forumPostId"`
+	TagIDs      []string                 `json:"tagIds"`
+	TagNames    []string                 `json:"tagNames"`
+	AppliedBy   ForumPostTagChangeSource `json:"appliedBy"`
+	Action      ForumPostTagChangeAction `json:"action"`
+	Reason      string                   `json:"reason"`
+	CreatedAt   time.Time                `json:"createdAt"`
+}
+
+type DeadLetterStatus string
+
+const (
+	DeadLetterStatusPending   DeadLetterStatus = "PENDING"
+	DeadLetterStatusReplaying DeadLetterStatus = "REPLAYING"
+	DeadLetterStatusReplayed  DeadLetterStatus = "REPLAYED"
+)
+
+type DeadLetter struct {
+	ID           int64            `json:"id"`
+	Topic        string           `json:"topic"`
+	Subscription string           `json:"subscription"`
+	Payload      json.RawMessage  `json:"payload"`
+	Error        string           `json:"error"`
+	Attempts     int              `json:"attempts"`
+	ReplayCount  int              `json:"replayCount"`
+	Status       DeadLetterStatus `json:"status"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
+
+// DeadLetterSettings configures the dead letter backlog alert
+type DeadLetterSettings struct {
+	// AlertChannelID receives the backlog alerts, they're disabled if empty
+	AlertChannelID string `json:"alertChannelId"`
+	// AlertThreshold is the amount of pending dead letters above which moderators get alerted
+	AlertThreshold int       `json:"alertThreshold"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+type DeadLetterReplayEvent struct {
+	DeadLetterID int64           `json:"deadLetterId"`
+	Subscription string          `json:"subscription"`
+	Payload      json.RawMessage `json:"payload"`
 }
 
 type KnowledgeBaseArticle struct {
@@ -70,3 +320,129 @@ type MessageSentimentStats struct {
 	Neutral  int `json:"neutral"`
 	Negative int `json:"negative"`
 }
+
+type InsightGranularity string
+
+const (
+	InsightGranularityHour  InsightGranularity = "hour"
+	InsightGranularityDay   InsightGranularity = "day"
+	InsightGranularityWeek  InsightGranularity = "week"
+	InsightGranularityMonth InsightGranularity = "month"
+)
+
+type InsightBucketStatus string
+
+const (
+	InsightBucketStatusPending   InsightBucketStatus = "PENDING"
+	InsightBucketStatusProcessed InsightBucketStatus = "PROCESSED"
+	InsightBucketStatusFailed    InsightBucketStatus = "FAILED"
+)
+
+// InsightBucket tracks the processing of the hourly insights of one hour
+type InsightBucket struct {
+	BucketStart time.Time           `json:"bucketStart"`
+	Status      InsightBucketStatus `json:"status"`
+	Attempts    int                 `json:"attempts"`
+	Error       string              `json:"error,omitempty"`
+	// AnalyzedMessages were classified by the LLM, SkippedMessages weren't because of failures or the budget
+	AnalyzedMessages int        `json:"analyzedMessages"`
+	SkippedMessages  int        `json:"skippedMessages"`
+	EstimatedTokens  int        `json:"estimatedTokens"`
+	ProcessedAt      *time.Time `json:"processedAt,omitempty"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+}
+
+type SentimentMode string
+
+const (
+	// SentimentModePerUser ranks the members by sentiment
+	SentimentModePerUser SentimentMode = "per_user"
+	// SentimentModeAggregate only reports the sentiment of channels & topics
+	SentimentModeAggregate SentimentMode = "aggregate"
+)
+
+type GuildInsightSettings struct {
+	GuildID string `json:"guildId"`
+	// Timezone is an IANA name, ie "Europe/Stockholm", day, week & month buckets start at midnight in it
+	Timezone string `json:"timezone"`
+	// ChampionsChannelID receives a weekly post celebrating the top helpers, it's disabled if empty
+	ChampionsChannelID string        `json:"championsChannelId"`
+	SentimentMode      SentimentMode `json:"sentimentMode"`
+	// MinSentimentMessages is the number of analyzed messages a member needs in a range before being ranked
+	MinSentimentMessages int       `json:"minSentimentMessages"`
+	UpdatedAt            time.Time `json:"updatedAt"`
+}
+
+// MessageReply is a message replying to another author's message, directly or in a thread started on it
+type MessageReply struct {
+	MessageID           string    `json:"messageId"`
+	AuthorID            string    `json:"authorId"`
+	ChannelID           string    `json:"channelId"`
+	CreatedAt           time.Time `json:"createdAt"`
+	ReferencedMessageID string    `json:"referencedMessageId"`
+	ReferencedAuthorID  string    `json:"referencedAuthorId"`
+}
+
+// ChampionStats counts how a member helped others
+type ChampionStats struct {
+	// RepliesToQuestions & Replies count the distinct messages of others replied to in chat
+	RepliesToQuestions int `json:"repliesToQuestions"`
+	Replies            int `json:"replies"`
+	// ForumThreadsHelped counts the forum threads of others the member posted in
+	ForumThreadsHelped int `json:"forumThreadsHelped"`
+	// SolvedThreads counts the solved forum threads where the member was the last to post besides the author
+	SolvedThreads     int `json:"solvedThreads"`
+	PositiveReactions int `json:"positiveReactions"`
+	Score             int `json:"score"`
+}
+
+type RetentionPolicy struct {
+	GuildID string `json:"guildId"`
+	// ChannelID is empty for the default policy of the guild
+	ChannelID     string    `json:"channelId"`
+	RetentionDays int       `json:"retentionDays"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// MessageArchive describes a compressed archive of messages removed by a retention policy
+type MessageArchive struct {
+	ID              int64     `json:"id"`
+	GuildID         string    `json:"guildId"`
+	ChannelID       string    `json:"channelId"`
+	MessageCount    int       `json:"messageCount"`
+	OldestMessageAt time.Time `json:"oldestMessageAt"`
+	NewestMessageAt time.Time `json:"newestMessageAt"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+type UserErasureStatus string
+
+const (
+	UserErasureStatusPending UserErasureStatus = "PENDING"
+	// UserErasureStatusMessagesErased means the indexed data is erased & the other services are being notified
+	UserErasureStatusMessagesErased UserErasureStatus = "MESSAGES_ERASED"
+	UserErasureStatusCompleted      UserErasureStatus = "COMPLETED"
+)
+
+type UserErasureRequest struct {
+	ID                int64             `json:"id"`
+	UserID            string            `json:"userId"`
+	RequestedBy       string            `json:"requestedBy"`
+	Reason            string            `json:"reason"`
+	Status            UserErasureStatus `json:"status"`
+	ErasedMessages    int               `json:"erasedMessages"`
+	ErasedVectors     int               `json:"erasedVectors"`
+	RewrittenArchives int               `json:"rewrittenArchives"`
+	InsightsErasedAt  *time.Time        `json:"insightsErasedAt"`
+	// ConfirmedServices are the services which erased their data of the user so far
+	ConfirmedServices []string   `json:"confirmedServices"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	CompletedAt       *time.Time `json:"completedAt"`
+}
+
+// UserDataErasureEvent asks services to erase everything they store about a user
+type UserDataErasureEvent struct {
+	RequestID int64  `json:"requestId"`
+	UserID    string `json:"userId"`
+}
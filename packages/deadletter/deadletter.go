@@ -0,0 +1,78 @@
+// Package deadletter captures messages which pubsub subscriptions failed to process
+// in the dead letter queue & replays them back into the original handler.
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	deadletterqueue "encore.app/dead_letter_queue"
+	"encore.app/models"
+	"encore.dev"
+	"encore.dev/rlog"
+)
+
+// Handler wraps a subscription handler & records the message in the dead letter queue
+// once its last delivery attempt fails, instead of letting it vanish.
+// Services keep the subscription name in a const next to the subscription, which is shared with
+// their dead letter replay handler; pubsub.NewSubscription itself only accepts the name as a literal.
+func Handler[T any](
+	topic, subscription string, maxRetries int, handler func(ctx context.Context, msg T) error,
+) func(ctx context.Context, msg T) error {
+	return func(ctx context.Context, msg T) error {
+		handlerErr := handler(ctx, msg)
+		if handlerErr == nil {
+			return nil
+		}
+
+		attempt := 1
+		if req := encore.CurrentRequest(); req.Message != nil {
+			attempt = req.Message.DeliveryAttempt
+		}
+
+		if attempt <= maxRetries {
+			return handlerErr
+		}
+
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			rlog.Error("Couldn't marshal dead letter", "subscription", subscription, "error", err)
+			return handlerErr
+		}
+
+		_, err = deadletterqueue.RecordDeadLetter(ctx, &deadletterqueue.RecordDeadLetterRequest{
+			Topic:        topic,
+			Subscription: subscription,
+			Payload:      payload,
+			Error:        handlerErr.Error(),
+			Attempts:     attempt,
+		})
+		if err != nil {
+			rlog.Error("Couldn't record dead letter", "subscription", subscription, "error", err)
+			return handlerErr
+		}
+
+		// the message is safely stored in the dead letter queue, so it can be acknowledged
+		return nil
+	}
+}
+
+// Replay passes a replayed dead letter to the handler of the subscription it failed in
+// & reports the outcome back to the dead letter queue.
+func Replay[T any](
+	ctx context.Context, evt *models.DeadLetterReplayEvent, handler func(ctx context.Context, msg T) error,
+) error {
+	var msg T
+	if err := json.Unmarshal(evt.Payload, &msg); err != nil {
+		return fmt.Errorf("couldn't unmarshal dead letter payload: %w", err)
+	}
+
+	req := &deadletterqueue.CompleteDeadLetterReplayRequest{}
+	if err := handler(ctx, msg); err != nil {
+		rlog.Warn("Dead letter replay failed", "deadLetterId", evt.DeadLetterID, "error", err)
+		req.Error = err.Error()
+	}
+
+	return deadletterqueue.CompleteDeadLetterReplay(ctx, evt.DeadLetterID, req)
+}
@@ -33,6 +33,12 @@ var triageMessageFuncSchema string
 //go:embed triage_message_prompt.txt
 var triageMessagePrompt string
 
+//go:embed triage_conversation_func.json
+var triageConversationFuncSchema string
+
+//go:embed triage_conversation_prompt.txt
+var triageConversationPrompt string
+
 //go:embed tag_forum_post_prompt.txt
 var tagForumPostPrompt string
 
@@ -45,12 +51,18 @@ var findMessagesMatchingTopicPrompt string
 //go:embed answer_forum_post_prompt.txt
 var answerForumPostPrompt string
 
-//go:embed match_message_to_topic_prompt.txt
-var matchMessageToTopicPrompt string
-
 //go:embed evaluate_message_sentiment_prompt.txt
 var evaluateMessageSentimentPrompt string
 
+//go:embed analyze_messages_prompt.txt
+var analyzeMessagesPrompt string
+
+//go:embed analyze_messages_sentiment_prompt.txt
+var analyzeMessagesSentimentPrompt string
+
+//go:embed label_topic_cluster_prompt.txt
+var labelTopicClusterPrompt string
+
 func NewService() (*Service, error) {
 	chatGpt35Client, err := openai.NewChat(openai.WithModel("gpt-3.5-turbo-0613"), openai.WithToken(secrets.OpenAIAPIKey))
 	if err != nil {
@@ -168,6 +180,50 @@ func (s *Service) TriageMessageTopic(ctx context.Context, messageContents string
 	return result.Topic, nil
 }
 
+type ConversationTriageResult struct {
+	Topic    string `json:"topic"`
+	Answered bool   `json:"answered"`
+}
+
+// TriageConversation determines the topic of a (possibly multi-message) request by a user
+// and whether the replies which followed it already answered it.
+func (s *Service) TriageConversation(
+	ctx context.Context, requestMessages, replies []string,
+) (*ConversationTriageResult, error) {
+	var llmFunctions = []llms.FunctionDefinition{
+		{
+			Name:        "setConversationTopic",
+			Description: "Sets the topic of the request & whether it was answered",
+			Parameters:  json.RawMessage(triageConversationFuncSchema),
+		},
+	}
+
+	repliesInput := "There are no replies."
+	if len(replies) > 0 {
+		repliesInput = strings.Join(lo.Map(replies, func(reply string, i int) string {
+			return fmt.Sprintf("\nreply %d:\n---\n%s\n---\n", i, reply)
+		}), "")
+	}
+
+	completion, err := s.chatGpt35Client.Call(ctx, []schema.ChatMessage{
+		schema.HumanChatMessage{Content: triageConversationPrompt},
+		schema.HumanChatMessage{Content: "Here's the user's request: " + strings.Join(requestMessages, "\n")},
+		schema.HumanChatMessage{Content: "Here are the replies which followed it: " + repliesInput},
+	}, llms.WithFunctions(llmFunctions))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't call openai: %w", err)
+	} else if completion.FunctionCall == nil {
+		return nil, errors.New("No function call found in completion")
+	}
+
+	var result ConversationTriageResult
+	if err := json.Unmarshal([]byte(completion.FunctionCall.Arguments), &result); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal function call arguments: %w", err)
+	}
+
+	return &result, nil
+}
+
 func (s *Service) SuggestTitleForMessage(ctx context.Context, messageContents string) (string, error) {
 	var llmFunctions = []llms.FunctionDefinition{
 		{
@@ -282,32 +338,31 @@ func (s *Service) AnswerForumPost(
 	return completion.Content, nil
 }
 
-func (s *Service) MatchMessageToTopic(
+func (s *Service) EvaluateMessageSentiment(
 	ctx context.Context,
 	message *models.DiscordRawMessage,
-	topics []string,
-) (string, error) {
+) (models.MessageSentiment, error) {
 	var llmFunctions = []llms.FunctionDefinition{
 		{
-			Name:        "setTopicForMessage",
-			Description: "Sets the topic for the given message",
+			Name:        "setMessageSentiment",
+			Description: "Sets the sentiment of the given message",
 			Parameters: json.RawMessage(fmt.Sprintf(`
 				{
 				  "type": "object",
 				  "properties": {
-					"matchingTopic": {
+					"messageSentiment": {
 					    "type": "string"
 					}
 				  },
-				  "required": ["matchingTopic"]
+				  "required": ["messageSentiment"]
 				}
 			`)),
 		},
 	}
 
 	completion, err := s.chatGpt35Client.Call(ctx, []schema.ChatMessage{
-		schema.HumanChatMessage{Content: fmt.Sprintf(matchMessageToTopicPrompt, strings.Join(topics, ", "))},
-		schema.HumanChatMessage{Content: "Here's the message you have to match:"},
+		schema.HumanChatMessage{Content: fmt.Sprintf(evaluateMessageSentimentPrompt)},
+		schema.HumanChatMessage{Content: "Here's the message you have to evaluate:"},
 		schema.HumanChatMessage{Content: message.CleanContent},
 	}, llms.WithFunctions(llmFunctions))
 	if err != nil {
@@ -315,63 +370,184 @@ func (s *Service) MatchMessageToTopic(
 	}
 
 	var result struct {
-		MatchingTopic string `json:"matchingTopic"`
+		MessageSentiment string `json:"messageSentiment"`
 	}
 
 	if err := json.Unmarshal([]byte(completion.FunctionCall.Arguments), &result); err != nil {
 		return "", fmt.Errorf("couldn't unmarshal function call arguments: %w", err)
 	}
 
-	return result.MatchingTopic, nil
+	switch strings.ToUpper(result.MessageSentiment) {
+	case "POSITIVE":
+		return models.MessageSentimentPositive, nil
+	case "NEUTRAL":
+		return models.MessageSentimentNeutral, nil
+	case "NEGATIVE":
+		return models.MessageSentimentNegative, nil
+	default:
+		return "", fmt.Errorf("ChatGPT generated an invalid message sentiment: %s", result.MessageSentiment)
+	}
+}
+
+type MessageAnalysis struct {
+	Topic     string                  `json:"topic"`
+	Sentiment models.MessageSentiment `json:"sentiment"`
+	Language  string                  `json:"language"`
 }
 
-func (s *Service) EvaluateMessageSentiment(
+// AnalyzeMessages determines the topic, sentiment & language of many messages in a single call.
+// Without withSentiment the model isn't asked for the sentiment & the analyses have none.
+// The analyses are keyed by message ID, messages the model skipped or analyzed invalidly are left out.
+func (s *Service) AnalyzeMessages(
 	ctx context.Context,
-	message *models.DiscordRawMessage,
-) (models.MessageSentiment, error) {
+	messages []*models.DiscordRawMessage,
+	topics []string,
+	withSentiment bool,
+) (map[string]*MessageAnalysis, error) {
+	if len(messages) == 0 {
+		return map[string]*MessageAnalysis{}, nil
+	}
+
+	topicsEnum, err := json.Marshal(topics)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal topics: %w", err)
+	}
+
+	description := "Sets the topic & language of each message"
+	sentimentProperty, sentimentRequired, sentimentPrompt := "", "", ""
+	if withSentiment {
+		description = "Sets the topic, sentiment & language of each message"
+		sentimentProperty = `"sentiment": { "type": "string", "enum": ["Positive", "Neutral", "Negative"] },`
+		sentimentRequired = `"sentiment", `
+		sentimentPrompt = analyzeMessagesSentimentPrompt
+	}
+
 	var llmFunctions = []llms.FunctionDefinition{
 		{
-			Name:        "setMessageSentiment",
-			Description: "Sets the sentiment of the given message",
+			Name:        "setMessageAnalyses",
+			Description: description,
 			Parameters: json.RawMessage(fmt.Sprintf(`
 				{
 				  "type": "object",
 				  "properties": {
-					"messageSentiment": {
-					    "type": "string"
+					"analyses": {
+					  "type": "array",
+					  "items": {
+						"type": "object",
+						"properties": {
+						  "message": { "type": "integer" },
+						  "topic": { "type": "string", "enum": %s },
+						  %s
+						  "language": { "type": "string" }
+						},
+						"required": ["message", "topic", %s"language"]
+					  }
 					}
 				  },
-				  "required": ["messageSentiment"]
+				  "required": ["analyses"]
 				}
-			`)),
+			`, topicsEnum, sentimentProperty, sentimentRequired)),
 		},
 	}
 
+	messagesInput := strings.Join(lo.Map(messages, func(message *models.DiscordRawMessage, i int) string {
+		return fmt.Sprintf("\nmessage %d:\n---\n%s\n---\n", i, message.CleanContent)
+	}), "")
+
 	completion, err := s.chatGpt35Client.Call(ctx, []schema.ChatMessage{
-		schema.HumanChatMessage{Content: fmt.Sprintf(evaluateMessageSentimentPrompt)},
-		schema.HumanChatMessage{Content: "Here's the message you have to evaluate:"},
-		schema.HumanChatMessage{Content: message.CleanContent},
+		schema.HumanChatMessage{Content: fmt.Sprintf(analyzeMessagesPrompt, strings.Join(topics, ", "), sentimentPrompt)},
+		schema.HumanChatMessage{Content: "Here's the messages you have to analyze:"},
+		schema.HumanChatMessage{Content: messagesInput},
 	}, llms.WithFunctions(llmFunctions))
 	if err != nil {
-		return "", fmt.Errorf("couldn't call openai: %w", err)
+		return nil, fmt.Errorf("couldn't call openai: %w", err)
+	} else if completion.FunctionCall == nil {
+		return nil, errors.New("No function call found in completion")
 	}
 
 	var result struct {
-		MessageSentiment string `json:"messageSentiment"`
+		Analyses []struct {
+			Message   int    `json:"message"`
+			Topic     string `json:"topic"`
+			Sentiment string `json:"sentiment"`
+			Language  string `json:"language"`
+		} `json:"analyses"`
 	}
-
 	if err := json.Unmarshal([]byte(completion.FunctionCall.Arguments), &result); err != nil {
-		return "", fmt.Errorf("couldn't unmarshal function call arguments: %w", err)
+		return nil, fmt.Errorf("couldn't unmarshal function call arguments: %w", err)
 	}
 
-	switch strings.ToUpper(result.MessageSentiment) {
-	case "POSITIVE":
-		return models.MessageSentimentPositive, nil
-	case "NEUTRAL":
-		return models.MessageSentimentNeutral, nil
-	case "NEGATIVE":
-		return models.MessageSentimentNegative, nil
-	default:
-		return "", fmt.Errorf("ChatGPT generated an invalid message sentiment: %s", result.MessageSentiment)
+	analyses := make(map[string]*MessageAnalysis)
+	for _, analysis := range result.Analyses {
+		sentiment := models.MessageSentiment(strings.ToUpper(analysis.Sentiment))
+		if !withSentiment {
+			sentiment = ""
+		}
+
+		if analysis.Message < 0 || analysis.Message >= len(messages) {
+			rlog.Warn("ChatGPT analyzed an invalid message", "message", analysis.Message)
+			continue
+		} else if !lo.Contains(topics, analysis.Topic) || (withSentiment && !lo.Contains([]models.MessageSentiment{
+			models.MessageSentimentPositive, models.MessageSentimentNeutral, models.MessageSentimentNegative,
+		}, sentiment)) {
+			rlog.Warn("ChatGPT generated an invalid message analysis",
+				"topic", analysis.Topic, "sentiment", analysis.Sentiment)
+			continue
+		}
+
+		analyses[messages[analysis.Message].ID] = &MessageAnalysis{
+			Topic:     analysis.Topic,
+			Sentiment: sentiment,
+			Language:  strings.ToLower(analysis.Language),
+		}
+	}
+
+	return analyses, nil
+}
+
+type TopicClusterLabel struct {
+	Label   string `json:"label"`
+	Summary string `json:"summary"`
+}
+
+// LabelTopicCluster names the subject shared by a group of similar messages.
+func (s *Service) LabelTopicCluster(ctx context.Context, messages []string) (*TopicClusterLabel, error) {
+	var llmFunctions = []llms.FunctionDefinition{
+		{
+			Name:        "setTopicLabel",
+			Description: "Sets the label & summary of the subject the messages share",
+			Parameters: json.RawMessage(`
+				{
+				  "type": "object",
+				  "properties": {
+					"label": { "type": "string" },
+					"summary": { "type": "string" }
+				  },
+				  "required": ["label", "summary"]
+				}
+			`),
+		},
+	}
+
+	messagesInput := strings.Join(lo.Map(messages, func(message string, i int) string {
+		return fmt.Sprintf("\nmessage %d:\n---\n%s\n---\n", i, message)
+	}), "")
+
+	completion, err := s.chatGpt35Client.Call(ctx, []schema.ChatMessage{
+		schema.HumanChatMessage{Content: labelTopicClusterPrompt},
+		schema.HumanChatMessage{Content: "Here's the messages:"},
+		schema.HumanChatMessage{Content: messagesInput},
+	}, llms.WithFunctions(llmFunctions))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't call openai: %w", err)
+	} else if completion.FunctionCall == nil {
+		return nil, errors.New("No function call found in completion")
+	}
+
+	var result TopicClusterLabel
+	if err := json.Unmarshal([]byte(completion.FunctionCall.Arguments), &result); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal function call arguments: %w", err)
 	}
+
+	return &result, nil
 }
@@ -0,0 +1,122 @@
+// Package outbox implements the transactional outbox pattern.
+// Services using it need an "outbox" table in their database,
+// see community_message_mapper/migrations/2_outbox.up.sql for its schema.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// batchSize is the max amount of events published per relay run
+const batchSize = 100
+
+// Publisher publishes a serialized outbox event to its pubsub topic
+type Publisher func(ctx context.Context, payload []byte) error
+
+// Insert stores an event in the outbox as part of the given transaction,
+// so that it's only published if the transaction commits.
+// Events with an already existing dedup key are ignored, in which case false is returned.
+func Insert(ctx context.Context, tx *sqldb.Tx, topic, dedupKey string, event any) (bool, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return false, fmt.Errorf("couldn't marshal outbox event: %w", err)
+	}
+
+	result, err := tx.Exec(ctx, `
+		INSERT INTO outbox (topic, dedup_key, payload)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (dedup_key) DO NOTHING
+	`, topic, dedupKey, payload)
+	if err != nil {
+		return false, fmt.Errorf("couldn't insert outbox event: %w", err)
+	}
+
+	return result.RowsAffected() > 0, nil
+}
+
+// Relay publishes pending outbox events of a service database
+type Relay struct {
+	db         *sqldb.Database
+	publishers map[string]Publisher
+}
+
+func NewRelay(db *sqldb.Database, publishers map[string]Publisher) *Relay {
+	return &Relay{db: db, publishers: publishers}
+}
+
+// PublishPending publishes all pending events in the outbox & marks them as sent.
+// Rows are locked while publishing, so concurrent relays don't publish the same event twice.
+// It stops at the first event which couldn't be published & returns its error.
+func (r *Relay) PublishPending(ctx context.Context) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, topic, payload
+		FROM outbox
+		WHERE sent_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, batchSize)
+	if err != nil {
+		return fmt.Errorf("couldn't query outbox: %w", err)
+	}
+
+	type pendingEvent struct {
+		id      int64
+		topic   string
+		payload []byte
+	}
+
+	var events []pendingEvent
+	for rows.Next() {
+		var event pendingEvent
+		if err := rows.Scan(&event.id, &event.topic, &event.payload); err != nil {
+			rows.Close()
+			return fmt.Errorf("couldn't scan outbox event: %w", err)
+		}
+
+		events = append(events, event)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("couldn't read outbox: %w", err)
+	}
+
+	var publishErr error
+	for _, event := range events {
+		publish, ok := r.publishers[event.topic]
+		if !ok {
+			rlog.Error("No publisher configured for outbox topic", "topic", event.topic, "id", event.id)
+			continue
+		}
+
+		if err := publish(ctx, event.payload); err != nil {
+			// stop here to preserve the event order, the rest will be picked up by the next run
+			publishErr = fmt.Errorf("couldn't publish outbox event %d: %w", event.id, err)
+			break
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE outbox SET sent_at = now() WHERE id = $1", event.id)
+		if err != nil {
+			return fmt.Errorf("couldn't mark outbox event as sent: %w", err)
+		}
+	}
+
+	// the events published before the failure are marked as sent either way
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+
+	return publishErr
+}